@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /api/admin/* is for people running the instance. Admins are configured
+// with NOTED_ADMINS secret: comma-separated GitHub logins or user ids
+// (e.g. "kjk,local-jo")
+//
+// /api/admin/users : users with store sizes, record counts and last activity
+// /api/admin/closeStore?user=${id} : close user's open store
+// /api/admin/compact?user=${id} : re-write user's store without over-written records
+// /api/admin/gc : run Go garbage collector and return memory to the OS
+// /api/admin/errors : recent errors
+// /api/admin/events : analytics events per day, see events.go
+// /api/admin/backup : status of backups, see backup.go
+
+var (
+	adminLogins []string
+
+	errStoreClosed = errors.New("store was closed by admin, please retry")
+)
+
+func parseAdminLogins(s string) []string {
+	var res []string
+	for _, login := range strings.Split(s, ",") {
+		login = strings.TrimSpace(login)
+		if login != "" {
+			res = append(res, login)
+		}
+	}
+	return res
+}
+
+func isAdmin(u *UserInfo) bool {
+	for _, login := range adminLogins {
+		if login == u.ID {
+			return true
+		}
+		if strings.HasPrefix(u.ID, "github-") && strings.EqualFold(login, u.User) {
+			return true
+		}
+	}
+	return false
+}
+
+const maxRecentErrors = 100
+
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	Msg       string    `json:"msg"`
+	Callstack string    `json:"callstack"`
+}
+
+var (
+	recentErrors   []*RecentError
+	muRecentErrors sync.Mutex
+)
+
+// called from logErrorf() and logIfErrf()
+func rememberError(msg string, callstack string) {
+	e := &RecentError{
+		Time:      time.Now().UTC(),
+		Msg:       strings.TrimSpace(msg),
+		Callstack: callstack,
+	}
+	muRecentErrors.Lock()
+	defer muRecentErrors.Unlock()
+	recentErrors = append(recentErrors, e)
+	if n := len(recentErrors) - maxRecentErrors; n > 0 {
+		recentErrors = slices.Delete(recentErrors, 0, n)
+	}
+}
+
+// most recent first
+func getRecentErrors() []*RecentError {
+	muRecentErrors.Lock()
+	defer muRecentErrors.Unlock()
+	res := slices.Clone(recentErrors)
+	slices.Reverse(res)
+	return res
+}
+
+type AdminUserInfo struct {
+	ID           string    `json:"id"`
+	Login        string    `json:"login"`
+	Emails       []string  `json:"emails"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastLoginAt  time.Time `json:"last_login_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+	StoreSize    int64     `json:"store_size"`
+	RecordsCount int       `json:"records_count"`
+	// store is open in memory
+	IsOpen bool `json:"is_open"`
+}
+
+// size of data and index files and number of records (including over-written)
+func storeDirStats(dir string) (int64, int) {
+	var size int64
+	for _, name := range []string{"data.bin", "index.txt"} {
+		if st, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			size += st.Size()
+		}
+	}
+	d, err := os.ReadFile(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		return size, 0
+	}
+	return size, bytes.Count(d, []byte{'\n'})
+}
+
+func adminListUsers() ([]*AdminUserInfo, error) {
+	dirs, err := listUserStoreDirs()
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*AdminUserInfo{}
+	var res []*AdminUserInfo
+	for _, ru := range listRegisteredUsers() {
+		ui := &AdminUserInfo{
+			ID:          ru.ID,
+			Login:       ru.Login,
+			Emails:      ru.Emails,
+			CreatedAt:   ru.CreatedAt,
+			LastLoginAt: ru.LastLoginAt,
+			LastSeenAt:  ru.LastLoginAt,
+		}
+		byID[ru.ID] = ui
+		res = append(res, ui)
+	}
+	// stores of users who didn't log in since we have users.json
+	for _, dir := range dirs {
+		id := filepath.Base(dir)
+		if byID[id] == nil {
+			ui := &AdminUserInfo{ID: id}
+			byID[id] = ui
+			res = append(res, ui)
+		}
+	}
+	for id, t := range sessionsLastSeen() {
+		if ui := byID[id]; ui != nil && t.After(ui.LastSeenAt) {
+			ui.LastSeenAt = t
+		}
+	}
+	for _, ui := range res {
+		ui.StoreSize, ui.RecordsCount = storeDirStats(userDataDir(ui.ID))
+	}
+
+	muStore.Lock()
+	for _, u := range users {
+		if ui := byID[u.ID]; ui != nil {
+			ui.IsOpen = true
+			ui.RecordsCount = len(u.Store.AllRecords())
+		}
+	}
+	muStore.Unlock()
+
+	slices.SortFunc(res, func(a, b *AdminUserInfo) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+	return res, nil
+}
+
+// must hold muStore. Returns false if store was not open.
+// Next request of the user will re-open the store.
+func closeUserStoreLocked(id string) (bool, error) {
+	idx := slices.IndexFunc(users, func(u *UserInfo) bool {
+		return u.ID == id
+	})
+	if idx < 0 {
+		return false, nil
+	}
+	u := users[idx]
+	users = slices.Delete(users, idx, idx+1)
+
+	// waits for reads and writes in progress
+	u.storeMu.Lock()
+	defer u.storeMu.Unlock()
+	u.storeClosed = true
+	return true, u.Store.CloseFiles()
+}
+
+func adminCloseStore(id string) (bool, error) {
+	muStore.Lock()
+	defer muStore.Unlock()
+	return closeUserStoreLocked(id)
+}
+
+// holds muStore for the duration so that nobody can open the store
+// while we re-write it. Returns store size before and after.
+func adminCompactStore(id string) (int64, int64, error) {
+	dir := userDataDir(id)
+	sizeBefore, _ := storeDirStats(dir)
+	if _, err := os.Stat(filepath.Join(dir, "index.txt")); err != nil {
+		return 0, 0, fmt.Errorf("user '%s' doesn't have a store", id)
+	}
+
+	muStore.Lock()
+	defer muStore.Unlock()
+	_, err := closeUserStoreLocked(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	keys, err := loadDataKeys(dir, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = rewriteStore(dir, keys)
+	if err != nil {
+		return 0, 0, err
+	}
+	sizeAfter, _ := storeDirStats(dir)
+	logf("adminCompactStore: compacted store of '%s' from %s to %s\n", id, formatSize(sizeBefore), formatSize(sizeAfter))
+	return sizeBefore, sizeAfter, nil
+}
+
+func getAdminUserArg(w http.ResponseWriter, r *http.Request) string {
+	id := strings.TrimSpace(r.FormValue("user"))
+	if !isValidUserID(id) {
+		serveError(w, r, fmt.Sprintf("invalid user id '%s'", id), http.StatusBadRequest)
+		return ""
+	}
+	return id
+}
+
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	u, err := getLoggedUser(r, w)
+	if serveIfError(w, r, err) {
+		return
+	}
+	if !isAdmin(u) {
+		serveError(w, r, "only for admins", http.StatusForbidden)
+		return
+	}
+	if !checkScope(w, r, scopeAdmin) {
+		return
+	}
+	logCtxf(r.Context(), "handleAdmin: %s by '%s'\n", r.URL.Path, u.ID)
+
+	switch r.URL.Path {
+	case "/api/admin/users":
+		res, err := adminListUsers()
+		if serveIfError(w, r, err) {
+			return
+		}
+		serveJSONOK(w, r, res)
+	case "/api/admin/closeStore":
+		if !checkMethodPOSTorPUT(w, r) {
+			return
+		}
+		id := getAdminUserArg(w, r)
+		if id == "" {
+			return
+		}
+		wasOpen, err := adminCloseStore(id)
+		if serveIfError(w, r, err) {
+			return
+		}
+		serveJSONOK(w, r, map[string]any{"ok": true, "was_open": wasOpen})
+	case "/api/admin/compact":
+		if !checkMethodPOSTorPUT(w, r) {
+			return
+		}
+		id := getAdminUserArg(w, r)
+		if id == "" {
+			return
+		}
+		before, after, err := adminCompactStore(id)
+		if serveIfError(w, r, err) {
+			return
+		}
+		serveJSONOK(w, r, map[string]any{"ok": true, "size_before": before, "size_after": after})
+	case "/api/admin/gc":
+		if !checkMethodPOSTorPUT(w, r) {
+			return
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		debug.FreeOSMemory()
+		runtime.ReadMemStats(&after)
+		res := map[string]any{
+			"heap_alloc_before": before.HeapAlloc,
+			"heap_alloc_after":  after.HeapAlloc,
+			"heap_sys_after":    after.HeapSys,
+			"goroutines":        runtime.NumGoroutine(),
+		}
+		serveJSONOK(w, r, res)
+	case "/api/admin/errors":
+		serveJSONOK(w, r, getRecentErrors())
+	case "/api/admin/events":
+		handleAdminEvents(w, r)
+	case "/api/admin/backup":
+		serveJSONOK(w, r, getBackupStatus())
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func TestIsAdmin(t *testing.T) {
+	adminLogins = parseAdminLogins(" kjk, local-jo,,")
+	defer func() { adminLogins = nil }()
+	assert.Equal(t, len(adminLogins), 2)
+
+	assert.True(t, isAdmin(&UserInfo{ID: "github-1", User: "KJK"}))
+	assert.True(t, isAdmin(&UserInfo{ID: "local-jo", User: "jo"}))
+	// only GitHub logins, a local user can pick any login
+	assert.False(t, isAdmin(&UserInfo{ID: "local-kjk", User: "kjk"}))
+	assert.False(t, isAdmin(&UserInfo{ID: "github-2", User: "jo"}))
+}
+
+func TestRecentErrors(t *testing.T) {
+	for i := 0; i < maxRecentErrors+10; i++ {
+		rememberError(fmt.Sprintf("error %d", i), "")
+	}
+	errs := getRecentErrors()
+	assert.Equal(t, len(errs), maxRecentErrors)
+	assert.Equal(t, errs[0].Msg, fmt.Sprintf("error %d", maxRecentErrors+9))
+}
+
+func TestAdminCompactStore(t *testing.T) {
+	for _, withKeys := range []bool{false, true} {
+		dataDir = t.TempDir()
+		if withKeys {
+			mk, err := parseMasterKeys("k1:" + strings.Repeat("ab", 32))
+			assert.NoError(t, err)
+			masterKeys = mk
+		}
+		dir := userDataDir("local-jo")
+		u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: dir, OverWriteDataExpandPercent: 100}}
+		assert.NoError(t, appendstore.OpenStore(u.Store))
+		var err error
+		u.dataKeys, err = loadDataKeys(dir, true)
+		assert.NoError(t, err)
+		users = append(users, u)
+
+		assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("note01", "note", "md", false)))
+		assert.NoError(t, storeAddNoteVersion(ctx(), u, "note01", []byte("hello"), 0, false))
+		// the first one is appended with space for over-writing, the second
+		// over-writes it in place
+		for _, s := range []string{"v1 with padding", "v2"} {
+			d := []byte(s)
+			if u.dataKeys != nil {
+				d = sealRecord(u.dataKeys, "settings", "", d)
+			}
+			assert.NoError(t, u.Store.OverwriteRecord("settings", "", d))
+		}
+		assert.Equal(t, len(u.Store.AllRecords()), 5)
+		assert.Equal(t, len(u.Store.Records()), 4)
+		assert.True(t, u.Store.AllRecords()[3].Overwritten)
+
+		before, after, err := adminCompactStore("local-jo")
+		assert.NoError(t, err)
+		assert.True(t, after < before)
+		assert.Equal(t, len(users), 0)
+
+		// requests that still have the old UserInfo
+		assert.Equal(t, storeAppendLog(ctx(), u, mkLogChangeTitle("note01", "new title")), errStoreClosed)
+		_, err = storeReadRecord(u, u.Store.Records()[0])
+		assert.Equal(t, err, errStoreClosed)
+
+		u2 := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: dir}}
+		assert.NoError(t, appendstore.OpenStore(u2.Store))
+		u2.dataKeys, err = loadDataKeys(dir, false)
+		assert.NoError(t, err)
+		assert.Equal(t, len(u2.Store.AllRecords()), 4)
+		assert.Equal(t, len(u2.Store.Records()), 4)
+		var contents []string
+		for _, rec := range u2.Store.Records() {
+			d, err := storeReadRecord(u2, rec)
+			assert.NoError(t, err)
+			contents = append(contents, string(d))
+		}
+		assert.Equal(t, contents[1], "hello")
+		assert.Equal(t, contents[3], "v2")
+		logs, err := storeGetLogs(ctx(), u2, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, notesFromLogs(logs).Get("note01").Title, "note")
+		assert.NoError(t, u2.Store.CloseFiles())
+
+		_, _, err = adminCompactStore("local-ann")
+		assert.Error(t, err)
+		masterKeys = nil
+		dataDir = ""
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+)
+
+/*
+Encryption at rest of user stores (data.bin).
+
+Each record is encrypted with AES-256-GCM using per-user data key.
+Data keys are stored in <user dir>/datakeys.json wrapped (encrypted)
+with a master key. Master keys come from secrets:
+
+NOTED_MASTER_KEYS=k2:<64 hex chars>,k1:<64 hex chars>
+
+The first master key is used for wrapping, the others are only used
+to unwrap data keys wrapped with older master keys.
+
+Encrypted record: atRestMagic, len(key id) byte, key id, nonce, ciphertext.
+Stores created before encryption was enabled have plaintext records.
+datakeys.json records the offset in data.bin from which records are
+encrypted (we only append to data.bin) so we never have to guess from
+the content of a record. After re-writing the store all records are
+encrypted.
+
+Rotation / migration (run with the server stopped):
+-encrypt-stores    : encrypt plaintext records of all stores
+-rotate-master-key : re-wrap data keys with the current master key
+-rotate-data-keys  : new data key for each user, re-encrypt all records
+*/
+
+const (
+	atRestMagic      = "\x00nte"
+	dataKeysFileName = "datakeys.json"
+)
+
+type masterKey struct {
+	ID  string
+	Key []byte
+}
+
+// first is current, set in loadSecrets()
+var masterKeys []*masterKey
+
+// "k2:<hex>,k1:<hex>"
+func parseMasterKeys(s string) ([]*masterKey, error) {
+	var res []*masterKey
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, keyHex, ok := strings.Cut(part, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid master key '%s', must be id:hex", id)
+		}
+		key, err := hex.DecodeString(keyHex)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid master key '%s', must be 64 hex chars", id)
+		}
+		res = append(res, &masterKey{ID: id, Key: key})
+	}
+	return res, nil
+}
+
+func findMasterKey(id string) *masterKey {
+	for _, k := range masterKeys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// returns nonce + ciphertext
+func gcmSeal(aead cipher.AEAD, d []byte, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	must(err)
+	return aead.Seal(nonce, nonce, d, additional)
+}
+
+func gcmOpen(aead cipher.AEAD, d []byte, additional []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(d) < n {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return aead.Open(nil, d[:n], d[n:], additional)
+}
+
+// as stored in datakeys.json
+type wrappedDataKey struct {
+	ID          string `json:"id"`
+	MasterKeyID string `json:"master_key_id"`
+	// base64 of nonce + data key encrypted with the master key
+	Wrapped string `json:"wrapped"`
+}
+
+type dataKeysFile struct {
+	// first is current
+	Keys []*wrappedDataKey `json:"keys"`
+	// records at this offset in data.bin and after are encrypted,
+	// records before are plaintext
+	EncryptedFrom int64 `json:"encrypted_from"`
+}
+
+type dataKey struct {
+	ID   string
+	key  []byte
+	aead cipher.AEAD
+}
+
+type dataKeys struct {
+	// first is current, used for new records
+	keys []*dataKey
+	// see dataKeysFile
+	encryptedFrom int64
+}
+
+func (k *dataKeys) current() *dataKey {
+	return k.keys[0]
+}
+
+func (k *dataKeys) find(id string) *dataKey {
+	for _, dk := range k.keys {
+		if dk.ID == id {
+			return dk
+		}
+	}
+	return nil
+}
+
+func newDataKey() (*dataKey, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{ID: genSecureRandomHex(4), key: key, aead: aead}, nil
+}
+
+func wrapDataKey(dk *dataKey) (*wrappedDataKey, error) {
+	mk := masterKeys[0]
+	aead, err := newGCM(mk.Key)
+	if err != nil {
+		return nil, err
+	}
+	d := gcmSeal(aead, dk.key, []byte(dk.ID))
+	return &wrappedDataKey{
+		ID:          dk.ID,
+		MasterKeyID: mk.ID,
+		Wrapped:     base64.StdEncoding.EncodeToString(d),
+	}, nil
+}
+
+func unwrapDataKey(wk *wrappedDataKey) (*dataKey, error) {
+	mk := findMasterKey(wk.MasterKeyID)
+	if mk == nil {
+		return nil, fmt.Errorf("master key '%s' needed for data key '%s' is not configured", wk.MasterKeyID, wk.ID)
+	}
+	aead, err := newGCM(mk.Key)
+	if err != nil {
+		return nil, err
+	}
+	d, err := base64.StdEncoding.DecodeString(wk.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	key, err := gcmOpen(aead, d, []byte(wk.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key '%s' with master key '%s': %w", wk.ID, mk.ID, err)
+	}
+	aead, err = newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{ID: wk.ID, key: key, aead: aead}, nil
+}
+
+func saveDataKeys(dir string, keys *dataKeys) error {
+	f := dataKeysFile{
+		EncryptedFrom: keys.encryptedFrom,
+	}
+	for _, dk := range keys.keys {
+		wk, err := wrapDataKey(dk)
+		if err != nil {
+			return err
+		}
+		f.Keys = append(f.Keys, wk)
+	}
+	return writeJSONFileAtomic(filepath.Join(dir, dataKeysFileName), &f)
+}
+
+// returns nil if store in dir is not encrypted and we don't have master keys
+// if we have master keys, we create a data key for new stores
+func loadDataKeys(dir string, create bool) (*dataKeys, error) {
+	var f dataKeysFile
+	err := readJSONFile(filepath.Join(dir, dataKeysFileName), &f)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if len(masterKeys) == 0 {
+			return nil, fmt.Errorf("store '%s' is encrypted but NOTED_MASTER_KEYS is not set", dir)
+		}
+		res := &dataKeys{
+			encryptedFrom: f.EncryptedFrom,
+		}
+		for _, wk := range f.Keys {
+			dk, err := unwrapDataKey(wk)
+			if err != nil {
+				return nil, err
+			}
+			res.keys = append(res.keys, dk)
+		}
+		if len(res.keys) == 0 {
+			return nil, fmt.Errorf("no keys in '%s'", filepath.Join(dir, dataKeysFileName))
+		}
+		return res, nil
+	}
+	if len(masterKeys) == 0 || !create {
+		return nil, nil
+	}
+	dk, err := newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	res := &dataKeys{keys: []*dataKey{dk}}
+	// existing records stay plaintext until the store is re-written
+	if st, err := os.Stat(filepath.Join(dir, "data.bin")); err == nil {
+		res.encryptedFrom = st.Size()
+	}
+	err = saveDataKeys(dir, res)
+	if err != nil {
+		return nil, err
+	}
+	logf("loadDataKeys: created data key '%s' for '%s'\n", dk.ID, dir)
+	return res, nil
+}
+
+// binds ciphertext to the record so that it can't be moved to another record
+func recordAdditionalData(kind, meta string) []byte {
+	return []byte(kind + "\n" + meta)
+}
+
+func sealRecord(keys *dataKeys, kind, meta string, d []byte) []byte {
+	dk := keys.current()
+	res := []byte(atRestMagic)
+	res = append(res, byte(len(dk.ID)))
+	res = append(res, dk.ID...)
+	return append(res, gcmSeal(dk.aead, d, recordAdditionalData(kind, meta))...)
+}
+
+// returns id of the data key used to encrypt the record
+func recordDataKeyID(d []byte) (string, []byte, error) {
+	if !bytes.HasPrefix(d, []byte(atRestMagic)) {
+		return "", nil, fmt.Errorf("record is not encrypted")
+	}
+	d = d[len(atRestMagic):]
+	if len(d) < 1 || len(d) < 1+int(d[0]) {
+		return "", nil, fmt.Errorf("invalid encrypted record")
+	}
+	n := int(d[0])
+	return string(d[1 : 1+n]), d[1+n:], nil
+}
+
+// offset is offset of the record in data.bin
+func openRecord(keys *dataKeys, kind, meta string, offset int64, d []byte) ([]byte, error) {
+	if keys == nil || offset < keys.encryptedFrom {
+		return d, nil
+	}
+	id, d, err := recordDataKeyID(d)
+	if err != nil {
+		return nil, err
+	}
+	dk := keys.find(id)
+	if dk == nil {
+		return nil, fmt.Errorf("data key '%s' not found", id)
+	}
+	return gcmOpen(dk.aead, d, recordAdditionalData(kind, meta))
+}
+
+// all writes to user store go through this so that they're encrypted
+func storeAppendRecord(u *UserInfo, kind, meta string, d []byte) error {
+	u.storeMu.RLock()
+	defer u.storeMu.RUnlock()
+	if u.storeClosed {
+		return errStoreClosed
+	}
+	if u.dataKeys != nil {
+		d = sealRecord(u.dataKeys, kind, meta, d)
+	}
+	size := recordSizeOnDisk(kind, meta, d)
+	err := reserveUserQuota(u, size)
+	if err != nil {
+		return err
+	}
+	timeStart := time.Now()
+	err = u.Store.AppendRecord(kind, meta, d)
+	observeStoreOp("appendRecord", time.Since(timeStart))
+	if err != nil {
+		u.storeSize.Add(-size)
+	}
+	return err
+}
+
+func storeReadRecord(u *UserInfo, rec *appendstore.Record) ([]byte, error) {
+	u.storeMu.RLock()
+	defer u.storeMu.RUnlock()
+	if u.storeClosed {
+		return nil, errStoreClosed
+	}
+	timeStart := time.Now()
+	d, err := u.Store.ReadRecord(rec)
+	observeStoreOp("readRecord", time.Since(timeStart))
+	if err != nil {
+		return nil, err
+	}
+	return openRecord(u.dataKeys, rec.Kind, rec.Meta, rec.Offset, d)
+}
+
+// dirs in data dir that have a store
+func listUserStoreDirs() ([]string, error) {
+	dir := getDataDirMust()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if _, err := os.Stat(filepath.Join(path, "index.txt")); err == nil {
+			res = append(res, path)
+		}
+	}
+	return res, nil
+}
+
+// returns true if all records are encrypted with the current data key
+func isStoreEncryptedWith(s *appendstore.Store, keys *dataKeys) (bool, error) {
+	for _, rec := range s.Records() {
+		if rec.Size == 0 {
+			continue
+		}
+		if rec.Offset < keys.encryptedFrom {
+			return false, nil
+		}
+		d, err := s.ReadRecord(rec)
+		if err != nil {
+			return false, err
+		}
+		id, _, err := recordDataKeyID(d)
+		if err != nil {
+			return false, err
+		}
+		if id != keys.current().ID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// re-writes the store in dir, encrypting all records with the current data key
+// (or leaving them as is if keys is nil). Over-written records are dropped.
+// new store is written to a temp dir which then replaces dir
+func rewriteStore(dir string, keys *dataKeys) error {
+	src := &appendstore.Store{DataDir: dir}
+	err := appendstore.OpenStore(src)
+	if err != nil {
+		return err
+	}
+	defer src.CloseFiles()
+
+	tmpDir := dir + ".rewrite"
+	must(os.RemoveAll(tmpDir))
+	dst := &appendstore.Store{DataDir: tmpDir}
+	err = appendstore.OpenStore(dst)
+	if err != nil {
+		return err
+	}
+	for _, rec := range src.Records() {
+		d, err := src.ReadRecord(rec)
+		if err == nil {
+			d, err = openRecord(keys, rec.Kind, rec.Meta, rec.Offset, d)
+		}
+		if err != nil {
+			dst.CloseFiles()
+			return fmt.Errorf("record at offset %d: %w", rec.Offset, err)
+		}
+		if keys != nil {
+			d = sealRecord(keys, rec.Kind, rec.Meta, d)
+		}
+		err = dst.AppendRecordWithTimestamp(rec.Kind, rec.Meta, d, rec.TimestampMs)
+		if err != nil {
+			dst.CloseFiles()
+			return err
+		}
+	}
+	err = dst.CloseFiles()
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		// saved before the swap: if we crash, reading the old store fails
+		// instead of returning ciphertext as plaintext
+		keys.encryptedFrom = 0
+		err = saveDataKeys(dir, keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	// if we crash during the swap, *.bak files are the old store
+	names := []string{"data.bin", "index.txt"}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		err = os.Rename(path, path+".bak")
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		err = os.Rename(filepath.Join(tmpDir, name), filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		os.Remove(filepath.Join(dir, name+".bak"))
+	}
+	return os.RemoveAll(tmpDir)
+}
+
+func checkMasterKeysMust() {
+	panicIf(len(masterKeys) == 0, "NOTED_MASTER_KEYS must be set in secrets")
+}
+
+// -encrypt-stores
+func encryptAllStores() {
+	checkMasterKeysMust()
+	dirs, err := listUserStoreDirs()
+	must(err)
+	for _, dir := range dirs {
+		keys, err := loadDataKeys(dir, true)
+		must(err)
+		s := &appendstore.Store{DataDir: dir}
+		must(appendstore.OpenStore(s))
+		ok, err := isStoreEncryptedWith(s, keys)
+		s.CloseFiles()
+		must(err)
+		if ok {
+			logf("encryptAllStores: '%s' already encrypted\n", dir)
+			continue
+		}
+		must(rewriteStore(dir, keys))
+		logf("encryptAllStores: encrypted '%s'\n", dir)
+	}
+}
+
+// -rotate-master-key: after adding a new master key as the first one
+// in NOTED_MASTER_KEYS. Old master keys can be removed afterwards
+func rotateMasterKey() {
+	checkMasterKeysMust()
+	dirs, err := listUserStoreDirs()
+	must(err)
+	for _, dir := range dirs {
+		keys, err := loadDataKeys(dir, false)
+		must(err)
+		if keys == nil {
+			logf("rotateMasterKey: '%s' is not encrypted, skipping\n", dir)
+			continue
+		}
+		must(saveDataKeys(dir, keys))
+		logf("rotateMasterKey: re-wrapped data keys of '%s' with '%s'\n", dir, masterKeys[0].ID)
+	}
+}
+
+// -rotate-data-keys
+func rotateDataKeys() {
+	checkMasterKeysMust()
+	dirs, err := listUserStoreDirs()
+	must(err)
+	for _, dir := range dirs {
+		keys, err := loadDataKeys(dir, true)
+		must(err)
+		dk, err := newDataKey()
+		must(err)
+		// save old keys too, in case we crash during rewrite
+		keys.keys = append([]*dataKey{dk}, keys.keys...)
+		must(saveDataKeys(dir, keys))
+		must(rewriteStore(dir, keys))
+		keys.keys = keys.keys[:1]
+		must(saveDataKeys(dir, keys))
+		logf("rotateDataKeys: '%s' re-encrypted with data key '%s'\n", dir, dk.ID)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func TestAtRestRecords(t *testing.T) {
+	mk, err := parseMasterKeys("k1:" + strings.Repeat("ab", 32))
+	assert.NoError(t, err)
+	masterKeys = mk
+	defer func() { masterKeys = nil }()
+
+	dir := t.TempDir()
+	keys, err := loadDataKeys(dir, true)
+	assert.NoError(t, err)
+	assert.Equal(t, keys.encryptedFrom, int64(0))
+
+	d := sealRecord(keys, "content", "abcdef-1234", []byte("secret"))
+	assert.False(t, strings.Contains(string(d), "secret"))
+
+	// data keys are persisted, wrapped with master key
+	keys2, err := loadDataKeys(dir, false)
+	assert.NoError(t, err)
+	d2, err := openRecord(keys2, "content", "abcdef-1234", 0, d)
+	assert.NoError(t, err)
+	assert.Equal(t, string(d2), "secret")
+
+	// can't move ciphertext to a different record
+	_, err = openRecord(keys2, "content", "abcdef-5678", 0, d)
+	assert.Error(t, err)
+
+	// all records of a new store are encrypted
+	_, err = openRecord(keys2, "log", "", 10, []byte(`[1,2]`))
+	assert.Error(t, err)
+
+	_, err = parseMasterKeys("k1:abcd")
+	assert.Error(t, err)
+}
+
+func TestAtRestExistingStore(t *testing.T) {
+	dir := t.TempDir()
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: dir}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer func() { u.Store.CloseFiles() }()
+	// plaintext that looks like an encrypted record
+	assert.NoError(t, storeAppendRecord(u, "content", "abcdef-1234", []byte(atRestMagic+"\x02k1 plaintext")))
+
+	mk, err := parseMasterKeys("k1:" + strings.Repeat("ab", 32))
+	assert.NoError(t, err)
+	masterKeys = mk
+	defer func() { masterKeys = nil }()
+	u.dataKeys, err = loadDataKeys(dir, true)
+	assert.NoError(t, err)
+	assert.True(t, u.dataKeys.encryptedFrom > 0)
+	assert.NoError(t, storeAppendRecord(u, "content", "abcdef-5678", []byte("secret")))
+
+	check := func() {
+		recs := u.Store.Records()
+		assert.Equal(t, len(recs), 2)
+		d, err := storeReadRecord(u, recs[0])
+		assert.NoError(t, err)
+		assert.Equal(t, string(d), atRestMagic+"\x02k1 plaintext")
+		d, err = storeReadRecord(u, recs[1])
+		assert.NoError(t, err)
+		assert.Equal(t, string(d), "secret")
+	}
+	check()
+	ok, err := isStoreEncryptedWith(u.Store, u.dataKeys)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// after re-writing, all records are encrypted
+	assert.NoError(t, u.Store.CloseFiles())
+	assert.NoError(t, rewriteStore(dir, u.dataKeys))
+	u.dataKeys, err = loadDataKeys(dir, false)
+	assert.NoError(t, err)
+	assert.Equal(t, u.dataKeys.encryptedFrom, int64(0))
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	check()
+	ok, err = isStoreEncryptedWith(u.Store, u.dataKeys)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
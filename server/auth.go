@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// pluggable ways to log in. Providers are configured in loadSecrets():
+// - github : GitHub OAuth, if GITHUB_SECRET_* is set (see github.go)
+// - OpenID Connect : OIDC_<NAME>_ISSUER etc. (see oidc.go)
+// - local : username / password, if there are users in local_users.json (see localauth.go)
+//
+// urls:
+// /auth/providers : list of configured providers, for login page
+// /auth/${name}/login?redirect=${url} : start login
+// /auth/${name}/callback : OAuth callback
+// /auth/logout
+
+// AuthIdentity is who the user is, according to auth provider
+type AuthIdentity struct {
+	// stable id, also the name of data directory e.g. "github-1234"
+	UserID string
+	Login  string
+	// verified emails, primary first, at least one
+	Emails    []string
+	Name      string
+	AvatarURL string
+}
+
+type AuthProvider interface {
+	// used in urls, lowercase letters and digits
+	Name() string
+	// human readable, for login page
+	DisplayName() string
+}
+
+// OAuthProvider redirects to login page of the provider which
+// redirects back to callback url with ?code=
+type OAuthProvider interface {
+	AuthProvider
+	AuthCodeURL(state string, callbackURL string) (string, error)
+	Exchange(ctx context.Context, code string, callbackURL string) (*AuthIdentity, error)
+}
+
+// PasswordProvider checks login and password itself
+type PasswordProvider interface {
+	AuthProvider
+	Authenticate(login string, password string) (*AuthIdentity, error)
+}
+
+var authProviders []AuthProvider
+
+func findAuthProvider(name string) AuthProvider {
+	for _, p := range authProviders {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func initAuthProviders(secrets map[string]string) {
+	authProviders = nil
+	if secretGitHub != "" {
+		authProviders = append(authProviders, &githubAuthProvider{})
+	}
+	oidcProviders, err := oidcProvidersFromSecrets(secrets)
+	if err != nil {
+		logErrorf("initAuthProviders: %s\n", err)
+	}
+	for _, p := range oidcProviders {
+		authProviders = append(authProviders, p)
+	}
+	authProviders = append(authProviders, &localAuthProvider{})
+	for _, p := range authProviders {
+		logf("auth provider: %s\n", p.Name())
+	}
+}
+
+func authCallbackURL(r *http.Request, p AuthProvider) string {
+	// registered in GitHub app settings before we had multiple providers
+	if p.Name() == "github" {
+		return httpScheme(r) + r.Host + "/auth/githubcb"
+	}
+	return httpScheme(r) + r.Host + "/auth/" + p.Name() + "/callback"
+}
+
+// /auth/providers
+func handleAuthProviders(w http.ResponseWriter, r *http.Request) {
+	res := []map[string]any{}
+	for _, p := range authProviders {
+		if lp, ok := p.(*localAuthProvider); ok && !lp.hasUsers() {
+			continue
+		}
+		_, isPassword := p.(PasswordProvider)
+		res = append(res, map[string]any{
+			"name":         p.Name(),
+			"display_name": p.DisplayName(),
+			"login_url":    "/auth/" + p.Name() + "/login",
+			"password":     isPassword,
+		})
+	}
+	serveJSONOK(w, r, res)
+}
+
+func loginRedirectURL(r *http.Request) string {
+	return safeRedirectURL(r.FormValue("redirect"))
+}
+
+// /auth/${name}/login
+func handleAuthLogin(w http.ResponseWriter, r *http.Request, p AuthProvider) {
+	redirectURL := loginRedirectURL(r)
+	logCtxf(r.Context(), "handleAuthLogin: provider: '%s', redirect: '%s'\n", p.Name(), redirectURL)
+	if pp, ok := p.(PasswordProvider); ok {
+		handlePasswordLogin(w, r, pp, redirectURL)
+		return
+	}
+	op := p.(OAuthProvider)
+
+	// secret value passed to auth server and then back to us
+	state, err := createOAuthState(w, p.Name(), redirectURL)
+	if err != nil {
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+
+	authURL, err := op.AuthCodeURL(state, authCallbackURL(r, p))
+	if err != nil {
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+	logCtxf(r.Context(), "handleAuthLogin: doing auth 302 redirect to '%s'\n", authURL)
+	http.Redirect(w, r, authURL, http.StatusFound) // 302
+}
+
+// /auth/${name}/callback
+func handleAuthCallback(w http.ResponseWriter, r *http.Request, p AuthProvider) {
+	logCtxf(r.Context(), "handleAuthCallback: '%s'\n", r.URL)
+	op, ok := p.(OAuthProvider)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	redirectURL, err := consumeOAuthState(w, r, p.Name())
+	if err != nil {
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+
+	// e.g. user denied access: ?error=access_denied&error_description=...
+	if errorStr := r.FormValue("error"); errorStr != "" {
+		if desc := r.FormValue("error_description"); desc != "" {
+			errorStr = desc
+		}
+		redirectLoginFailed(w, r, errorStr)
+		return
+	}
+
+	id, err := op.Exchange(r.Context(), r.FormValue("code"), authCallbackURL(r, p))
+	if err != nil {
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+	completeLogin(w, r, id, redirectURL)
+}
+
+// sets the cookie for a user authenticated by a provider
+func completeLogin(w http.ResponseWriter, r *http.Request, id *AuthIdentity, redirectURL string) {
+	if len(id.Emails) == 0 {
+		redirectLoginFailed(w, r, "login provider didn't return an email")
+		return
+	}
+	err := registerUserLogin(id.UserID, id.Login, id.Emails)
+	if err != nil {
+		logCtxErrorf(r.Context(), "registerUserLogin() failed with '%s'\n", err)
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+	setRequestLogUser(r.Context(), id.UserID)
+	sess, err := createSession(id.UserID, r)
+	if err != nil {
+		logCtxErrorf(r.Context(), "createSession() failed with '%s'\n", err)
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+	cookie := &SecureCookieValue{
+		SessionID: sess.ID,
+		UserID:    id.UserID,
+		User:      id.Login,
+		Email:     id.Emails[0],
+		Name:      id.Name,
+		AvatarURL: id.AvatarURL,
+	}
+	logCtxf(r.Context(), "completeLogin: user: '%s', id: '%s', email: '%s'\n", cookie.User, cookie.UserID, cookie.Email)
+	err = setSecureCookie(w, cookie)
+	if err != nil {
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+	logCtxf(r.Context(), "completeLogin: redirect: '%s'\n", redirectURL)
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+
+	// can't put in the background because that cancels ctx
+	logLogin(ctx(), r, id)
+}
+
+// /auth/${name}/login, /auth/${name}/callback
+// returns false if not an auth provider url
+func handleAuthProviderURL(w http.ResponseWriter, r *http.Request) bool {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/auth/")
+	if !ok {
+		return false
+	}
+	name, action, ok := strings.Cut(rest, "/")
+	if !ok {
+		return false
+	}
+	p := findAuthProvider(name)
+	if p == nil {
+		return false
+	}
+	switch action {
+	case "login":
+		handleAuthLogin(w, r, p)
+		return true
+	case "callback":
+		handleAuthCallback(w, r, p)
+		return true
+	}
+	return false
+}
+
+func oauthFormError(m map[string]any) error {
+	errorStr := mapStr(m, "error")
+	if errorStr == "" {
+		return nil
+	}
+	if desc := mapStr(m, "error_description"); desc != "" {
+		errorStr = desc
+	}
+	return fmt.Errorf("%s", errorStr)
+}
+
+var rxSafeIDPart = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+// for providers whose user ids are not safe as file names
+func safeUserIDPart(s string) string {
+	if rxSafeIDPart.MatchString(s) {
+		return s
+	}
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:16])
+}
+
+func addQueryToURL(uri string, vals url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + vals.Encode()
+	}
+	return uri + "?" + vals.Encode()
+}
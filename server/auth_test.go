@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/assert"
+)
+
+func newMockOIDCServer(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			v = map[string]string{
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/authorize",
+				"token_endpoint":         srv.URL + "/token",
+				"userinfo_endpoint":      srv.URL + "/userinfo",
+			}
+		case "/token":
+			if r.FormValue("code") != "good-code" || r.FormValue("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				v = map[string]string{"error": "invalid_grant", "error_description": "bad code"}
+				break
+			}
+			v = map[string]string{"access_token": "tok", "token_type": "Bearer"}
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			v = map[string]any{
+				"sub":            "user|42",
+				"email":          "Jo@example.com",
+				"email_verified": "false",
+				"name":           "Jo",
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOIDCProvider(t *testing.T) {
+	srv := newMockOIDCServer(t)
+	ps, err := oidcProvidersFromSecrets(map[string]string{
+		"OIDC_CORP_ISSUER":        srv.URL + "/",
+		"OIDC_CORP_CLIENT_ID":     "client",
+		"OIDC_CORP_CLIENT_SECRET": "secret",
+		"OIDC_CORP_DISPLAY_NAME":  "Corp",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(ps), 1)
+	p := ps[0]
+	assert.Equal(t, p.Name(), "corp")
+	assert.Equal(t, p.DisplayName(), "Corp")
+
+	cb := "https://noted.example.com/auth/corp/callback"
+	authURL, err := p.AuthCodeURL("st", cb)
+	assert.NoError(t, err)
+	uri, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	assert.Equal(t, uri.Path, "/authorize")
+	q := uri.Query()
+	assert.Equal(t, q.Get("client_id"), "client")
+	assert.Equal(t, q.Get("state"), "st")
+	assert.Equal(t, q.Get("redirect_uri"), cb)
+	assert.Equal(t, q.Get("scope"), "openid email profile")
+
+	id, err := p.Exchange(context.Background(), "good-code", cb)
+	assert.NoError(t, err)
+	// "|" is not safe in file names
+	assert.True(t, strings.HasPrefix(id.UserID, "oidc-corp-"))
+	assert.True(t, isValidUserID(id.UserID))
+	assert.Equal(t, id.Name, "Jo")
+	// unverified email is not used
+	assert.Equal(t, len(id.Emails), 1)
+	assert.False(t, strings.Contains(id.Emails[0], "example.com"))
+
+	_, err = p.Exchange(context.Background(), "bad-code", cb)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "bad code"))
+
+	_, err = newOIDCAuthProvider("Bad Name", srv.URL, "client", "")
+	assert.Error(t, err)
+}
+
+func TestLocalAuthProvider(t *testing.T) {
+	dataDir = t.TempDir()
+	defer func() { dataDir = "" }()
+
+	p := &localAuthProvider{}
+	assert.False(t, p.hasUsers())
+	assert.Error(t, setLocalUser("jo", "jo@example.com", "short"))
+	assert.Error(t, setLocalUser("jo/..", "jo@example.com", "long enough"))
+	assert.NoError(t, setLocalUser("Jo", "jo@example.com", "long enough"))
+	assert.True(t, p.hasUsers())
+
+	id, err := p.Authenticate("jo", "long enough")
+	assert.NoError(t, err)
+	assert.Equal(t, id.UserID, "local-jo")
+	assert.Equal(t, id.Emails[0], "jo@example.com")
+
+	_, err = p.Authenticate("jo", "wrong password")
+	assert.Error(t, err)
+	_, err = p.Authenticate("nobody", "long enough")
+	assert.Error(t, err)
+}
+
+func TestOAuthLoginFlow(t *testing.T) {
+	dataDir = t.TempDir()
+	oauthStates, oauthStatesLoaded = nil, false
+	defer func() { dataDir = "" }()
+	makeSecureCookie()
+
+	srv := newMockOIDCServer(t)
+	p, err := newOIDCAuthProvider("corp", srv.URL, "client", "secret")
+	assert.NoError(t, err)
+	authProviders = []AuthProvider{p}
+	defer func() { authProviders = nil }()
+
+	startLogin := func(redirect string) (string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/auth/corp/login?redirect="+url.QueryEscape(redirect), nil)
+		assert.True(t, handleAuthProviderURL(w, r))
+		assert.Equal(t, w.Code, http.StatusFound)
+		uri, err := url.Parse(w.Header().Get("Location"))
+		assert.NoError(t, err)
+		return uri.Query().Get("state"), w.Result().Cookies()[0]
+	}
+	callback := func(state string, c *http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/auth/corp/callback?code=good-code&state="+state, nil)
+		if c != nil {
+			r.AddCookie(c)
+		}
+		assert.True(t, handleAuthProviderURL(w, r))
+		return w
+	}
+
+	state, c := startLogin("/n/abc")
+	assert.Equal(t, c.Name, loginCookieName)
+	w := callback(state, c)
+	assert.Equal(t, w.Header().Get("Location"), "/n/abc")
+
+	// state can't be re-used
+	w = callback(state, c)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Location"), errorURL))
+
+	// login started in another browser
+	state, _ = startLogin("/")
+	w = callback(state, nil)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Location"), errorURL))
+
+	// not an open redirect
+	state, c = startLogin("https://evil.com/")
+	w = callback(state, c)
+	assert.Equal(t, w.Header().Get("Location"), "/")
+}
+
+func TestOAuthStatesLimit(t *testing.T) {
+	dataDir = t.TempDir()
+	oauthStates, oauthStatesLoaded = nil, true
+	defer func() {
+		dataDir = ""
+		oauthStates, oauthStatesLoaded = nil, false
+	}()
+	for i := 0; i < maxOAuthStates-1; i++ {
+		oauthStates = append(oauthStates, &OAuthState{State: genSecureRandomHex(16), CreatedAt: time.Now()})
+	}
+	_, err := createOAuthState(httptest.NewRecorder(), "github", "/")
+	assert.NoError(t, err)
+	first := oauthStates[0].State
+	_, err = createOAuthState(httptest.NewRecorder(), "github", "/")
+	assert.Equal(t, err, errTooManyOAuthStates)
+	// logins in progress are not dropped
+	assert.Equal(t, len(oauthStates), maxOAuthStates)
+	assert.Equal(t, oauthStates[0].State, first)
+
+	oauthStates[0].CreatedAt = time.Now().Add(-oauthStateTTL - time.Second)
+	_, err = createOAuthState(httptest.NewRecorder(), "github", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, len(oauthStates), maxOAuthStates)
+	assert.True(t, oauthStates[0].State != first)
+}
+
+func TestSafeRedirectURL(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/n/abc?x=1#top", "/n/abc?x=1#top"},
+		{"https://evil.com", "/"},
+		{"//evil.com/x", "/"},
+		{"/\\evil.com", "/"},
+		{"javascript:alert(1)", "/"},
+		{"n/abc", "/"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, safeRedirectURL(tc.uri), tc.want, tc.uri)
+	}
+}
+
+func TestMigrateLegacyUserDirs(t *testing.T) {
+	dataDir = t.TempDir()
+	defer func() {
+		dataDir = ""
+		registeredUsers, registeredUsersLoaded = nil, false
+	}()
+	registeredUsers = []*RegisteredUser{{ID: "github-1", Emails: []string{"new@example.com", "jo@example.com"}}}
+	registeredUsersLoaded = true
+	for _, email := range []string{"jo@example.com", "unknown@example.com"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dataDir, email), 0755))
+	}
+
+	migrateLegacyUserDirs()
+	_, err := os.Stat(filepath.Join(dataDir, "github-1"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dataDir, "jo@example.com"))
+	assert.True(t, os.IsNotExist(err))
+	// we don't know the id until the user logs in
+	_, err = os.Stat(filepath.Join(dataDir, "unknown@example.com"))
+	assert.NoError(t, err)
+}
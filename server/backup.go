@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/minio/minio-go/v7"
+)
+
+/*
+Off-box backups of user stores.
+
+Stores are append-only so a backup uploads the bytes of index.txt and data.bin
+added since the last backup. Uploaded parts of a store form a generation:
+
+${user}/${gen}/data/${offset}  : part of data.bin starting at offset
+${user}/${gen}/index/${offset} : part of index.txt starting at offset
+${user}/${gen}/datakeys-${hash}.json : wrapped data keys, see atrest.go
+${user}/snapshots/${time}.json : backupSnapshot, sizes of files at that time
+
+When a store is re-written (compaction, key rotation), it no longer matches
+what we uploaded and we start a new generation with a full upload.
+
+Snapshots older than BACKUP_KEEP_DAYS are deleted (but we always keep the
+latest one) together with generations no longer used by any snapshot.
+Every BACKUP_VERIFY_INTERVAL we restore one store to a temp dir and compare
+it with the local copy.
+
+Configured in secrets:
+BACKUP_S3_BUCKET : enables backups to S3-compatible storage
+BACKUP_S3_ENDPOINT, BACKUP_S3_REGION, BACKUP_S3_PREFIX : optional
+BACKUP_S3_ACCESS, BACKUP_S3_SECRET : default to SPACES_KEY, SPACES_SECRET
+BACKUP_DIR : enables backups to a directory (e.g. mounted volume) instead
+BACKUP_INTERVAL : how often to backup, default 1h
+BACKUP_KEEP_DAYS : default 30
+BACKUP_VERIFY_INTERVAL : default 24h
+
+Master keys (NOTED_MASTER_KEYS) are not backed up. Without them encrypted
+stores can't be read.
+
+-restore-backup ${dir} restores latest backup of all stores to ${dir},
+-restore-at ${time} restores the state at a given time.
+*/
+
+type backupStorage interface {
+	Name() string
+	Put(key string, d []byte) error
+	Get(key string) ([]byte, error)
+	// keys with a given prefix, sorted
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+type s3BackupStorage struct {
+	mc     *minio.Client
+	bucket string
+	prefix string
+	name   string
+}
+
+func newS3BackupStorage(c *s3Config, prefix string) (*s3BackupStorage, error) {
+	mc, endpoint, err := newS3Client(c)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BackupStorage{
+		mc:     mc,
+		bucket: c.Bucket,
+		prefix: prefix,
+		name:   fmt.Sprintf("s3:%s/%s/%s", endpoint, c.Bucket, prefix),
+	}, nil
+}
+
+func (s *s3BackupStorage) Name() string {
+	return s.name
+}
+
+func (s *s3BackupStorage) Put(key string, d []byte) error {
+	opts := minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	}
+	_, err := s.mc.PutObject(context.Background(), s.bucket, s.prefix+key, bytes.NewReader(d), int64(len(d)), opts)
+	return err
+}
+
+func (s *s3BackupStorage) Get(key string) ([]byte, error) {
+	obj, err := s.mc.GetObject(context.Background(), s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+func (s *s3BackupStorage) List(prefix string) ([]string, error) {
+	opts := minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	}
+	var res []string
+	for obj := range s.mc.ListObjects(context.Background(), s.bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		res = append(res, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+func (s *s3BackupStorage) Delete(key string) error {
+	return s.mc.RemoveObject(context.Background(), s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+type dirBackupStorage struct {
+	dir string
+}
+
+func (s *dirBackupStorage) Name() string {
+	return "dir:" + s.dir
+}
+
+func (s *dirBackupStorage) Put(key string, d []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, d, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *dirBackupStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+func (s *dirBackupStorage) List(prefix string) ([]string, error) {
+	var res []string
+	err := filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			res = append(res, key)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	slices.Sort(res)
+	return res, err
+}
+
+func (s *dirBackupStorage) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+const (
+	// we upload files in parts of at most this size
+	backupPartSize = 32 * 1024 * 1024
+	// we compare this much at the end of uploaded part of the file
+	// to detect that the file was re-written
+	backupTailSize = 4096
+
+	backupTimeFormat = "20060102T150405.000Z"
+)
+
+var (
+	backupStore          backupStorage
+	backupInterval       = time.Hour
+	backupKeepDays       = 30
+	backupVerifyInterval = 24 * time.Hour
+
+	// serializes backups, retention and verification
+	muBackup sync.Mutex
+)
+
+// backupSnapshot describes state of user's store at a given time
+type backupSnapshot struct {
+	UserID       string    `json:"user_id"`
+	Time         time.Time `json:"time"`
+	Gen          string    `json:"gen"`
+	IndexSize    int64     `json:"index_size"`
+	DataSize     int64     `json:"data_size"`
+	RecordsCount int       `json:"records_count"`
+	// key of datakeys.json, empty if store is not encrypted
+	DataKeys string `json:"data_keys,omitempty"`
+}
+
+// what we've uploaded for a user, kept locally in data/backup_state.json
+type backupUserState struct {
+	Gen           string `json:"gen"`
+	IndexSize     int64  `json:"index_size"`
+	DataSize      int64  `json:"data_size"`
+	IndexTailHash string `json:"index_tail_hash"`
+	DataTailHash  string `json:"data_tail_hash"`
+	RecordsCount  int    `json:"records_count"`
+	DataKeys      string `json:"data_keys,omitempty"`
+}
+
+type backupState struct {
+	Users          map[string]*backupUserState `json:"users"`
+	LastBackupAt   time.Time                   `json:"last_backup_at"`
+	LastBackupErr  string                      `json:"last_backup_err,omitempty"`
+	LastRetention  time.Time                   `json:"last_retention"`
+	LastVerifyAt   time.Time                   `json:"last_verify_at"`
+	LastVerifyUser string                      `json:"last_verify_user,omitempty"`
+	LastVerifyErr  string                      `json:"last_verify_err,omitempty"`
+	VerifyCount    int                         `json:"verify_count"`
+}
+
+func backupStatePath() string {
+	return filepath.Join(getDataDirMust(), "backup_state.json")
+}
+
+func loadBackupState() *backupState {
+	var res backupState
+	err := readJSONFile(backupStatePath(), &res)
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf("loadBackupState: readJSONFile() failed with '%s'\n", err)
+	}
+	if res.Users == nil {
+		res.Users = map[string]*backupUserState{}
+	}
+	return &res
+}
+
+func saveBackupState(st *backupState) {
+	err := writeJSONFileAtomic(backupStatePath(), st)
+	logIfErrf(ctx(), err)
+}
+
+func initBackups(m map[string]string) {
+	backupStore = nil
+	get := func(key string, def string) string {
+		if v := strings.TrimSpace(m[key]); v != "" {
+			return v
+		}
+		return def
+	}
+	if bucket := get("BACKUP_S3_BUCKET", ""); bucket != "" {
+		c := &s3Config{
+			Endpoint: get("BACKUP_S3_ENDPOINT", defaultS3Endpoint),
+			Bucket:   bucket,
+			Region:   get("BACKUP_S3_REGION", ""),
+			Access:   get("BACKUP_S3_ACCESS", get("SPACES_KEY", os.Getenv("SPACES_KEY"))),
+			Secret:   get("BACKUP_S3_SECRET", get("SPACES_SECRET", os.Getenv("SPACES_SECRET"))),
+		}
+		prefix := get("BACKUP_S3_PREFIX", "noted-backup/")
+		st, err := newS3BackupStorage(c, prefix)
+		must(err)
+		backupStore = st
+	} else if dir := get("BACKUP_DIR", ""); dir != "" {
+		backupStore = &dirBackupStorage{dir: dir}
+	}
+
+	var err error
+	backupInterval, err = time.ParseDuration(get("BACKUP_INTERVAL", "1h"))
+	panicIf(err != nil || backupInterval < time.Minute, "invalid BACKUP_INTERVAL")
+	backupVerifyInterval, err = time.ParseDuration(get("BACKUP_VERIFY_INTERVAL", "24h"))
+	panicIf(err != nil, "invalid BACKUP_VERIFY_INTERVAL")
+	backupKeepDays, err = strconv.Atoi(get("BACKUP_KEEP_DAYS", "30"))
+	panicIf(err != nil || backupKeepDays < 1, "invalid BACKUP_KEEP_DAYS")
+
+	if backupStore == nil {
+		logf("Missing BACKUP_S3_BUCKET and BACKUP_DIR, backups are disabled\n")
+		return
+	}
+	logf("backups to '%s' every %s, keeping %d days\n", backupStore.Name(), backupInterval, backupKeepDays)
+}
+
+func sha256Hex(d []byte) string {
+	h := sha256.Sum256(d)
+	return hex.EncodeToString(h[:])
+}
+
+func readFileRange(f *os.File, off int64, n int64) ([]byte, error) {
+	d := make([]byte, n)
+	_, err := f.ReadAt(d, off)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// hash of up to backupTailSize bytes before offset size
+func fileTailHash(f *os.File, size int64) (string, error) {
+	start := max(0, size-backupTailSize)
+	d, err := readFileRange(f, start, size-start)
+	if err != nil {
+		return "", err
+	}
+	return sha256Hex(d), nil
+}
+
+func backupPartKey(userID, gen, name string, off int64) string {
+	return fmt.Sprintf("%s/%s/%s/%016d", userID, gen, name, off)
+}
+
+// uploads [start, end) of f in parts
+func backupUploadRange(bs backupStorage, f *os.File, userID, gen, name string, start, end int64) error {
+	for off := start; off < end; {
+		n := min(end-off, backupPartSize)
+		d, err := readFileRange(f, off, n)
+		if err != nil {
+			return err
+		}
+		err = bs.Put(backupPartKey(userID, gen, name, off), d)
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// opens files of a store and gets their size in a way that index.txt only
+// refers to data in data.bin. Records are written to data.bin first, so we
+// get the size of index.txt first.
+// Holds muStore so that the store isn't re-written at the same time.
+func openStoreFilesForBackup(dir string) (*os.File, int64, *os.File, int64, error) {
+	muStore.Lock()
+	defer muStore.Unlock()
+	idxFile, err := os.Open(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		return nil, 0, nil, 0, err
+	}
+	st, err := idxFile.Stat()
+	if err != nil {
+		idxFile.Close()
+		return nil, 0, nil, 0, err
+	}
+	idxSize := st.Size()
+	dataFile, err := os.Open(filepath.Join(dir, "data.bin"))
+	if os.IsNotExist(err) {
+		// store without data
+		return idxFile, idxSize, nil, 0, nil
+	}
+	if err == nil {
+		st, err = dataFile.Stat()
+	}
+	if err != nil {
+		idxFile.Close()
+		return nil, 0, nil, 0, err
+	}
+	return idxFile, idxSize, dataFile, st.Size(), nil
+}
+
+// returns true if what we uploaded is still a prefix of the file
+func isBackupPrefixOf(f *os.File, size int64, uploadedSize int64, tailHash string) bool {
+	if uploadedSize == 0 {
+		return true
+	}
+	if f == nil || size < uploadedSize {
+		return false
+	}
+	h, err := fileTailHash(f, uploadedSize)
+	return err == nil && h == tailHash
+}
+
+// uploads changes to user's store since last backup. Returns nil if there
+// were no changes
+func backupUserStore(bs backupStorage, userID string, us *backupUserState, now time.Time) (*backupSnapshot, error) {
+	dir := userDataDir(userID)
+	idxFile, idxSize, dataFile, dataSize, err := openStoreFilesForBackup(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer idxFile.Close()
+	if dataFile != nil {
+		defer dataFile.Close()
+	}
+
+	changed := false
+	isPrefix := isBackupPrefixOf(idxFile, idxSize, us.IndexSize, us.IndexTailHash) &&
+		isBackupPrefixOf(dataFile, dataSize, us.DataSize, us.DataTailHash)
+	if us.Gen == "" || !isPrefix {
+		if us.Gen != "" {
+			logf("backupUserStore: store of '%s' was re-written, starting new generation\n", userID)
+		}
+		*us = backupUserState{Gen: now.UTC().Format(backupTimeFormat)}
+		changed = true
+	}
+
+	// only complete index lines
+	idxDelta, err := readFileRange(idxFile, us.IndexSize, idxSize-us.IndexSize)
+	if err != nil {
+		return nil, err
+	}
+	idxDelta = idxDelta[:bytes.LastIndexByte(idxDelta, '\n')+1]
+	newIdxSize := us.IndexSize + int64(len(idxDelta))
+
+	// data first so that index never refers to data we didn't upload
+	if dataSize > us.DataSize {
+		err = backupUploadRange(bs, dataFile, userID, us.Gen, "data", us.DataSize, dataSize)
+		if err != nil {
+			return nil, err
+		}
+		us.DataSize = dataSize
+		us.DataTailHash, err = fileTailHash(dataFile, dataSize)
+		if err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	if newIdxSize > us.IndexSize {
+		err = backupUploadRange(bs, idxFile, userID, us.Gen, "index", us.IndexSize, newIdxSize)
+		if err != nil {
+			return nil, err
+		}
+		us.IndexSize = newIdxSize
+		us.IndexTailHash, err = fileTailHash(idxFile, newIdxSize)
+		if err != nil {
+			return nil, err
+		}
+		us.RecordsCount += bytes.Count(idxDelta, []byte{'\n'})
+		changed = true
+	}
+
+	keysData, err := os.ReadFile(filepath.Join(dir, dataKeysFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		key := fmt.Sprintf("%s/%s/datakeys-%s.json", userID, us.Gen, sha256Hex(keysData)[:16])
+		if key != us.DataKeys {
+			err = bs.Put(key, keysData)
+			if err != nil {
+				return nil, err
+			}
+			us.DataKeys = key
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	snap := &backupSnapshot{
+		UserID:       userID,
+		Time:         now.UTC(),
+		Gen:          us.Gen,
+		IndexSize:    us.IndexSize,
+		DataSize:     us.DataSize,
+		RecordsCount: us.RecordsCount,
+		DataKeys:     us.DataKeys,
+	}
+	d, _ := json.MarshalIndent(snap, "", "  ")
+	err = bs.Put(backupSnapshotKey(userID, now), d)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func backupSnapshotKey(userID string, t time.Time) string {
+	return userID + "/snapshots/" + t.UTC().Format(backupTimeFormat) + ".json"
+}
+
+// backs up all stores, returns number of backed up stores
+func runBackup(bs backupStorage, st *backupState, now time.Time) (int, error) {
+	dirs, err := listUserStoreDirs()
+	if err != nil {
+		return 0, err
+	}
+	nChanged := 0
+	var errs []error
+	for _, dir := range dirs {
+		userID := filepath.Base(dir)
+		us := st.Users[userID]
+		if us == nil {
+			us = &backupUserState{}
+		}
+		// on error we don't know what was uploaded so we start over
+		usCopy := *us
+		snap, err := backupUserStore(bs, userID, &usCopy, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backup of '%s' failed: %w", userID, err))
+			continue
+		}
+		st.Users[userID] = &usCopy
+		if snap != nil {
+			nChanged++
+		}
+	}
+	return nChanged, errors.Join(errs...)
+}
+
+func parseBackupSnapshotTime(key string) (time.Time, bool) {
+	name := strings.TrimSuffix(path.Base(key), ".json")
+	t, err := time.Parse(backupTimeFormat, name)
+	return t, err == nil
+}
+
+// user ids that have snapshots
+func listBackupUsers(bs backupStorage) ([]string, error) {
+	keys, err := bs.List("")
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if len(parts) == 3 && parts[1] == "snapshots" && !slices.Contains(res, parts[0]) {
+			res = append(res, parts[0])
+		}
+	}
+	return res, nil
+}
+
+// deletes snapshots older than keepDays (but keeps the latest) and parts of
+// generations not used by remaining snapshots. Returns number of deleted files
+func applyBackupRetention(bs backupStorage, now time.Time, keepDays int) (int, error) {
+	userIDs, err := listBackupUsers(bs)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := now.AddDate(0, 0, -keepDays)
+	nDeleted := 0
+	for _, userID := range userIDs {
+		keys, err := bs.List(userID + "/")
+		if err != nil {
+			return nDeleted, err
+		}
+		var snapKeys []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, userID+"/snapshots/") {
+				snapKeys = append(snapKeys, key)
+			}
+		}
+		gens := map[string]bool{}
+		for i, key := range snapKeys {
+			t, ok := parseBackupSnapshotTime(key)
+			isLatest := i == len(snapKeys)-1
+			if ok && t.Before(cutoff) && !isLatest {
+				err = bs.Delete(key)
+				if err != nil {
+					return nDeleted, err
+				}
+				nDeleted++
+				continue
+			}
+			var snap backupSnapshot
+			d, err := bs.Get(key)
+			if err == nil {
+				err = json.Unmarshal(d, &snap)
+			}
+			if err != nil {
+				return nDeleted, fmt.Errorf("reading '%s' failed with '%w'", key, err)
+			}
+			gens[snap.Gen] = true
+		}
+		for _, key := range keys {
+			parts := strings.Split(key, "/")
+			if len(parts) < 3 || parts[1] == "snapshots" || gens[parts[1]] {
+				continue
+			}
+			err = bs.Delete(key)
+			if err != nil {
+				return nDeleted, err
+			}
+			nDeleted++
+		}
+	}
+	return nDeleted, nil
+}
+
+// latest snapshot of user taken at or before at. Zero at means latest
+func findBackupSnapshot(bs backupStorage, userID string, at time.Time) (*backupSnapshot, error) {
+	keys, err := bs.List(userID + "/snapshots/")
+	if err != nil {
+		return nil, err
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		t, ok := parseBackupSnapshotTime(keys[i])
+		if !ok || (!at.IsZero() && t.After(at)) {
+			continue
+		}
+		d, err := bs.Get(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		var snap backupSnapshot
+		err = json.Unmarshal(d, &snap)
+		if err != nil {
+			return nil, fmt.Errorf("reading '%s' failed with '%w'", keys[i], err)
+		}
+		return &snap, nil
+	}
+	return nil, fmt.Errorf("no backup of '%s' at %s", userID, at)
+}
+
+// downloads parts of a file up to size
+func restoreBackupFile(bs backupStorage, snap *backupSnapshot, name string, size int64, dstPath string) error {
+	prefix := fmt.Sprintf("%s/%s/%s/", snap.UserID, snap.Gen, name)
+	keys, err := bs.List(prefix)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var written int64
+	for _, key := range keys {
+		if written >= size {
+			break
+		}
+		off, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if off != written {
+			return fmt.Errorf("missing part of %s at offset %d, next part is at %d", name, written, off)
+		}
+		d, err := bs.Get(key)
+		if err != nil {
+			return err
+		}
+		d = d[:min(int64(len(d)), size-written)]
+		_, err = f.Write(d)
+		if err != nil {
+			return err
+		}
+		written += int64(len(d))
+	}
+	if written != size {
+		return fmt.Errorf("%s is incomplete: restored %d of %d bytes", name, written, size)
+	}
+	return f.Close()
+}
+
+// checks that restored store can be opened and matches the snapshot
+func checkRestoredStore(dir string, snap *backupSnapshot) error {
+	s := &appendstore.Store{DataDir: dir}
+	err := appendstore.OpenStore(s)
+	if err != nil {
+		return err
+	}
+	defer s.CloseFiles()
+	recs := s.AllRecords()
+	if len(recs) != snap.RecordsCount {
+		return fmt.Errorf("restored store has %d records, expected %d", len(recs), snap.RecordsCount)
+	}
+	for _, rec := range recs {
+		if rec.Offset+max(rec.Size, rec.SizeInFile) > snap.DataSize {
+			return fmt.Errorf("record at offset %d of size %d is outside of data.bin of size %d", rec.Offset, rec.Size, snap.DataSize)
+		}
+	}
+	return nil
+}
+
+// restores user's store as of at to dstDir, which must not exist
+func restoreUserBackup(bs backupStorage, userID string, at time.Time, dstDir string) (*backupSnapshot, error) {
+	snap, err := findBackupSnapshot(bs, userID, at)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dstDir); err == nil {
+		return nil, fmt.Errorf("'%s' already exists", dstDir)
+	}
+	tmpDir := dstDir + ".restoring"
+	must(os.RemoveAll(tmpDir))
+	err = os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = restoreBackupFile(bs, snap, "data", snap.DataSize, filepath.Join(tmpDir, "data.bin"))
+	if err == nil {
+		err = restoreBackupFile(bs, snap, "index", snap.IndexSize, filepath.Join(tmpDir, "index.txt"))
+	}
+	if err == nil && snap.DataKeys != "" {
+		var d []byte
+		d, err = bs.Get(snap.DataKeys)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(tmpDir, dataKeysFileName), d, 0644)
+		}
+	}
+	if err == nil {
+		err = checkRestoredStore(tmpDir, snap)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("restoring '%s' failed: %w", userID, err)
+	}
+	return snap, os.Rename(tmpDir, dstDir)
+}
+
+// restores stores of all users to dstDir
+func restoreAllBackups(bs backupStorage, at time.Time, dstDir string) (int, error) {
+	userIDs, err := listBackupUsers(bs)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, userID := range userIDs {
+		if !isValidUserID(userID) {
+			logf("restoreAllBackups: skipping invalid user id '%s'\n", userID)
+			continue
+		}
+		snap, err := restoreUserBackup(bs, userID, at, filepath.Join(dstDir, userID))
+		if err != nil {
+			return n, err
+		}
+		logf("restored '%s' from %s: %d records, %s\n", userID, snap.Time.Format(time.RFC3339), snap.RecordsCount, formatSize(snap.IndexSize+snap.DataSize))
+		n++
+	}
+	return n, nil
+}
+
+// restores latest backup of a user to a temp dir and compares it with
+// the local store
+func verifyUserBackup(bs backupStorage, userID string, us *backupUserState) error {
+	tmpDir, err := os.MkdirTemp("", "noted-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	dstDir := filepath.Join(tmpDir, userID)
+	snap, err := restoreUserBackup(bs, userID, time.Time{}, dstDir)
+	if err != nil {
+		return err
+	}
+	if snap.Gen != us.Gen {
+		return fmt.Errorf("latest backup of '%s' is generation '%s', expected '%s'", userID, snap.Gen, us.Gen)
+	}
+	idxFile, _, dataFile, _, err := openStoreFilesForBackup(userDataDir(userID))
+	if err != nil {
+		return err
+	}
+	defer idxFile.Close()
+	if dataFile != nil {
+		defer dataFile.Close()
+	}
+	compare := func(name string, f *os.File, size int64) error {
+		restored, err := os.ReadFile(filepath.Join(dstDir, name))
+		if err != nil {
+			return err
+		}
+		var local []byte
+		if f != nil {
+			local, err = readFileRange(f, 0, size)
+			if err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(restored, local) {
+			return fmt.Errorf("restored %s of '%s' is different than local", name, userID)
+		}
+		return nil
+	}
+	err = compare("index.txt", idxFile, snap.IndexSize)
+	if err == nil {
+		err = compare("data.bin", dataFile, snap.DataSize)
+	}
+	return err
+}
+
+// backup, retention and periodic verification, called from scheduler
+func runBackupCycle(bs backupStorage, now time.Time) {
+	muBackup.Lock()
+	defer muBackup.Unlock()
+
+	st := loadBackupState()
+	defer saveBackupState(st)
+
+	timeStart := time.Now()
+	n, err := runBackup(bs, st, now)
+	st.LastBackupErr = ""
+	if err != nil {
+		logErrorf("runBackupCycle: %s\n", err)
+		st.LastBackupErr = err.Error()
+	} else {
+		st.LastBackupAt = now
+	}
+	logf("runBackupCycle: backed up %d changed stores in %s\n", n, time.Since(timeStart))
+
+	if now.Sub(st.LastRetention) >= 24*time.Hour {
+		nDeleted, err := applyBackupRetention(bs, now, backupKeepDays)
+		if err != nil {
+			logErrorf("runBackupCycle: applyBackupRetention() failed with '%s'\n", err)
+		} else {
+			st.LastRetention = now
+			logf("runBackupCycle: retention deleted %d files\n", nDeleted)
+		}
+	}
+
+	if now.Sub(st.LastVerifyAt) < backupVerifyInterval || len(st.Users) == 0 {
+		return
+	}
+	// verify a different user every time
+	userIDs := sortedKeys(st.Users)
+	userID := userIDs[st.VerifyCount%len(userIDs)]
+	st.VerifyCount++
+	st.LastVerifyAt = now
+	st.LastVerifyUser = userID
+	st.LastVerifyErr = ""
+	err = verifyUserBackup(bs, userID, st.Users[userID])
+	if err != nil {
+		logErrorf("runBackupCycle: verification of backup of '%s' failed with '%s'\n", userID, err)
+		st.LastVerifyErr = err.Error()
+		return
+	}
+	logf("runBackupCycle: verified backup of '%s'\n", userID)
+}
+
+func startBackups() {
+	if backupStore == nil {
+		return
+	}
+	go func() {
+		for {
+			runBackupCycle(backupStore, time.Now())
+			time.Sleep(backupInterval)
+		}
+	}()
+}
+
+// state file is written atomically so we don't need to wait for a backup
+// in progress
+func getBackupStatus() map[string]any {
+	return map[string]any{
+		"enabled": backupStore != nil,
+		"state":   loadBackupState(),
+	}
+}
+
+// -restore-backup ${dir} [-restore-at ${time}]
+func runRestoreBackup(dstDir string, atStr string) {
+	panicIf(backupStore == nil, "backups are not configured, set BACKUP_S3_BUCKET or BACKUP_DIR in secrets")
+	var at time.Time
+	if atStr != "" {
+		var err error
+		at, err = parseTimeArg(atStr, true)
+		must(err)
+	}
+	must(os.MkdirAll(dstDir, 0755))
+	n, err := restoreAllBackups(backupStore, at, dstDir)
+	must(err)
+	logf("restored %d stores from '%s' to '%s'\n", n, backupStore.Name(), dstDir)
+}
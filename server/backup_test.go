@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func appendTestRecords(t *testing.T, dir string, start int, n int) {
+	s := &appendstore.Store{DataDir: dir}
+	assert.NoError(t, appendstore.OpenStore(s))
+	defer s.CloseFiles()
+	for i := start; i < start+n; i++ {
+		d := []byte(strings.Repeat(fmt.Sprintf("record %d ", i), 100))
+		assert.NoError(t, s.AppendRecord("content", fmt.Sprintf("note-%d", i%3), d))
+	}
+}
+
+func testBackupAndRestore(t *testing.T, bs backupStorage) {
+	dataDir = t.TempDir()
+	defer func() { dataDir = "" }()
+
+	userID := "local-jo"
+	dir := userDataDir(userID)
+	appendTestRecords(t, dir, 0, 10)
+
+	st := loadBackupState()
+	t1 := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+	n, err := runBackup(bs, st, t1)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	gen1 := st.Users[userID].Gen
+
+	// nothing changed
+	n, err = runBackup(bs, st, t1.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, n, 0)
+
+	// only the new part is uploaded
+	appendTestRecords(t, dir, 10, 5)
+	t2 := t1.Add(2 * time.Hour)
+	n, err = runBackup(bs, st, t2)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	keys, err := bs.List(userID + "/" + gen1 + "/index/")
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), 2)
+
+	restoreDir := t.TempDir()
+	snap, err := restoreUserBackup(bs, userID, time.Time{}, filepath.Join(restoreDir, "latest"))
+	assert.NoError(t, err)
+	assert.Equal(t, snap.RecordsCount, 15)
+	for _, name := range []string{"index.txt", "data.bin"} {
+		restored, err := os.ReadFile(filepath.Join(restoreDir, "latest", name))
+		assert.NoError(t, err)
+		local, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, restored, local)
+	}
+	// state at a given time
+	snap, err = restoreUserBackup(bs, userID, t1.Add(time.Minute), filepath.Join(restoreDir, "at"))
+	assert.NoError(t, err)
+	assert.Equal(t, snap.RecordsCount, 10)
+	_, err = restoreUserBackup(bs, userID, t1.Add(-time.Minute), filepath.Join(restoreDir, "before"))
+	assert.Error(t, err)
+
+	assert.NoError(t, verifyUserBackup(bs, userID, st.Users[userID]))
+
+	// re-written store (e.g. with new data keys) starts a new generation
+	assert.NoError(t, os.RemoveAll(dir))
+	appendTestRecords(t, dir, 100, 3)
+	t3 := t1.AddDate(0, 0, 10)
+	n, err = runBackup(bs, st, t3)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	gen2 := st.Users[userID].Gen
+	assert.NotEqual(t, gen1, gen2)
+	assert.Equal(t, st.Users[userID].RecordsCount, 3)
+	assert.NoError(t, verifyUserBackup(bs, userID, st.Users[userID]))
+
+	// old snapshots and their generation are deleted
+	nDeleted, err := applyBackupRetention(bs, t1.AddDate(0, 0, 5), 30)
+	assert.NoError(t, err)
+	assert.Equal(t, nDeleted, 0)
+	nDeleted, err = applyBackupRetention(bs, t3.AddDate(0, 0, 1), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, nDeleted, 6)
+	keys, err = bs.List(userID + "/")
+	assert.NoError(t, err)
+	for _, key := range keys {
+		assert.False(t, strings.Contains(key, gen1))
+	}
+	// the latest snapshot is kept even if it's old
+	nDeleted, err = applyBackupRetention(bs, t3.AddDate(1, 0, 0), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, nDeleted, 0)
+
+	n, err = restoreAllBackups(bs, time.Time{}, filepath.Join(restoreDir, "all"))
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+
+	// verification detects a corrupted backup
+	keys, err = bs.List(userID + "/" + gen2 + "/data/")
+	assert.NoError(t, err)
+	d, err := bs.Get(keys[0])
+	assert.NoError(t, err)
+	d[0] ^= 0xff
+	assert.NoError(t, bs.Put(keys[0], d))
+	assert.Error(t, verifyUserBackup(bs, userID, st.Users[userID]))
+}
+
+func TestBackupToDir(t *testing.T) {
+	testBackupAndRestore(t, &dirBackupStorage{dir: t.TempDir()})
+}
+
+func TestBackupToS3(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer srv.Close()
+	bs, err := newS3BackupStorage(&s3Config{
+		Endpoint: srv.URL,
+		Bucket:   "backups",
+		Region:   "us-east-1",
+		Access:   "access",
+		Secret:   "secret",
+	}, "noted/")
+	assert.NoError(t, err)
+	testBackupAndRestore(t, bs)
+}
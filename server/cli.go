@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjk/common/u"
+)
+
+// command-line client that talks to noted server using the same
+// /api/store/* protocol as the frontend, authenticated with api token:
+//
+// noted notes list
+// noted note cat <id or title>
+// noted note edit <id or title>
+// noted note new [title]
+// noted search <text>
+// noted sync-dir [-watch] <dir> (see syncdir.go)
+//
+// server and token are provided with -server and -token flags
+// or NOTED_SERVER and NOTED_TOKEN env variables
+
+type apiClient struct {
+	ServerURL string
+	Token     string
+}
+
+// we only have ciphertext of end-to-end encrypted notes, they can
+// only be read and edited in the browser
+var errNoteEncrypted = errors.New("note is end-to-end encrypted, use the browser to read or edit it")
+
+func (c *apiClient) doWithHeader(method string, uri string, body io.Reader) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, c.ServerURL+uri, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer u.CloseNoError(resp.Body)
+	d, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		msg := strings.TrimSpace(string(d))
+		return nil, nil, fmt.Errorf("%s %s failed with '%s': %s", method, uri, resp.Status, msg)
+	}
+	return d, resp.Header, nil
+}
+
+func (c *apiClient) do(method string, uri string, body io.Reader) ([]byte, error) {
+	d, _, err := c.doWithHeader(method, uri, body)
+	return d, err
+}
+
+func (c *apiClient) getLogs(start int) ([][]any, error) {
+	d, err := c.do(http.MethodGet, "/api/store/getLogs?start="+strconv.Itoa(start), nil)
+	if err != nil {
+		return nil, err
+	}
+	var logs [][]any
+	err = json.Unmarshal(d, &logs)
+	return logs, err
+}
+
+func (c *apiClient) appendLog(e []any) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(http.MethodPost, "/api/store/appendLog", bytes.NewReader(d))
+	return err
+}
+
+// returns errNoteEncrypted if content is ciphertext
+func (c *apiClient) getContent(contentID string) ([]byte, error) {
+	d, hdr, err := c.doWithHeader(http.MethodGet, "/api/store/getContent?id="+url.QueryEscape(contentID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Get("X-Noted-Encrypted") != "" {
+		return nil, errNoteEncrypted
+	}
+	return d, nil
+}
+
+func (c *apiClient) setContent(contentID string, d []byte) error {
+	_, err := c.do(http.MethodPost, "/api/store/setContent?id="+url.QueryEscape(contentID), bytes.NewReader(d))
+	return err
+}
+
+func (c *apiClient) getNotes() (*Notes, error) {
+	logs, err := c.getLogs(0)
+	if err != nil {
+		return nil, err
+	}
+	return notesFromLogs(logs), nil
+}
+
+// returns nil if note has no content yet and errNoteEncrypted
+// if it's end-to-end encrypted
+func (c *apiClient) getNoteContent(note *Note) ([]byte, error) {
+	if note.ContentID == "" {
+		return nil, nil
+	}
+	return c.getContent(note.ContentID)
+}
+
+// same as addNoteVersion() in notesStore.js: upload content then log the change
+// content is plain text so callers must not call it for encrypted notes
+// (getNoteContent() returns errNoteEncrypted for them)
+func (c *apiClient) addNoteVersion(note *Note, d []byte) error {
+	contentID := genContentID(note.ID)
+	err := c.setContent(contentID, d)
+	if err != nil {
+		return err
+	}
+	return c.appendLog(mkLogChangeContent(note.ID, contentID, len(d)))
+}
+
+func (c *apiClient) newNote(title string, kind string) (*Note, error) {
+	id := genNoteID()
+	e := mkLogCreateNote(id, title, kind, false)
+	err := c.appendLog(e)
+	if err != nil {
+		return nil, err
+	}
+	notes := newNotes()
+	must(notes.ApplyLog(e))
+	return notes.Get(id), nil
+}
+
+// s can be note id or a title, like getNoteByTitleOrID() in notesStore.js
+func findNoteByIDOrTitle(notes *Notes, s string) *Note {
+	if note := notes.Get(s); note != nil {
+		return note
+	}
+	for _, note := range notes.Notes {
+		if note.Title == s {
+			return note
+		}
+	}
+	return nil
+}
+
+func cliFatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(1)
+}
+
+func cliFatalIfErr(err error) {
+	if err != nil {
+		cliFatalf("Error: %s\n", err)
+	}
+}
+
+func newAPIClientFromFlags(fs *flag.FlagSet, args []string) *apiClient {
+	serverURL := os.Getenv("NOTED_SERVER")
+	if serverURL == "" {
+		serverURL = "https://" + domain
+	}
+	c := &apiClient{}
+	fs.StringVar(&c.ServerURL, "server", serverURL, "url of noted server (NOTED_SERVER)")
+	fs.StringVar(&c.Token, "token", os.Getenv("NOTED_TOKEN"), "api token (NOTED_TOKEN)")
+	must(fs.Parse(args))
+	c.ServerURL = strings.TrimSuffix(c.ServerURL, "/")
+	if c.Token == "" {
+		cliFatalf("need api token. Use -token flag or NOTED_TOKEN env variable\n")
+	}
+	return c
+}
+
+// s is note id or title
+func findNote(c *apiClient, s string) (*Note, error) {
+	notes, err := c.getNotes()
+	if err != nil {
+		return nil, err
+	}
+	note := findNoteByIDOrTitle(notes, s)
+	if note == nil {
+		return nil, fmt.Errorf("note '%s' not found", s)
+	}
+	return note, nil
+}
+
+func getEditor() string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if s := os.Getenv(env); s != "" {
+			return s
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return "notepad"
+	}
+	return "vi"
+}
+
+// opens d in $EDITOR and returns edited content
+func editInEditor(name string, d []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "noted-*-"+name)
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	defer os.Remove(path)
+	_, err = f.Write(d)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	// $EDITOR can have arguments e.g. "code --wait"
+	parts := strings.Fields(getEditor())
+	parts = append(parts, path)
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func isStdinPiped() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice == 0
+}
+
+func fmtTimeMs(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).Format("2006-01-02 15:04")
+}
+
+func listNotes(c *apiClient, w io.Writer) error {
+	notes, err := c.getNotes()
+	if err != nil {
+		return err
+	}
+	a := slices.Clone(notes.Notes)
+	slices.SortFunc(a, func(n1, n2 *Note) int {
+		return cmp.Compare(n2.UpdatedAt, n1.UpdatedAt)
+	})
+	for _, note := range a {
+		fmt.Fprintf(w, "%s  %s  %8s  %s\n", note.ID, fmtTimeMs(note.UpdatedAt), formatSize(note.Size), note.Title)
+	}
+	return nil
+}
+
+func catNote(c *apiClient, w io.Writer, s string) error {
+	note, err := findNote(c, s)
+	if err != nil {
+		return err
+	}
+	d, err := c.getNoteContent(note)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(d)
+	return err
+}
+
+func editNote(c *apiClient, w io.Writer, s string) error {
+	note, err := findNote(c, s)
+	if err != nil {
+		return err
+	}
+	d, err := c.getNoteContent(note)
+	if err != nil {
+		return err
+	}
+	d2, err := editInEditor(note.ID+".md", d)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(d, d2) {
+		fmt.Fprintf(w, "no changes\n")
+		return nil
+	}
+	err = c.addNoteVersion(note, d2)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "saved new version of '%s' (%s)\n", note.Title, formatSize(int64(len(d2))))
+	return nil
+}
+
+// if title is empty, we use first line of d
+func createNote(c *apiClient, w io.Writer, title string, kind string, d []byte) error {
+	if title == "" {
+		// like in the frontend, use first line as title
+		title, _ = getNextLine(string(d))
+		title = strings.TrimSpace(strings.TrimLeft(title, "# "))
+	}
+	if title == "" {
+		return fmt.Errorf("need a title")
+	}
+	note, err := c.newNote(title, kind)
+	if err != nil {
+		return err
+	}
+	if len(d) > 0 {
+		err = c.addNoteVersion(note, d)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "created note '%s' with id %s\n", title, note.ID)
+	return nil
+}
+
+// case-insensitive search in titles and content of notes
+func searchNotes(c *apiClient, w io.Writer, s string) error {
+	toFind := strings.ToLower(s)
+	notes, err := c.getNotes()
+	if err != nil {
+		return err
+	}
+	nFound := 0
+	for _, note := range notes.Notes {
+		titleMatches := strings.Contains(strings.ToLower(note.Title), toFind)
+		d, err := c.getNoteContent(note)
+		if errors.Is(err, errNoteEncrypted) {
+			// can only search titles of encrypted notes
+			d, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		var lines []string
+		scanner := bufio.NewScanner(bytes.NewReader(d))
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := scanner.Text()
+			if strings.Contains(strings.ToLower(line), toFind) {
+				lines = append(lines, fmt.Sprintf("  %d: %s", lineNo, strings.TrimSpace(line)))
+			}
+		}
+		if !titleMatches && len(lines) == 0 {
+			continue
+		}
+		nFound++
+		fmt.Fprintf(w, "%s  %s\n", note.ID, note.Title)
+		for _, line := range lines {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+	if nFound == 0 {
+		fmt.Fprintf(w, "no notes matching '%s'\n", toFind)
+	}
+	return nil
+}
+
+func needNoteArg(fs *flag.FlagSet) string {
+	if fs.NArg() < 1 {
+		cliFatalf("need note id or title\n")
+	}
+	return strings.Join(fs.Args(), " ")
+}
+
+func cliNotesList(args []string) {
+	fs := flag.NewFlagSet("notes list", flag.ExitOnError)
+	c := newAPIClientFromFlags(fs, args)
+	cliFatalIfErr(listNotes(c, os.Stdout))
+}
+
+func cliNoteCat(args []string) {
+	fs := flag.NewFlagSet("note cat", flag.ExitOnError)
+	c := newAPIClientFromFlags(fs, args)
+	cliFatalIfErr(catNote(c, os.Stdout, needNoteArg(fs)))
+}
+
+func cliNoteEdit(args []string) {
+	fs := flag.NewFlagSet("note edit", flag.ExitOnError)
+	c := newAPIClientFromFlags(fs, args)
+	cliFatalIfErr(editNote(c, os.Stdout, needNoteArg(fs)))
+}
+
+// content is read from stdin if piped, otherwise we open $EDITOR
+func cliNoteNew(args []string) {
+	fs := flag.NewFlagSet("note new", flag.ExitOnError)
+	var kind string
+	fs.StringVar(&kind, "kind", "md", "kind of note")
+	c := newAPIClientFromFlags(fs, args)
+	title := strings.Join(fs.Args(), " ")
+
+	var d []byte
+	var err error
+	if isStdinPiped() {
+		d, err = io.ReadAll(os.Stdin)
+	} else {
+		d, err = editInEditor("new.md", nil)
+	}
+	cliFatalIfErr(err)
+	cliFatalIfErr(createNote(c, os.Stdout, title, kind, d))
+}
+
+func cliSearch(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	c := newAPIClientFromFlags(fs, args)
+	if fs.NArg() < 1 {
+		cliFatalf("need text to search for\n")
+	}
+	cliFatalIfErr(searchNotes(c, os.Stdout, strings.Join(fs.Args(), " ")))
+}
+
+func cliUsage() {
+	fmt.Printf(`usage:
+  noted notes list
+  noted note cat <id or title>
+  noted note edit <id or title>
+  noted note new [-kind md] [title]
+  noted search <text>
+  noted sync-dir [-watch] [-interval 5s] <dir>
+flags for all commands:
+  -server url   (or NOTED_SERVER env variable)
+  -token token  (or NOTED_TOKEN env variable)
+`)
+}
+
+// returns false if args are not one of cli sub-commands
+func runCLI(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd := args[0]
+	sub := ""
+	if len(args) > 1 {
+		sub = args[1]
+	}
+	switch {
+	case cmd == "notes" && sub == "list":
+		cliNotesList(args[2:])
+	case cmd == "note" && sub == "cat":
+		cliNoteCat(args[2:])
+	case cmd == "note" && sub == "edit":
+		cliNoteEdit(args[2:])
+	case cmd == "note" && sub == "new":
+		cliNoteNew(args[2:])
+	case cmd == "search":
+		cliSearch(args[1:])
+	case cmd == "sync-dir":
+		cliSyncDir(args[1:])
+	case cmd == "notes" || cmd == "note" || cmd == "help":
+		cliUsage()
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kjk/common/assert"
+)
+
+// starts /api/store/* server with a fresh store of local-jo and returns
+// a client authenticated with api token with a given scope
+func newTestAPIClient(t *testing.T, scope string) *apiClient {
+	dataDir = t.TempDir()
+	token, _, err := createAPIToken("local-jo", "jo", "jo@example.com", "test", scope)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleStore(w, withAPIToken(r))
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		_, err := adminCloseStore("local-jo")
+		assert.NoError(t, err)
+		dataDir = ""
+		apiTokens = nil
+		apiTokensLoaded = false
+	})
+	return &apiClient{ServerURL: srv.URL, Token: token}
+}
+
+func TestCLI(t *testing.T) {
+	c := newTestAPIClient(t, scopeWrite)
+	var w bytes.Buffer
+
+	assert.NoError(t, listNotes(c, &w))
+	assert.Equal(t, w.String(), "")
+
+	assert.NoError(t, createNote(c, &w, "", "md", []byte("# Shopping\nmilk\nEggs\n")))
+	assert.True(t, strings.HasPrefix(w.String(), "created note 'Shopping' with id "))
+	assert.NoError(t, createNote(c, &w, "Todo", "md", nil))
+	assert.Error(t, createNote(c, &w, "", "md", nil))
+
+	w.Reset()
+	assert.NoError(t, listNotes(c, &w))
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Equal(t, len(lines), 2)
+	assert.True(t, strings.Contains(w.String(), "Todo\n"))
+	assert.True(t, strings.Contains(w.String(), "Shopping\n"))
+
+	w.Reset()
+	assert.NoError(t, catNote(c, &w, "Shopping"))
+	assert.Equal(t, w.String(), "# Shopping\nmilk\nEggs\n")
+	err := catNote(c, &w, "no such note")
+	assert.Equal(t, err.Error(), "note 'no such note' not found")
+
+	w.Reset()
+	assert.NoError(t, searchNotes(c, &w, "EGGS"))
+	assert.True(t, strings.HasSuffix(w.String(), "Shopping\n  3: Eggs\n"))
+	w.Reset()
+	assert.NoError(t, searchNotes(c, &w, "bread"))
+	assert.Equal(t, w.String(), "no notes matching 'bread'\n")
+
+	// editor that appends a line to the file
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	assert.NoError(t, os.WriteFile(editor, []byte("#!/bin/sh\necho bread >> \"$1\"\n"), 0755))
+	t.Setenv("VISUAL", editor)
+	w.Reset()
+	assert.NoError(t, editNote(c, &w, "Shopping"))
+	assert.True(t, strings.HasPrefix(w.String(), "saved new version of 'Shopping'"))
+	w.Reset()
+	assert.NoError(t, catNote(c, &w, "Shopping"))
+	assert.Equal(t, w.String(), "# Shopping\nmilk\nEggs\nbread\n")
+	t.Setenv("VISUAL", "true")
+	w.Reset()
+	assert.NoError(t, editNote(c, &w, "Shopping"))
+	assert.Equal(t, w.String(), "no changes\n")
+
+	_, err = c.getContent("nosuchcontent")
+	assert.True(t, strings.Contains(err.Error(), "404 Not Found"))
+
+	bad := &apiClient{ServerURL: c.ServerURL, Token: "nt_invalid"}
+	err = listNotes(bad, &w)
+	assert.True(t, strings.HasSuffix(err.Error(), "'500 Internal Server Error': invalid api token"))
+}
+
+// like the browser does for end-to-end encrypted notes
+func setEncryptedContent(t *testing.T, c *apiClient, note *Note, ciphertext string) {
+	contentID := genContentID(note.ID)
+	_, err := c.do(http.MethodPost, "/api/store/setContent?encrypted=1&id="+contentID, strings.NewReader(ciphertext))
+	assert.NoError(t, err)
+	assert.NoError(t, c.appendLog(mkLogChangeContent(note.ID, contentID, len(ciphertext))))
+}
+
+func TestCLIEncryptedNote(t *testing.T) {
+	c := newTestAPIClient(t, scopeWrite)
+	note, err := c.newNote("Secret", "md")
+	assert.NoError(t, err)
+	setEncryptedContent(t, c, note, "ciphertext")
+
+	var w bytes.Buffer
+	assert.True(t, errors.Is(catNote(c, &w, "Secret"), errNoteEncrypted))
+	assert.Equal(t, w.String(), "")
+	t.Setenv("VISUAL", "true")
+	assert.True(t, errors.Is(editNote(c, &w, "Secret"), errNoteEncrypted))
+	assert.Equal(t, w.String(), "")
+
+	// only the title is searched
+	assert.NoError(t, searchNotes(c, &w, "ciphertext"))
+	assert.Equal(t, w.String(), "no notes matching 'ciphertext'\n")
+	w.Reset()
+	assert.NoError(t, searchNotes(c, &w, "secret"))
+	assert.Equal(t, w.String(), note.ID+"  Secret\n")
+}
+
+func TestCLIReadOnlyToken(t *testing.T) {
+	c := newTestAPIClient(t, scopeRead)
+	var w bytes.Buffer
+	assert.NoError(t, listNotes(c, &w))
+	err := createNote(c, &w, "Todo", "md", []byte("text"))
+	assert.True(t, strings.Contains(err.Error(), "403 Forbidden"))
+}
@@ -22,6 +22,9 @@ var (
 	httpPort         = 9305
 	wantedSecrets    = []string{"GITHUB_SECRET_PROD", "GITHUB_SECRET_LOCAL"}
 	frontEndBuildDir = filepath.Join("frontend", "dist")
+
+	// only required when building for or running in production
+	wantedSecretsProd = []string{"COOKIE_KEYS"}
 )
 
 // stuff that is derived from the above
@@ -145,11 +148,21 @@ func deleteOldBuilds() {
 	}
 }
 
+// called when running the server and when building for production
 func validateSecrets(m map[string]string) {
 	for _, k := range wantedSecrets {
 		_, ok := m[k]
-		panicIf(!ok, "didn't find secret '%s' in '%s'", k)
+		panicIf(!ok, "didn't find secret '%s'", k)
+	}
+	if isDev() {
+		return
+	}
+	for _, k := range wantedSecretsProd {
+		v := strings.TrimSpace(m[k])
+		panicIf(v == "", "didn't find secret '%s', required in production", k)
 	}
+	_, err := parseCookieKeys(m["COOKIE_KEYS"])
+	panicIf(err != nil, "invalid COOKIE_KEYS: %v", err)
 }
 
 func rebuildFrontend() {
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// end-to-end encrypted notes: content is encrypted in the browser
+// (see frontend/src/encrypt.js) and the server only stores ciphertext.
+//
+// The key that encrypts notes is random and is stored on the server
+// wrapped (encrypted) with a key derived from user's password and salt,
+// so the server never sees a key that could decrypt the notes.
+//
+// content records of encrypted notes have meta "${contentID} enc",
+// we don't index, search or otherwise look inside them
+
+const (
+	contentEncryptedFlag = "enc"
+	recKindKeys          = "keys"
+	// kiss-crypto salt and wrapped key are short, this is generous
+	maxKeyMaterialSize = 4096
+)
+
+func contentRecordMeta(contentID string, encrypted bool) string {
+	if encrypted {
+		return contentID + " " + contentEncryptedFlag
+	}
+	return contentID
+}
+
+func parseContentRecordMeta(meta string) (string, bool) {
+	contentID, flag, _ := strings.Cut(meta, " ")
+	return contentID, flag == contentEncryptedFlag
+}
+
+type UserKeys struct {
+	Salt       string `json:"salt"`
+	WrappedKey string `json:"wrapped_key"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+// returns nil if user didn't set up encryption
+// we keep all versions of keys and the latest wins
+func storeGetKeys(u *UserInfo) (*UserKeys, error) {
+	recs := u.Store.Records()
+	for i := len(recs) - 1; i >= 0; i-- {
+		rec := recs[i]
+		if rec.Kind != recKindKeys {
+			continue
+		}
+		d, err := storeReadRecord(u, rec)
+		if err != nil {
+			return nil, err
+		}
+		var k UserKeys
+		err = json.Unmarshal(d, &k)
+		if err != nil {
+			return nil, err
+		}
+		return &k, nil
+	}
+	return nil, nil
+}
+
+func storeSetKeys(u *UserInfo, k *UserKeys) error {
+	k.UpdatedAt = nowMs()
+	d, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return storeAppendRecord(u, recKindKeys, "", d)
+}
+
+// GET /api/store/keys : returns UserKeys or {} if not set
+// PUT /api/store/keys : sets UserKeys, e.g. after changing password
+func handleKeys(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	if r.Method == http.MethodGet {
+		if !checkScope(w, r, scopeRead) {
+			return
+		}
+		k, err := storeGetKeys(u)
+		if serveIfError(w, r, err) {
+			return
+		}
+		if k == nil {
+			serveJSONOK(w, r, map[string]any{})
+			return
+		}
+		serveJSONOK(w, r, k)
+		return
+	}
+
+	defer r.Body.Close()
+	if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeWrite) {
+		return
+	}
+	var k UserKeys
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*maxKeyMaterialSize)).Decode(&k)
+	if err != nil {
+		serveError(w, r, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if k.Salt == "" || k.WrappedKey == "" {
+		serveError(w, r, "salt and wrapped_key are required", http.StatusBadRequest)
+		return
+	}
+	if len(k.Salt) > maxKeyMaterialSize || len(k.WrappedKey) > maxKeyMaterialSize {
+		serveError(w, r, "salt or wrapped_key too large", http.StatusBadRequest)
+		return
+	}
+	err = storeSetKeys(u, &k)
+	if serveIfError(w, r, err) {
+		return
+	}
+	logCtxf(r.Context(), "handleKeys: set keys for user '%s'\n", u.Email)
+	serveJSONOK(w, r, &k)
+}
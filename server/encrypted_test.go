@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func TestContentRecordMeta(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		id, enc := parseContentRecordMeta(contentRecordMeta("n1-abcd", encrypted))
+		assert.Equal(t, id, "n1-abcd")
+		assert.Equal(t, enc, encrypted)
+	}
+}
+
+func TestHandleKeys(t *testing.T) {
+	dataDir = t.TempDir()
+	defer func() {
+		dataDir = ""
+		apiTokens = nil
+		apiTokensLoaded = false
+	}()
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer u.Store.CloseFiles()
+	readToken, _, err := createAPIToken("local-jo", "jo", "jo@example.com", "read", scopeRead)
+	assert.NoError(t, err)
+	writeToken, _, err := createAPIToken("local-jo", "jo", "jo@example.com", "write", scopeWrite)
+	assert.NoError(t, err)
+
+	call := func(method string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/store/keys", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handleKeys(w, withAPIToken(r), u)
+		return w
+	}
+	getKeys := func() *UserKeys {
+		w := call("GET", readToken, "")
+		assert.Equal(t, w.Code, 200)
+		var k UserKeys
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &k))
+		return &k
+	}
+
+	// not set up yet
+	assert.Equal(t, getKeys(), &UserKeys{})
+
+	k1 := `{"salt":"c2FsdA==","wrapped_key":"d3JhcHBlZA=="}`
+	assert.Equal(t, call("PUT", readToken, k1).Code, 403)
+	assert.Equal(t, call("PUT", writeToken, k1).Code, 200)
+	k := getKeys()
+	assert.Equal(t, k.Salt, "c2FsdA==")
+	assert.Equal(t, k.WrappedKey, "d3JhcHBlZA==")
+	assert.True(t, k.UpdatedAt > 0)
+
+	// e.g. after changing password, the latest wins
+	assert.Equal(t, call("POST", writeToken, `{"salt":"salt2","wrapped_key":"key2"}`).Code, 200)
+	k = getKeys()
+	assert.Equal(t, k.Salt, "salt2")
+	assert.Equal(t, k.WrappedKey, "key2")
+
+	// survives re-opening the store
+	assert.NoError(t, u.Store.CloseFiles())
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	k, err = storeGetKeys(u)
+	assert.NoError(t, err)
+	assert.Equal(t, k.Salt, "salt2")
+	assert.Equal(t, k.WrappedKey, "key2")
+
+	tooLarge := `{"salt":"s","wrapped_key":"` + strings.Repeat("k", maxKeyMaterialSize+1) + `"}`
+	for _, body := range []string{"not json", `{"salt":"s"}`, `{"wrapped_key":"k"}`, tooLarge} {
+		assert.Equal(t, call("PUT", writeToken, body).Code, 400)
+	}
+	assert.Equal(t, call("DELETE", writeToken, "").Code, 400)
+	assert.Equal(t, getKeys().Salt, "salt2")
+}
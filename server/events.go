@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/common/filerotate"
+)
+
+// analytics events sent by the frontend to /event/${name}
+// Stored as JSON lines in data/events/${date}-events.jsonl, a new file every day.
+// /api/admin/events aggregates them.
+
+type Event struct {
+	Name string `json:"name"`
+	// unix milliseconds
+	TimeMs int64  `json:"t"`
+	UserID string `json:"user,omitempty"`
+	// 0 if not timed
+	DurMs float64           `json:"dur,omitempty"`
+	Meta  map[string]string `json:"meta,omitempty"`
+}
+
+const (
+	eventLogSuffix    = "events.jsonl"
+	maxEventBodySize  = 16 * 1024
+	maxEventMetaKeys  = 32
+	maxEventMetaValue = 256
+)
+
+var (
+	rxEventName = regexp.MustCompile(`^[0-9A-Za-z_.-]{1,64}$`)
+
+	eventLog   *filerotate.File
+	muEventLog sync.Mutex
+)
+
+func eventsDir() string {
+	return filepath.Join(getDataDirMust(), "events")
+}
+
+func writeEvent(e *Event) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	d = append(d, '\n')
+
+	muEventLog.Lock()
+	defer muEventLog.Unlock()
+	if eventLog == nil {
+		dir := eventsDir()
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		eventLog, err = filerotate.NewDaily(dir, eventLogSuffix, nil)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = eventLog.Write(d)
+	return err
+}
+
+func closeEventLog() {
+	muEventLog.Lock()
+	defer muEventLog.Unlock()
+	if eventLog != nil {
+		eventLog.Close()
+		eventLog = nil
+	}
+}
+
+// formats JSON values as strings, so that 5 is "5" and not "5.000000"
+func eventMetaValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	d, _ := json.Marshal(v)
+	return string(d)
+}
+
+// log event
+// /event/${name}
+// body is JSON with metadata for POST / PUT or ?foo=bar keys
+// if duration is included, it's dur field in metadata
+func handleEvent(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/event/")
+	if !rxEventName.MatchString(name) {
+		logCtxWarnf(r.Context(), "handleEvent: invalid event name '%s'\n", name)
+		http.NotFound(w, r)
+		return
+	}
+
+	e := &Event{
+		Name:   name,
+		TimeMs: time.Now().UnixMilli(),
+		Meta:   map[string]string{},
+	}
+	logKV := func(k, v string) {
+		if k == "dur" {
+			e.DurMs, _ = strconv.ParseFloat(v, 64)
+			return
+		}
+		if v == "" || len(e.Meta) >= maxEventMetaKeys {
+			return
+		}
+		if len(v) > maxEventMetaValue {
+			v = v[:maxEventMetaValue]
+		}
+		e.Meta[k] = v
+	}
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		var m map[string]any
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventBodySize))
+		err := dec.Decode(&m)
+		if err != nil {
+			// ignore but log
+			logCtxWarnf(r.Context(), "dec.Decode() failed with '%s'\n", err)
+		} else {
+			for k, v := range m {
+				logKV(k, eventMetaValue(v))
+			}
+		}
+	}
+	vals := r.URL.Query()
+	for k := range vals {
+		logKV(k, vals.Get(k))
+	}
+	if math.IsNaN(e.DurMs) || e.DurMs < 0 {
+		e.DurMs = 0
+	}
+	if cookie := getSecureCookie(r); cookie != nil {
+		e.UserID = cookie.UserID
+	}
+
+	err := writeEvent(e)
+	logIfErrf(ctx(), err)
+
+	content := bytes.NewReader([]byte("ok"))
+	http.ServeContent(w, r, "foo.txt", time.Time{}, content)
+}
+
+// EventStats is aggregated stats for an event on a given day
+type EventStats struct {
+	Day         string  `json:"day"`
+	Name        string  `json:"name"`
+	Count       int     `json:"count"`
+	UniqueUsers int     `json:"unique_users"`
+	TimedCount  int     `json:"timed_count"`
+	DurP50      float64 `json:"dur_p50"`
+	DurP90      float64 `json:"dur_p90"`
+	DurP99      float64 `json:"dur_p99"`
+}
+
+// nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	idx = max(0, min(idx, len(sorted)-1))
+	return sorted[idx]
+}
+
+// from and to are inclusive "YYYY-MM-DD" in UTC, name is optional filter
+func aggregateEvents(from, to string, name string) ([]*EventStats, error) {
+	entries, err := os.ReadDir(eventsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	type key struct{ day, name string }
+	type acc struct {
+		count int
+		users map[string]bool
+		durs  []float64
+	}
+	accs := map[key]*acc{}
+	for _, de := range entries {
+		fileName := de.Name()
+		if !strings.HasSuffix(fileName, eventLogSuffix) || len(fileName) < 10 {
+			continue
+		}
+		// files are rotated in local time so may have events from
+		// the day before or after
+		fileDay := fileName[:10]
+		if fileDay < dayBefore(from) || fileDay > dayAfter(to) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(eventsDir(), fileName))
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, maxEventBodySize*4)
+		for sc.Scan() {
+			var e Event
+			if json.Unmarshal(sc.Bytes(), &e) != nil {
+				continue
+			}
+			day := time.UnixMilli(e.TimeMs).UTC().Format("2006-01-02")
+			if day < from || day > to || (name != "" && e.Name != name) {
+				continue
+			}
+			k := key{day, e.Name}
+			a := accs[k]
+			if a == nil {
+				a = &acc{users: map[string]bool{}}
+				accs[k] = a
+			}
+			a.count++
+			if e.UserID != "" {
+				a.users[e.UserID] = true
+			}
+			if e.DurMs > 0 {
+				a.durs = append(a.durs, e.DurMs)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := []*EventStats{}
+	for k, a := range accs {
+		slices.Sort(a.durs)
+		res = append(res, &EventStats{
+			Day:         k.day,
+			Name:        k.name,
+			Count:       a.count,
+			UniqueUsers: len(a.users),
+			TimedCount:  len(a.durs),
+			DurP50:      percentile(a.durs, 50),
+			DurP90:      percentile(a.durs, 90),
+			DurP99:      percentile(a.durs, 99),
+		})
+	}
+	slices.SortFunc(res, func(a, b *EventStats) int {
+		if a.Day != b.Day {
+			return strings.Compare(a.Day, b.Day)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res, nil
+}
+
+func dayBefore(day string) string {
+	t, _ := time.Parse("2006-01-02", day)
+	return t.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+func dayAfter(day string) string {
+	t, _ := time.Parse("2006-01-02", day)
+	return t.AddDate(0, 0, 1).Format("2006-01-02")
+}
+
+// /api/admin/events?from=${day}&to=${day}&name=${name}
+// days are YYYY-MM-DD, default is last 7 days
+func handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from := r.FormValue("from")
+	to := r.FormValue("to")
+	if to == "" {
+		to = now.Format("2006-01-02")
+	}
+	if from == "" {
+		from = now.AddDate(0, 0, -6).Format("2006-01-02")
+	}
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			serveError(w, r, fmt.Sprintf("invalid day '%s', must be YYYY-MM-DD", day), http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := aggregateEvents(from, to, r.FormValue("name"))
+	if serveIfError(w, r, err) {
+		return
+	}
+	serveJSONOK(w, r, res)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestEvents(t *testing.T) {
+	dataDir = t.TempDir()
+	defer func() {
+		closeEventLog()
+		dataDir = ""
+	}()
+
+	send := func(name string, body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/event/"+name+"?src=menu", strings.NewReader(body))
+		handleEvent(w, r)
+		return w.Code
+	}
+	for i := 1; i <= 10; i++ {
+		assert.Equal(t, send("open-note", `{"dur": "10", "n": 5}`), 200)
+	}
+	assert.Equal(t, send("search", `{"dur": 250}`), 200)
+	assert.Equal(t, send("search", `{}`), 200)
+	assert.Equal(t, send("../bad", `{}`), 404)
+
+	today := time.Now().UTC().Format("2006-01-02")
+	res, err := aggregateEvents(today, today, "")
+	assert.NoError(t, err)
+	assert.Equal(t, len(res), 2)
+	assert.Equal(t, res[0].Name, "open-note")
+	assert.Equal(t, res[0].Count, 10)
+	assert.Equal(t, res[0].DurP50, 10.0)
+	assert.Equal(t, res[1].Name, "search")
+	assert.Equal(t, res[1].Count, 2)
+	assert.Equal(t, res[1].TimedCount, 1)
+	assert.Equal(t, res[1].DurP99, 250.0)
+
+	res, err = aggregateEvents(today, today, "search")
+	assert.NoError(t, err)
+	assert.Equal(t, len(res), 1)
+}
+
+func TestPercentile(t *testing.T) {
+	v := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(t, percentile(v, 50), 5.0)
+	assert.Equal(t, percentile(v, 90), 9.0)
+	assert.Equal(t, percentile(v, 99), 10.0)
+	assert.Equal(t, percentile(nil, 50), 0.0)
+}
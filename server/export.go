@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+)
+
+/*
+/api/store/export[?versions=1] returns a .zip with:
+- notes/<title>.md : latest version of each note, with metadata as front matter
+  (content of encrypted notes is exported as ciphertext, marked with encrypted: true).
+  If we can't read the content, the note is exported without it and front matter
+  has the reason in error: field
+- versions/<note id>/<content id>.md : every version of every note (if versions=1)
+- log.json : raw log, as returned by /api/store/getLogs
+*/
+
+const (
+	exportNotesDir    = "notes"
+	exportVersionsDir = "versions"
+	exportLogName     = "log.json"
+)
+
+// maps content id to its record
+func storeContentRecords(u *UserInfo) map[string]*appendstore.Record {
+	res := map[string]*appendstore.Record{}
+	for _, rec := range u.Store.Records() {
+		if rec.Kind == "content" {
+			contentID, _ := parseContentRecordMeta(rec.Meta)
+			res[contentID] = rec
+		}
+	}
+	return res
+}
+
+func fmtTimeMsRFC3339(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+// kv are additional key / value pairs
+func noteFrontMatter(note *Note, kv ...string) string {
+	kv = append([]string{
+		"id", note.ID,
+		"title", note.Title,
+		"kind", note.Kind,
+		"created", fmtTimeMsRFC3339(note.CreatedAt),
+		"updated", fmtTimeMsRFC3339(note.UpdatedAt),
+	}, kv...)
+	if note.IsDaily {
+		kv = append(kv, "daily", "true")
+	}
+	return formatFrontMatter(kv...)
+}
+
+func zipWriteFile(zw *zip.Writer, name string, modTime time.Time, d []byte) error {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	}
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(d)
+	return err
+}
+
+func exportUserData(ctx context.Context, u *UserInfo, w io.Writer, withVersions bool) error {
+	logs, err := storeGetLogs(ctx, u, 0)
+	if err != nil {
+		return err
+	}
+	notes := notesFromLogs(logs)
+	contentRecs := storeContentRecords(u)
+	readContent := func(contentID string) ([]byte, bool, error) {
+		if contentID == "" {
+			return nil, false, nil
+		}
+		rec := contentRecs[contentID]
+		if rec == nil {
+			return nil, false, fmt.Errorf("content '%s' not found", contentID)
+		}
+		_, encrypted := parseContentRecordMeta(rec.Meta)
+		d, err := storeReadRecord(u, rec)
+		return d, encrypted, err
+	}
+
+	zw := zip.NewWriter(w)
+	usedNames := map[string]bool{}
+	nErrors := 0
+	for _, note := range notes.Notes {
+		var kv []string
+		d, encrypted, err := readContent(note.ContentID)
+		if err != nil {
+			// export the note anyway so that it's not silently missing
+			logCtxErrorf(ctx, "exportUserData: %s\n", err)
+			nErrors++
+			kv = append(kv, "error", err.Error())
+		}
+		if encrypted {
+			kv = append(kv, "encrypted", "true")
+		}
+		base := titleToFileName(note.Title)
+		if base == "" {
+			base = note.ID
+		} else if usedNames[strings.ToLower(base)] {
+			base = base + titleIDSep + note.ID
+		}
+		usedNames[strings.ToLower(base)] = true
+		name := path.Join(exportNotesDir, base+".md")
+		d = append([]byte(noteFrontMatter(note, kv...)), d...)
+		err = zipWriteFile(zw, name, time.UnixMilli(note.UpdatedAt), d)
+		if err != nil {
+			return err
+		}
+	}
+
+	if withVersions {
+		for _, e := range logs {
+			if logEntryOp(e) != kLogChangeContent {
+				continue
+			}
+			noteID := logEntryNoteID(e)
+			contentID := logEntryStr(e, 3)
+			d, _, err := readContent(contentID)
+			if err != nil {
+				logCtxErrorf(ctx, "exportUserData: %s\n", err)
+				nErrors++
+				continue
+			}
+			name := path.Join(exportVersionsDir, noteID, contentID+".md")
+			err = zipWriteFile(zw, name, time.UnixMilli(logEntryTimestamp(e)), d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	d, err := json.Marshal(logs)
+	if err != nil {
+		return err
+	}
+	err = zipWriteFile(zw, exportLogName, time.Now(), d)
+	if err != nil {
+		return err
+	}
+	logCtxf(ctx, "exportUserData: exported %d notes of user '%s', %d errors\n", len(notes.Notes), u.Email, nErrors)
+	return zw.Close()
+}
+
+// /api/store/export
+func handleExport(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	if !checkScope(w, r, scopeRead) {
+		return
+	}
+	withVersions := r.URL.Query().Get("versions") != ""
+	name := fmt.Sprintf("noted-export-%s.zip", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	// we're streaming so can't report an error to the client
+	err := exportUserData(r.Context(), u, w, withVersions)
+	if err != nil {
+		logCtxErrorf(r.Context(), "handleExport: exportUserData() failed with '%s'\n", err)
+	}
+}
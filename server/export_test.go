@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func TestExport(t *testing.T) {
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer u.Store.CloseFiles()
+
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("note01", "First", "md", false)))
+	assert.NoError(t, storeAddNoteVersion(ctx(), u, "note01", []byte("v1\n"), 0, false))
+	assert.NoError(t, storeAddNoteVersion(ctx(), u, "note01", []byte("v2\n"), 0, false))
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("note02", "Daily", "md", true)))
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("note03", "Secret", "md", false)))
+	assert.NoError(t, storeAddNoteVersion(ctx(), u, "note03", []byte("ciphertext"), 0, true))
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("note04", "Lost", "md", false)))
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogChangeContent("note04", "note04-gone", 5)))
+
+	var buf bytes.Buffer
+	assert.NoError(t, exportUserData(ctx(), u, &buf, true))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		d, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+		files[f.Name] = string(d)
+	}
+
+	logs, err := storeGetLogs(ctx(), u, 0)
+	assert.NoError(t, err)
+	var exportedLogs [][]any
+	assert.NoError(t, json.Unmarshal([]byte(files[exportLogName]), &exportedLogs))
+	assert.Equal(t, len(exportedLogs), len(logs))
+
+	notes := notesFromLogs(logs)
+	checkNote := func(name string, noteID string, wantBody string) map[string]string {
+		fm, body := parseFrontMatter(files[name])
+		assert.Equal(t, fm["id"], noteID)
+		assert.Equal(t, fm["title"], notes.Get(noteID).Title)
+		assert.Equal(t, fm["kind"], "md")
+		assert.Equal(t, fm["created"], fmtTimeMsRFC3339(notes.Get(noteID).CreatedAt))
+		assert.Equal(t, body, wantBody)
+		return fm
+	}
+	checkNote("notes/First.md", "note01", "v2\n")
+	assert.Equal(t, checkNote("notes/Daily.md", "note02", "")["daily"], "true")
+	assert.Equal(t, checkNote("notes/Secret.md", "note03", "ciphertext")["encrypted"], "true")
+	// exported with the reason instead of being dropped
+	fm := checkNote("notes/Lost.md", "note04", "")
+	assert.True(t, strings.Contains(fm["error"], "note04-gone"))
+
+	var versions []string
+	for name, d := range files {
+		if strings.HasPrefix(name, exportVersionsDir+"/note01/") {
+			versions = append(versions, d)
+		}
+	}
+	assert.Equal(t, len(versions), 2)
+	assert.True(t, strings.Contains(strings.Join(versions, ""), "v1\n"))
+	assert.Equal(t, len(files), 4+3+1)
+
+	// importing export into a fresh store gives the same notes
+	u2 := &UserInfo{ID: "local-ann", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u2.Store))
+	defer u2.Store.CloseFiles()
+	res, err := importUserData(ctx(), u2, buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, res.Format, "noted")
+	assert.Equal(t, res.Imported, 4)
+	logs, err = storeGetLogs(ctx(), u2, 0)
+	assert.NoError(t, err)
+	notes2 := notesFromLogs(logs)
+	for _, note := range notes.Notes {
+		note2 := notes2.Get(note.ID)
+		assert.Equal(t, note2.Title, note.Title)
+		assert.Equal(t, note2.IsDaily, note.IsDaily)
+		assert.Equal(t, note2.UpdatedAt/1000, note.UpdatedAt/1000)
+	}
+	d, err := contentGet(ctx(), u2, notes2.Get("note01").ContentID)
+	assert.NoError(t, err)
+	assert.Equal(t, string(d), "v2\n")
+	rec := contentGetRecord(u2, notes2.Get("note03").ContentID)
+	_, encrypted := parseContentRecordMeta(rec.Meta)
+	assert.True(t, encrypted)
+}
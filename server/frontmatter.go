@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// minimal YAML-style front matter at the beginning of markdown files:
+// ---
+// id: abc123
+// title: "My note: draft"
+// ---
+
+const frontMatterDelim = "---"
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return false
+	}
+	if strings.TrimSpace(s) != s {
+		return true
+	}
+	return strings.ContainsAny(s, ":#\"'\n\r\t[]{}") || strings.HasPrefix(s, "-")
+}
+
+// kv is key, value, key, value...
+func formatFrontMatter(kv ...string) string {
+	panicIf(len(kv)%2 != 0, "odd number of key/values")
+	var sb strings.Builder
+	sb.WriteString(frontMatterDelim + "\n")
+	for i := 0; i < len(kv); i += 2 {
+		v := kv[i+1]
+		if needsQuoting(v) {
+			v = strconv.Quote(v)
+		}
+		sb.WriteString(kv[i] + ": " + v + "\n")
+	}
+	sb.WriteString(frontMatterDelim + "\n")
+	return sb.String()
+}
+
+// returns nil front matter if s doesn't start with front matter
+// body is the rest of s after front matter
+func parseFrontMatter(s string) (map[string]string, string) {
+	s2 := strings.ReplaceAll(s, "\r\n", "\n")
+	rest, ok := trimPrefix(s2, frontMatterDelim+"\n")
+	if !ok {
+		return nil, s
+	}
+	m := map[string]string{}
+	for len(rest) > 0 {
+		var line string
+		line, rest = getNextLine(rest)
+		if strings.TrimRight(line, " ") == frontMatterDelim {
+			return m, rest
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, `"`) {
+			if uv, err := strconv.Unquote(v); err == nil {
+				v = uv
+			}
+		}
+		m[strings.TrimSpace(k)] = v
+	}
+	// no closing delimiter so it's not front matter
+	return nil, s
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/atomicfile"
+)
+
+/*
+-fsck checks integrity of all user stores, -fsck-user ${user} of one user.
+
+Records are appended to data.bin first and then to index.txt so a crash
+in the middle of an append leaves:
+- a partial last line in index.txt (torn index)
+- data at the end of data.bin not referenced by index.txt (torn data)
+- index line referring to data that didn't make it to disk (out of bounds)
+
+We also check that log entries parse and that content referenced by
+kLogChangeContent exists.
+
+-repair fixes what can be fixed: drops bad index lines and duplicates,
+re-creates index line for a log entry found in torn data (its index line
+was lost) or truncates torn data. Original index.txt and the torn data
+are saved as ${name}.fsck-${time}.bak. Run with the server stopped.
+*/
+
+type fsckIssue struct {
+	// "torn-index", "invalid-index", "out-of-bounds", "duplicate", "overlap",
+	// "unreadable", "invalid-log", "missing-content", "dangling-data", "torn-data"
+	Kind string
+	// line in index.txt, 0 if not about a line
+	Line    int
+	Msg     string
+	Fixable bool
+}
+
+type fsckResult struct {
+	Dir          string
+	RecordsCount int
+	LogsCount    int
+	ContentCount int
+	Issues       []*fsckIssue
+
+	// for repair
+	validLines []string
+	dataSize   int64
+	// end of data referenced by valid records
+	dataEnd int64
+	// index line for log entry found in torn data
+	recoveredLine string
+}
+
+func (r *fsckResult) add(kind string, line int, fixable bool, format string, args ...any) {
+	r.Issues = append(r.Issues, &fsckIssue{
+		Kind:    kind,
+		Line:    line,
+		Msg:     fmt.Sprintf(format, args...),
+		Fixable: fixable,
+	})
+}
+
+func (r *fsckResult) hasFixable() bool {
+	return slices.ContainsFunc(r.Issues, func(i *fsckIssue) bool { return i.Fixable })
+}
+
+// returns error if log entry is not [op, ts, noteID, ...]
+func checkLogEntry(e []any) error {
+	if len(e) < 3 {
+		return fmt.Errorf("log entry has %d elements, expected at least 3", len(e))
+	}
+	op := logEntryOp(e)
+	if op < kLogCreateNote || op > kLogDeleteNote {
+		return fmt.Errorf("unknown log op %v", e[0])
+	}
+	if logEntryNoteID(e) == "" {
+		return fmt.Errorf("log entry without note id")
+	}
+	if op == kLogChangeContent && logEntryStr(e, 3) == "" {
+		return fmt.Errorf("kLogChangeContent without content id")
+	}
+	return nil
+}
+
+func validateLogEntry(d []byte) ([]any, error) {
+	var e []any
+	err := json.Unmarshal(d, &e)
+	if err != nil {
+		return nil, err
+	}
+	err = checkLogEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+type fsckRecord struct {
+	rec  *appendstore.Record
+	line int
+}
+
+func fsckStore(dir string) (*fsckResult, error) {
+	res := &fsckResult{Dir: dir}
+	idx, err := os.ReadFile(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		return nil, err
+	}
+	dataFile, err := os.Open(filepath.Join(dir, "data.bin"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if dataFile != nil {
+		defer dataFile.Close()
+		st, err := dataFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		res.dataSize = st.Size()
+	}
+	keys, err := loadDataKeys(dir, false)
+	if err != nil {
+		res.add("unreadable", 0, false, "can't load data keys: %s", err)
+	}
+
+	lines := strings.Split(string(idx), "\n")
+	if last := lines[len(lines)-1]; last != "" {
+		res.add("torn-index", len(lines), true, "partial last line '%s'", last)
+	}
+	lines = lines[:len(lines)-1]
+
+	var recs []*fsckRecord
+	seenLines := map[string]int{}
+	// line of the first content record with a given id. Empty content
+	// is a record without data
+	contentIDs := map[string]int{}
+	for i, line := range lines {
+		lineNo := i + 1
+		if line == "" {
+			continue
+		}
+		rec := &appendstore.Record{}
+		err = appendstore.ParseIndexLine(line, rec)
+		if err != nil {
+			res.add("invalid-index", lineNo, true, "%s", err)
+			continue
+		}
+		if prev, ok := seenLines[line]; ok {
+			res.add("duplicate", lineNo, true, "same as line %d", prev)
+			continue
+		}
+		seenLines[line] = lineNo
+		end := rec.Offset + max(rec.Size, rec.SizeInFile)
+		if rec.Size > 0 && end > res.dataSize {
+			res.add("out-of-bounds", lineNo, true, "record %d-%d is outside of data.bin of size %d", rec.Offset, end, res.dataSize)
+			continue
+		}
+		res.validLines = append(res.validLines, line)
+		if rec.Kind == "content" {
+			res.ContentCount++
+			id, _ := parseContentRecordMeta(rec.Meta)
+			if prev, ok := contentIDs[id]; ok {
+				res.add("duplicate", lineNo, false, "content '%s' is also at line %d", id, prev)
+			} else {
+				contentIDs[id] = lineNo
+			}
+		}
+		if rec.Size > 0 {
+			recs = append(recs, &fsckRecord{rec, lineNo})
+			res.dataEnd = max(res.dataEnd, end)
+		}
+		res.RecordsCount++
+	}
+
+	// records with data should not overlap. Same offset means over-written record
+	byOffset := slices.Clone(recs)
+	slices.SortStableFunc(byOffset, func(a, b *fsckRecord) int {
+		return cmp.Compare(a.rec.Offset, b.rec.Offset)
+	})
+	var covered int64
+	for i, r := range byOffset {
+		if i > 0 && r.rec.Offset == byOffset[i-1].rec.Offset {
+			continue
+		}
+		if r.rec.Offset < covered {
+			res.add("overlap", r.line, false, "record at offset %d overlaps previous record ending at %d", r.rec.Offset, covered)
+		} else if r.rec.Offset > covered {
+			res.add("dangling-data", 0, false, "data.bin bytes %d-%d are not referenced by any record", covered, r.rec.Offset)
+		}
+		covered = max(covered, r.rec.Offset+max(r.rec.Size, r.rec.SizeInFile))
+	}
+
+	// line of kLogChangeContent entries
+	changes := map[int][]any{}
+	for _, r := range recs {
+		rec := r.rec
+		d, err := readFileRange(dataFile, rec.Offset, rec.Size)
+		if err == nil {
+			d, err = openRecord(keys, rec.Kind, rec.Meta, rec.Offset, d)
+		}
+		if err != nil {
+			res.add("unreadable", r.line, false, "record at offset %d: %s", rec.Offset, err)
+			continue
+		}
+		if rec.Kind != "log" {
+			continue
+		}
+		res.LogsCount++
+		e, err := validateLogEntry(d)
+		if err != nil {
+			res.add("invalid-log", r.line, false, "%s", err)
+			continue
+		}
+		if logEntryOp(e) == kLogChangeContent {
+			changes[r.line] = e
+		}
+	}
+	for _, line := range slices.Sorted(maps.Keys(changes)) {
+		e := changes[line]
+		if id := logEntryStr(e, 3); contentIDs[id] == 0 {
+			res.add("missing-content", line, false, "content '%s' of note '%s' doesn't exist", id, logEntryNoteID(e))
+		}
+	}
+
+	if res.dataSize > res.dataEnd {
+		tail, err := readFileRange(dataFile, res.dataEnd, res.dataSize-res.dataEnd)
+		if err != nil {
+			return nil, err
+		}
+		res.add("torn-data", 0, true, "%d bytes at the end of data.bin are not referenced by any record", len(tail))
+		// log entry is appended after content so if we crashed before
+		// writing its index line, we can re-create it
+		d, err := openRecord(keys, "log", "", res.dataEnd, tail)
+		if err == nil {
+			if e, err := validateLogEntry(d); err == nil {
+				res.recoveredLine = fmt.Sprintf("%d %d %d log", res.dataEnd, len(tail), logEntryTimestamp(e))
+			}
+		}
+	}
+	return res, nil
+}
+
+func repairStore(res *fsckResult) error {
+	if !res.hasFixable() {
+		return nil
+	}
+	suffix := ".fsck-" + time.Now().Format("20060102-150405") + ".bak"
+	idxPath := filepath.Join(res.Dir, "index.txt")
+	dataPath := filepath.Join(res.Dir, "data.bin")
+
+	lines := res.validLines
+	if res.recoveredLine != "" {
+		lines = append(lines, res.recoveredLine)
+		logf("repairStore: recovered log entry at offset %d\n", res.dataEnd)
+	} else if res.dataSize > res.dataEnd {
+		d, err := os.ReadFile(dataPath)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(dataPath+suffix, d[res.dataEnd:], 0644)
+		if err != nil {
+			return err
+		}
+		err = os.Truncate(dataPath, res.dataEnd)
+		if err != nil {
+			return err
+		}
+		logf("repairStore: truncated data.bin from %d to %d bytes\n", res.dataSize, res.dataEnd)
+	}
+
+	d, err := os.ReadFile(idxPath)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(idxPath+suffix, d, 0644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	f, err := atomicfile.New(idxPath)
+	if err != nil {
+		return err
+	}
+	defer f.RemoveIfNotClosed()
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	logf("repairStore: wrote index.txt with %d records, old saved as '%s'\n", len(lines), idxPath+suffix)
+	return nil
+}
+
+// -fsck or -fsck-user ${user}, optionally with -repair
+func runFsck(userID string, repair bool) {
+	var dirs []string
+	if userID != "" {
+		panicIf(!isValidUserID(userID), "invalid user id '%s'", userID)
+		dirs = []string{userDataDir(userID)}
+	} else {
+		var err error
+		dirs, err = listUserStoreDirs()
+		must(err)
+	}
+	nIssues := 0
+	for _, dir := range dirs {
+		res, err := fsckStore(dir)
+		if err != nil {
+			logErrorf("fsck: '%s': %s\n", dir, err)
+			nIssues++
+			continue
+		}
+		logf("fsck: '%s': %d records, %d log entries, %d contents, %d issues\n", dir, res.RecordsCount, res.LogsCount, res.ContentCount, len(res.Issues))
+		for _, issue := range res.Issues {
+			fixable := ""
+			if issue.Fixable {
+				fixable = " (fixable with -repair)"
+			}
+			if issue.Line > 0 {
+				logf("  %s: line %d: %s%s\n", issue.Kind, issue.Line, issue.Msg, fixable)
+			} else {
+				logf("  %s: %s%s\n", issue.Kind, issue.Msg, fixable)
+			}
+		}
+		nIssues += len(res.Issues)
+		if repair {
+			must(repairStore(res))
+		}
+	}
+	logf("fsck: checked %d stores, found %d issues\n", len(dirs), nIssues)
+}
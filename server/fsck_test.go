@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func fsckIssueKinds(res *fsckResult) []string {
+	var kinds []string
+	for _, issue := range res.Issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	s := &appendstore.Store{DataDir: dir}
+	assert.NoError(t, appendstore.OpenStore(s))
+	addLog := func(e []any) {
+		d, err := json.Marshal(e)
+		assert.NoError(t, err)
+		assert.NoError(t, s.AppendRecord("log", "", d))
+	}
+	addLog(mkLogCreateNote("n1", "note", "md", false))
+	assert.NoError(t, s.AppendRecord("content", "n1-c1", []byte("hello")))
+	addLog(mkLogChangeContent("n1", "n1-c1", 5))
+	// empty content is a record without data
+	assert.NoError(t, s.AppendRecord("content", "n1-c2", nil))
+	addLog(mkLogChangeContent("n1", "n1-c2", 0))
+	assert.NoError(t, s.CloseFiles())
+
+	res, err := fsckStore(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, len(res.Issues), 0)
+	assert.Equal(t, res.RecordsCount, 5)
+	assert.Equal(t, res.LogsCount, 3)
+	assert.Equal(t, res.ContentCount, 2)
+
+	idxPath := filepath.Join(dir, "index.txt")
+	dataPath := filepath.Join(dir, "data.bin")
+	appendFile := func(path string, d string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		_, err = f.WriteString(d)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	idx, err := os.ReadFile(idxPath)
+	assert.NoError(t, err)
+	st, err := os.Stat(dataPath)
+	assert.NoError(t, err)
+	dataSize := int(st.Size())
+
+	// log entry without content, invalid log entry, duplicate line and
+	// line referring to data that was not written
+	bad := `[3,1700000000000,"n1","n1-xx",3]`
+	appendFile(dataPath, bad+"not json")
+	appendFile(idxPath, fmt.Sprintf("%d %d 1700000000000 log\n", dataSize, len(bad)))
+	appendFile(idxPath, fmt.Sprintf("%d %d 1700000000000 log\n", dataSize+len(bad), 8))
+	appendFile(idxPath, string(idx[:bytes.IndexByte(idx, '\n')+1]))
+	appendFile(idxPath, fmt.Sprintf("%d 100 1700000000000 content n1-c3\n", dataSize+1000))
+	// crashed after writing log entry to data.bin
+	lost := `[2,1700000000001,"n1","new title"]`
+	appendFile(dataPath, lost)
+	// and in the middle of writing index line
+	appendFile(idxPath, "123 4")
+
+	res, err = fsckStore(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, fsckIssueKinds(res), []string{"torn-index", "duplicate", "out-of-bounds", "invalid-log", "missing-content", "torn-data"})
+	// an existing store with torn index can't be opened
+	assert.Error(t, appendstore.OpenStore(&appendstore.Store{DataDir: dir}))
+
+	assert.NoError(t, repairStore(res))
+	res, err = fsckStore(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, fsckIssueKinds(res), []string{"invalid-log", "missing-content"})
+	assert.Equal(t, res.LogsCount, 6)
+
+	s = &appendstore.Store{DataDir: dir}
+	assert.NoError(t, appendstore.OpenStore(s))
+	defer s.CloseFiles()
+	recs := s.Records()
+	last := recs[len(recs)-1]
+	d, err := s.ReadRecord(last)
+	assert.NoError(t, err)
+	assert.Equal(t, string(d), lost)
+	assert.Equal(t, last.TimestampMs, int64(1700000000001))
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/kjk/common/u"
@@ -134,3 +136,114 @@ func getGitHubUserInfo(ghToken string) (*JSONRequest, *GitHubUser, error) {
 	err := req.Get()
 	return req, result, err
 }
+
+// https://docs.github.com/en/rest/users/emails#list-email-addresses-for-the-authenticated-user
+type GitHubEmail struct {
+	Email      string `json:"email"`
+	Primary    bool   `json:"primary"`
+	Verified   bool   `json:"verified"`
+	Visibility string `json:"visibility"`
+}
+
+func getGitHubEmails(ghToken string) ([]*GitHubEmail, error) {
+	var res []*GitHubEmail
+	req := NewGitHubRequest("/user/emails", ghToken, &res)
+	err := req.Get()
+	return res, err
+}
+
+// returns verified emails of the user, primary first. Never empty: if we
+// can't get emails (private email and no user:email scope) we use
+// GitHub's noreply address which is derived from user id
+func getGitHubUserEmails(ghToken string, i *GitHubUser) []string {
+	var res []string
+	emails, err := getGitHubEmails(ghToken)
+	if err != nil {
+		logErrorf("getGitHubEmails() failed with '%s'\n", err)
+	}
+	for _, e := range emails {
+		if !e.Verified || e.Email == "" {
+			continue
+		}
+		if e.Primary {
+			res = append([]string{e.Email}, res...)
+		} else {
+			res = append(res, e.Email)
+		}
+	}
+	if len(res) == 0 && i.Email != "" {
+		res = append(res, i.Email)
+	}
+	if len(res) == 0 {
+		res = append(res, fmt.Sprintf("%d+%s@users.noreply.github.com", i.ID, i.Login))
+	}
+	return res
+}
+
+// githubAuthProvider implements OAuthProvider
+// https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/authorizing-oauth-apps
+type githubAuthProvider struct{}
+
+func (p *githubAuthProvider) Name() string {
+	return "github"
+}
+
+func (p *githubAuthProvider) DisplayName() string {
+	return "GitHub"
+}
+
+func (p *githubAuthProvider) AuthCodeURL(state string, callbackURL string) (string, error) {
+	clientID, _ := getGitHubSecrets()
+	vals := url.Values{}
+	vals.Add("client_id", clientID)
+	// user:email is needed to get private emails
+	vals.Add("scope", "read:user user:email")
+	vals.Add("state", state)
+	vals.Add("redirect_uri", callbackURL)
+	return "https://github.com/login/oauth/authorize?" + vals.Encode(), nil
+}
+
+func (p *githubAuthProvider) Exchange(ctx context.Context, code string, callbackURL string) (*AuthIdentity, error) {
+	// https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/authorizing-oauth-apps#2-users-are-redirected-back-to-your-site-by-github
+	vals := url.Values{}
+	clientId, clientSecret := getGitHubSecrets()
+	vals.Add("client_id", clientId)
+	vals.Add("client_secret", clientSecret)
+	vals.Add("code", code)
+	uri := "https://github.com/login/oauth/access_token?" + vals.Encode()
+	hdrs := map[string]string{
+		"Accept": "application/json",
+	}
+	resp, err := postWithHeaders(uri, hdrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token from GitHub: %w", err)
+	}
+	defer u.CloseNoError(resp.Body)
+	var m map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access token response from GitHub: %w", err)
+	}
+	if err = oauthFormError(m); err != nil {
+		return nil, err
+	}
+
+	accessToken := mapStr(m, "access_token")
+	logf("githubAuthProvider: token_type: %s, scope: %s\n", mapStr(m, "token_type"), mapStr(m, "scope"))
+
+	_, i, err := getGitHubUserInfo(accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info from GitHub: %w", err)
+	}
+	if i.ID == 0 || i.Login == "" {
+		return nil, fmt.Errorf("GitHub didn't return user id or login")
+	}
+	return &AuthIdentity{
+		UserID: githubUserID(i.ID),
+		Login:  i.Login,
+		// i.Email is empty if user made their email private
+		Emails:    getGitHubUserEmails(accessToken, i),
+		Name:      i.Name,
+		AvatarURL: i.AvatarURL,
+	}, nil
+}
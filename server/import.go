@@ -0,0 +1,634 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+/api/store/import accepts (as POST body):
+- .zip, .tar or .tar.gz with .md / .txt files
+- .enex file (Evernote export)
+
+Importers, in order of detection:
+- noted export (see export.go): notes/*.md with front matter
+- Simplenote export: notes.json
+- Evernote: *.enex files
+- Obsidian vault (has .obsidian/ directory) or any directory of .md / .txt files
+
+Notes are created with the usual log entries, using created / modified
+times of the original files as timestamps of log entries.
+*/
+
+const maxImportSize = 256 * 1024 * 1024
+
+// limits for uncompressed archive so that a zip or gzip bomb can't
+// keep us busy. A single file is limited by maxContentSize
+var (
+	maxImportUncompressedSize int64 = 1024 * 1024 * 1024
+	maxImportFiles                  = 100000
+)
+
+// file in an archive, we only read its content when importing it
+type importFile struct {
+	Name    string
+	ModTime time.Time
+}
+
+type importedNote struct {
+	ID        string // only set if we want to preserve the id
+	Title     string
+	Kind      string
+	IsDaily   bool
+	Encrypted bool // Content is ciphertext of end-to-end encrypted note
+	Content   []byte
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type importResult struct {
+	Format   string   `json:"format"`
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// we know the names of files before reading any content so that we can
+// detect the format and then read files one at a time instead of
+// keeping uncompressed archive in memory
+type importArchive struct {
+	Files []*importFile
+	// calls fn with content of each of Files, in order
+	ForEach func(fn func(f *importFile, d []byte) error) error
+}
+
+func checkImportFilesCount(n int) error {
+	if n > maxImportFiles {
+		return &limitError{
+			Code:  http.StatusRequestEntityTooLarge,
+			Msg:   fmt.Sprintf("import has too many files, the limit is %d", maxImportFiles),
+			Limit: int64(maxImportFiles),
+		}
+	}
+	return nil
+}
+
+// reads files from archive, enforcing limits on uncompressed size.
+// We also check sizes from archive headers up-front so that we usually
+// fail before importing anything, but headers can lie
+type importReader struct {
+	size int64
+}
+
+func (ir *importReader) add(name string, size int64) error {
+	if size > maxContentSize {
+		return errTooLarge(fmt.Sprintf("file '%s'", name), size, maxContentSize)
+	}
+	ir.size += size
+	if ir.size > maxImportUncompressedSize {
+		return errTooLarge("uncompressed import", ir.size, maxImportUncompressedSize)
+	}
+	return nil
+}
+
+func (ir *importReader) readFile(name string, r io.Reader) ([]byte, error) {
+	d, err := io.ReadAll(io.LimitReader(r, maxContentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	err = ir.add(name, int64(len(d)))
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func openZipArchive(d []byte) (*importArchive, error) {
+	zr, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		return nil, err
+	}
+	var zipFiles []*zip.File
+	ar := &importArchive{}
+	sizes := &importReader{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		err = sizes.add(f.Name, int64(f.UncompressedSize64))
+		if err != nil {
+			return nil, err
+		}
+		zipFiles = append(zipFiles, f)
+		ar.Files = append(ar.Files, &importFile{
+			Name:    f.Name,
+			ModTime: f.Modified,
+		})
+	}
+	err = checkImportFilesCount(len(ar.Files))
+	if err != nil {
+		return nil, err
+	}
+	ar.ForEach = func(fn func(f *importFile, d []byte) error) error {
+		ir := &importReader{}
+		for i, zf := range zipFiles {
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			fd, err := ir.readFile(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			err = fn(ar.Files[i], fd)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ar, nil
+}
+
+// tar can only be read sequentially so we read it twice: first to get
+// file names, then to read the content
+func openTarArchive(newReader func() (io.Reader, error)) (*importArchive, error) {
+	walk := func(fn func(hdr *tar.Header, r io.Reader) error) error {
+		r, err := newReader()
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			err = fn(hdr, tr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	ar := &importArchive{}
+	sizes := &importReader{}
+	err := walk(func(hdr *tar.Header, r io.Reader) error {
+		err := sizes.add(hdr.Name, hdr.Size)
+		if err != nil {
+			return err
+		}
+		ar.Files = append(ar.Files, &importFile{
+			Name:    strings.TrimPrefix(hdr.Name, "./"),
+			ModTime: hdr.ModTime,
+		})
+		return checkImportFilesCount(len(ar.Files))
+	})
+	if err != nil {
+		return nil, err
+	}
+	ar.ForEach = func(fn func(f *importFile, d []byte) error) error {
+		ir := &importReader{}
+		i := 0
+		return walk(func(hdr *tar.Header, r io.Reader) error {
+			fd, err := ir.readFile(hdr.Name, r)
+			if err != nil {
+				return err
+			}
+			f := ar.Files[i]
+			i++
+			return fn(f, fd)
+		})
+	}
+	return ar, nil
+}
+
+func isTar(d []byte) bool {
+	return len(d) > 262 && string(d[257:262]) == "ustar"
+}
+
+func isENEX(d []byte) bool {
+	n := min(len(d), 512)
+	return bytes.Contains(d[:n], []byte("<en-export"))
+}
+
+// figures out the kind of the archive from its content
+func openImportArchive(d []byte) (*importArchive, error) {
+	switch {
+	case bytes.HasPrefix(d, []byte("PK\x03\x04")):
+		return openZipArchive(d)
+	case bytes.HasPrefix(d, []byte{0x1f, 0x8b}):
+		return openTarArchive(func() (io.Reader, error) {
+			return gzip.NewReader(bytes.NewReader(d))
+		})
+	case isTar(d):
+		return openTarArchive(func() (io.Reader, error) {
+			return bytes.NewReader(d), nil
+		})
+	case isENEX(d):
+		f := &importFile{
+			Name:    "export.enex",
+			ModTime: time.Now(),
+		}
+		ar := &importArchive{
+			Files: []*importFile{f},
+			ForEach: func(fn func(f *importFile, d []byte) error) error {
+				return fn(f, d)
+			},
+		}
+		return ar, nil
+	}
+	return nil, fmt.Errorf("unsupported format, must be .zip, .tar, .tar.gz or .enex")
+}
+
+func isImportFile(f *importFile, name string) bool {
+	return f.Name == name || strings.HasSuffix(f.Name, "/"+name)
+}
+
+func findImportFile(files []*importFile, name string) *importFile {
+	for _, f := range files {
+		if f.Name == name || strings.HasSuffix(f.Name, "/"+name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func hasExt(name string, exts ...string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeOr(s string, def time.Time) time.Time {
+	for _, layout := range []string{time.RFC3339, time.RFC3339Nano, "20060102T150405Z"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return def
+}
+
+func titleFromFileName(name string) string {
+	name = path.Base(name)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// first non-empty line, without markdown heading
+func titleFromContent(s string) string {
+	for len(s) > 0 {
+		var line string
+		line, s = getNextLine(s)
+		line = strings.TrimSpace(strings.TrimLeft(line, "# "))
+		if line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// noted export: notes/*.md with front matter we generate in export.go
+// returns nil if f is not a note
+func importNotedExportFile(f *importFile, d []byte) *importedNote {
+	if !strings.HasPrefix(f.Name, exportNotesDir+"/") || !hasExt(f.Name, ".md") {
+		return nil
+	}
+	fm, body := parseFrontMatter(string(d))
+	if fm == nil {
+		return nil
+	}
+	return &importedNote{
+		ID:        fm["id"],
+		Title:     fm["title"],
+		Kind:      fm["kind"],
+		IsDaily:   fm["daily"] == "true",
+		Encrypted: fm["encrypted"] == "true",
+		Content:   []byte(body),
+		CreatedAt: parseTimeOr(fm["created"], f.ModTime),
+		UpdatedAt: parseTimeOr(fm["updated"], f.ModTime),
+	}
+}
+
+// https://simplenote.com/help/#export
+type simplenoteExport struct {
+	ActiveNotes []struct {
+		ID           string   `json:"id"`
+		Content      string   `json:"content"`
+		CreationDate string   `json:"creationDate"`
+		LastModified string   `json:"lastModified"`
+		Tags         []string `json:"tags"`
+	} `json:"activeNotes"`
+}
+
+func appendTags(content string, tags []string) string {
+	if len(tags) == 0 {
+		return content
+	}
+	var a []string
+	for _, tag := range tags {
+		tag = strings.ReplaceAll(strings.TrimSpace(tag), " ", "-")
+		if tag != "" {
+			a = append(a, "#"+tag)
+		}
+	}
+	return strings.TrimRight(content, "\n") + "\n\n" + strings.Join(a, " ") + "\n"
+}
+
+func importSimplenote(f *importFile, d []byte) ([]*importedNote, error) {
+	var export simplenoteExport
+	err := json.Unmarshal(d, &export)
+	if err != nil {
+		return nil, err
+	}
+	var res []*importedNote
+	for _, sn := range export.ActiveNotes {
+		n := &importedNote{
+			Title:     titleFromContent(sn.Content),
+			Content:   []byte(appendTags(sn.Content, sn.Tags)),
+			CreatedAt: parseTimeOr(sn.CreationDate, f.ModTime),
+			UpdatedAt: parseTimeOr(sn.LastModified, f.ModTime),
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+type enexExport struct {
+	Notes []struct {
+		Title   string   `xml:"title"`
+		Content string   `xml:"content"`
+		Created string   `xml:"created"`
+		Updated string   `xml:"updated"`
+		Tags    []string `xml:"tag"`
+	} `xml:"note"`
+}
+
+// converts ENML (xhtml) to markdown-ish plain text
+func enmlToText(enml string) string {
+	dec := xml.NewDecoder(strings.NewReader(enml))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	var sb strings.Builder
+	newline := func() {
+		s := sb.String()
+		if len(s) > 0 && !strings.HasSuffix(s, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "div", "p", "br", "tr", "ul", "ol":
+				newline()
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				newline()
+				n := int(t.Name.Local[1] - '0')
+				sb.WriteString(strings.Repeat("#", n) + " ")
+			case "li":
+				newline()
+				sb.WriteString("- ")
+			case "en-todo":
+				checked := false
+				for _, a := range t.Attr {
+					if a.Name.Local == "checked" && a.Value == "true" {
+						checked = true
+					}
+				}
+				if checked {
+					sb.WriteString("- [x] ")
+				} else {
+					sb.WriteString("- [ ] ")
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "div", "p", "h1", "h2", "h3", "h4", "h5", "h6", "li", "tr":
+				newline()
+			}
+		case xml.CharData:
+			sb.Write(t)
+		}
+	}
+	return strings.TrimSpace(sb.String()) + "\n"
+}
+
+func importENEX(f *importFile, d []byte) ([]*importedNote, error) {
+	var export enexExport
+	dec := xml.NewDecoder(bytes.NewReader(d))
+	dec.Strict = false
+	err := dec.Decode(&export)
+	if err != nil {
+		return nil, err
+	}
+	var res []*importedNote
+	for _, en := range export.Notes {
+		content := enmlToText(en.Content)
+		n := &importedNote{
+			Title:     strings.TrimSpace(en.Title),
+			Content:   []byte(appendTags(content, en.Tags)),
+			CreatedAt: parseTimeOr(en.Created, f.ModTime),
+			UpdatedAt: parseTimeOr(en.Updated, f.ModTime),
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// Obsidian vault or any other directory of markdown / text files
+// returns nil if f is not a note
+func importMarkdownFile(f *importFile, d []byte) *importedNote {
+	if !hasExt(f.Name, ".md", ".markdown", ".txt") {
+		return nil
+	}
+	// Obsidian config and trash
+	if strings.Contains("/"+f.Name, "/.obsidian/") || strings.Contains("/"+f.Name, "/.trash/") {
+		return nil
+	}
+	title := titleFromFileName(f.Name)
+	if fm, _ := parseFrontMatter(string(d)); fm != nil && fm["title"] != "" {
+		title = fm["title"]
+	}
+	kind := "md"
+	if hasExt(f.Name, ".txt") {
+		kind = "txt"
+	}
+	return &importedNote{
+		Title:     title,
+		Kind:      kind,
+		Content:   d,
+		CreatedAt: f.ModTime,
+		UpdatedAt: f.ModTime,
+	}
+}
+
+// we detect the format from file names, before reading any files
+func detectImportFormat(files []*importFile) string {
+	hasFile := func(name string) bool {
+		return slices.ContainsFunc(files, func(f *importFile) bool {
+			return isImportFile(f, name)
+		})
+	}
+	switch {
+	case hasFile(exportLogName):
+		return "noted"
+	case hasFile("notes.json"):
+		return "simplenote"
+	case slices.ContainsFunc(files, func(f *importFile) bool { return hasExt(f.Name, ".enex") }):
+		return "enex"
+	case slices.ContainsFunc(files, func(f *importFile) bool { return strings.Contains("/"+f.Name, "/.obsidian/") }):
+		return "obsidian"
+	}
+	return "markdown"
+}
+
+// returns notes in f, d is its content
+func parseImportFile(format string, f *importFile, d []byte) ([]*importedNote, error) {
+	var n *importedNote
+	switch format {
+	case "noted":
+		n = importNotedExportFile(f, d)
+	case "simplenote":
+		if isImportFile(f, "notes.json") {
+			return importSimplenote(f, d)
+		}
+	case "enex":
+		if hasExt(f.Name, ".enex") {
+			return importENEX(f, d)
+		}
+	default:
+		n = importMarkdownFile(f, d)
+	}
+	if n == nil {
+		return nil, nil
+	}
+	return []*importedNote{n}, nil
+}
+
+// creates a note with the same log entries as the frontend would
+func storeCreateNote(ctx context.Context, u *UserInfo, n *importedNote) error {
+	now := time.Now()
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = now
+	}
+	if n.UpdatedAt.IsZero() || n.UpdatedAt.Before(n.CreatedAt) {
+		n.UpdatedAt = n.CreatedAt
+	}
+	if n.Kind == "" {
+		n.Kind = "md"
+	}
+	if n.ID == "" {
+		n.ID = genNoteID()
+	}
+	e := mkLogCreateNote(n.ID, n.Title, n.Kind, n.IsDaily)
+	e[1] = n.CreatedAt.UnixMilli()
+	err := storeAppendLog(ctx, u, e)
+	if err != nil {
+		return err
+	}
+	if len(n.Content) == 0 {
+		return nil
+	}
+	return storeAddNoteVersion(ctx, u, n.ID, n.Content, n.UpdatedAt.UnixMilli(), n.Encrypted)
+}
+
+func importUserData(ctx context.Context, u *UserInfo, d []byte) (*importResult, error) {
+	ar, err := openImportArchive(d)
+	if err != nil {
+		return nil, err
+	}
+	format := detectImportFormat(ar.Files)
+	logs, err := storeGetLogs(ctx, u, 0)
+	if err != nil {
+		return nil, err
+	}
+	existing := notesFromLogs(logs)
+
+	res := &importResult{
+		Format: format,
+	}
+	importNote := func(n *importedNote) {
+		if n.ID != "" && !isValidStoreID(n.ID) {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: invalid note id '%s'", n.Title, n.ID))
+			return
+		}
+		// re-importing noted export shouldn't create duplicates
+		if n.ID != "" && existing.Get(n.ID) != nil {
+			res.Skipped++
+			return
+		}
+		if n.Title == "" {
+			n.Title = "Untitled"
+		}
+		err := storeCreateNote(ctx, u, n)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", n.Title, err))
+			return
+		}
+		res.Imported++
+	}
+	err = ar.ForEach(func(f *importFile, fd []byte) error {
+		notes, err := parseImportFile(format, f, fd)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", f.Name, err))
+			return nil
+		}
+		for _, n := range notes {
+			importNote(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logCtxf(ctx, "importUserData: user: '%s', format: %s, imported: %d, skipped: %d, errors: %d\n", u.Email, format, res.Imported, res.Skipped, len(res.Errors))
+	return res, nil
+}
+
+// /api/store/import
+func handleImport(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	defer r.Body.Close()
+	if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeWrite) {
+		return
+	}
+	d, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if serveIfError(w, r, err) {
+		return
+	}
+	res, err := importUserData(r.Context(), u, d)
+	if serveIfLimitError(w, r, err) {
+		return
+	}
+	if err != nil {
+		serveError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveJSONOK(w, r, res)
+}
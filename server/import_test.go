@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+// files are name, content pairs
+func mkImportZip(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(files[i+1]))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func mkImportTarGz(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for i := 0; i < len(files); i += 2 {
+		hdr := &tar.Header{
+			Name:     files[i],
+			Mode:     0644,
+			Size:     int64(len(files[i+1])),
+			ModTime:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Typeflag: tar.TypeReg,
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(files[i+1]))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestImportLimits(t *testing.T) {
+	defer func(c, u int64, n int) {
+		maxContentSize, maxImportUncompressedSize, maxImportFiles = c, u, n
+	}(maxContentSize, maxImportUncompressedSize, maxImportFiles)
+	maxContentSize = 1024
+	maxImportUncompressedSize = 4096
+	maxImportFiles = 10
+
+	// compresses very well
+	mkFiles := func(nFiles int, size int) []string {
+		var res []string
+		for i := 0; i < nFiles; i++ {
+			res = append(res, fmt.Sprintf("note-%d.md", i), string(make([]byte, size)))
+		}
+		return res
+	}
+	isLimitError := func(err error) bool {
+		var le *limitError
+		return errors.As(err, &le) && le.Code == http.StatusRequestEntityTooLarge
+	}
+
+	for _, mkArchive := range []func(t *testing.T, files ...string) []byte{mkImportZip, mkImportTarGz} {
+		ar, err := openImportArchive(mkArchive(t, mkFiles(4, 1024)...))
+		assert.NoError(t, err)
+		assert.Equal(t, len(ar.Files), 4)
+		n := 0
+		err = ar.ForEach(func(f *importFile, d []byte) error {
+			assert.Equal(t, f.Name, fmt.Sprintf("note-%d.md", n))
+			assert.Equal(t, len(d), 1024)
+			n++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, n, 4)
+
+		_, err = openImportArchive(mkArchive(t, mkFiles(1, 1025)...))
+		assert.True(t, isLimitError(err))
+		_, err = openImportArchive(mkArchive(t, mkFiles(5, 1000)...))
+		assert.True(t, isLimitError(err))
+		_, err = openImportArchive(mkArchive(t, mkFiles(11, 1)...))
+		assert.True(t, isLimitError(err))
+	}
+}
+
+// title => content of notes of u
+func storeNotesContent(t *testing.T, u *UserInfo) map[string]string {
+	logs, err := storeGetLogs(ctx(), u, 0)
+	assert.NoError(t, err)
+	res := map[string]string{}
+	for _, note := range notesFromLogs(logs).Notes {
+		d, err := contentGet(ctx(), u, note.ContentID)
+		assert.NoError(t, err)
+		res[note.Title] = string(d)
+	}
+	return res
+}
+
+func TestImport(t *testing.T) {
+	notedNote := formatFrontMatter("id", "note01", "title", "First", "kind", "md", "created", "2024-01-02T03:04:05Z", "updated", "2024-02-03T04:05:06Z") + "hello\n"
+	badIDNote := formatFrontMatter("id", "bad id", "title", "Bad") + "bad\n"
+	simplenote := `{"activeNotes":[{"id":"x","content":"# Groceries\nmilk\n","creationDate":"2024-01-02T03:04:05.000Z","lastModified":"2024-01-03T03:04:05.000Z","tags":["to buy"]}]}`
+	enex := `<?xml version="1.0" encoding="UTF-8"?>
+<en-export><note><title>Trip</title><content><![CDATA[<en-note><h1>Plan</h1><div>pack</div><en-todo checked="true"/>tickets</en-note>]]></content><created>20240102T030405Z</created><tag>travel</tag></note></en-export>`
+
+	tests := []struct {
+		name     string
+		data     []byte
+		format   string
+		imported int
+		nErrors  int
+		want     map[string]string
+	}{
+		{
+			name:     "noted export",
+			data:     mkImportZip(t, "notes/First.md", notedNote, "notes/Bad.md", badIDNote, "versions/note01/note01-abcd.md", "old", exportLogName, "[]"),
+			format:   "noted",
+			imported: 1,
+			nErrors:  1,
+			want:     map[string]string{"First": "hello\n"},
+		},
+		{
+			name:     "simplenote",
+			data:     mkImportZip(t, "source/notes.json", simplenote),
+			format:   "simplenote",
+			imported: 1,
+			want:     map[string]string{"Groceries": "# Groceries\nmilk\n\n#to-buy\n"},
+		},
+		{
+			name:     "enex",
+			data:     []byte(enex),
+			format:   "enex",
+			imported: 1,
+			want:     map[string]string{"Trip": "# Plan\npack\n- [x] tickets\n\n#travel\n"},
+		},
+		{
+			name:     "obsidian",
+			data:     mkImportTarGz(t, "vault/.obsidian/app.json", "{}", "vault/daily/Monday.md", "# work\n", "vault/.trash/Old.md", "gone", "vault/list.txt", "a\nb\n", "vault/image.png", "png"),
+			format:   "obsidian",
+			imported: 2,
+			want:     map[string]string{"Monday": "# work\n", "list": "a\nb\n"},
+		},
+		{
+			name:     "markdown",
+			data:     mkImportZip(t, "a.md", formatFrontMatter("title", "From Front Matter")+"text\n"),
+			format:   "markdown",
+			imported: 1,
+			want:     map[string]string{"From Front Matter": formatFrontMatter("title", "From Front Matter") + "text\n"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+			assert.NoError(t, appendstore.OpenStore(u.Store))
+			defer u.Store.CloseFiles()
+
+			res, err := importUserData(ctx(), u, tc.data)
+			assert.NoError(t, err)
+			assert.Equal(t, res.Format, tc.format)
+			assert.Equal(t, res.Imported, tc.imported)
+			assert.Equal(t, len(res.Errors), tc.nErrors)
+			assert.Equal(t, storeNotesContent(t, u), tc.want)
+		})
+	}
+
+	_, err := importUserData(ctx(), nil, []byte("not an archive"))
+	assert.Error(t, err)
+}
+
+func TestImportNotedExportTwice(t *testing.T) {
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer u.Store.CloseFiles()
+
+	fm := formatFrontMatter("id", "note01", "title", "First", "created", "2024-01-02T03:04:05Z", "updated", "2024-02-03T04:05:06Z", "encrypted", "true")
+	d := mkImportZip(t, "notes/First.md", fm+"ciphertext", exportLogName, "[]")
+	res, err := importUserData(ctx(), u, d)
+	assert.NoError(t, err)
+	assert.Equal(t, res.Imported, 1)
+
+	logs, err := storeGetLogs(ctx(), u, 0)
+	assert.NoError(t, err)
+	note := notesFromLogs(logs).Get("note01")
+	assert.Equal(t, note.CreatedAt, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixMilli())
+	assert.Equal(t, note.UpdatedAt, time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC).UnixMilli())
+	rec := contentGetRecord(u, note.ContentID)
+	_, encrypted := parseContentRecordMeta(rec.Meta)
+	assert.True(t, encrypted)
+
+	res, err = importUserData(ctx(), u, d)
+	assert.NoError(t, err)
+	assert.Equal(t, res.Imported, 0)
+	assert.Equal(t, res.Skipped, 1)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kjk/common/appendstore"
+)
+
+// userIndex is derived data about user's notes (current state of notes,
+// tasks, tags, front matter) used to answer queries without reading every note.
+// It's built on first use and updated incrementally from new log entries.
+type userIndex struct {
+	mu sync.Mutex
+	// number of log entries already applied
+	nLogs int
+	notes *Notes
+	// maps note id to tasks in latest version of the note
+	tasks map[string][]*Task
+	// maps note id to tags in latest version of the note
+	tags map[string][]string
+	// maps note id to front matter of latest version of the note
+	meta map[string]map[string]string
+	// notes whose latest version is end-to-end encrypted, we can't index them
+	encrypted map[string]bool
+}
+
+// re-parse derived data for a note whose content might have changed
+// contentRecs is from storeContentRecords()
+func (idx *userIndex) reindexNote(ctx context.Context, u *UserInfo, note *Note, contentRecs map[string]*appendstore.Record) {
+	delete(idx.tasks, note.ID)
+	delete(idx.tags, note.ID)
+	delete(idx.meta, note.ID)
+	delete(idx.encrypted, note.ID)
+	if note.ContentID == "" {
+		return
+	}
+	rec := contentRecs[note.ContentID]
+	if rec == nil {
+		logCtxErrorf(ctx, "reindexNote: content '%s' not found\n", note.ContentID)
+		return
+	}
+	if _, encrypted := parseContentRecordMeta(rec.Meta); encrypted {
+		idx.encrypted[note.ID] = true
+		return
+	}
+	d, err := storeReadRecord(u, rec)
+	if err != nil {
+		logCtxErrorf(ctx, "reindexNote: %s\n", err)
+		return
+	}
+	s := string(d)
+	tasks := parseTasks(s)
+	for _, t := range tasks {
+		t.NoteID = note.ID
+		t.NoteTitle = note.Title
+		t.ContentID = note.ContentID
+	}
+	idx.tasks[note.ID] = tasks
+	fm, body := parseFrontMatter(s)
+	idx.tags[note.ID] = parseTags(body, fm)
+	if fm != nil {
+		idx.meta[note.ID] = fm
+	}
+}
+
+// apply log entries added since last update
+func (idx *userIndex) updateLocked(ctx context.Context, u *UserInfo) error {
+	logs, err := storeGetLogs(ctx, u, idx.nLogs)
+	if err != nil {
+		return err
+	}
+	if idx.notes == nil {
+		idx.notes = newNotes()
+		idx.tasks = map[string][]*Task{}
+		idx.tags = map[string][]string{}
+		idx.meta = map[string]map[string]string{}
+		idx.encrypted = map[string]bool{}
+	}
+	changed := map[string]bool{}
+	var contentRecs map[string]*appendstore.Record
+	for _, e := range logs {
+		idx.nLogs++
+		// entries appended before we validated them. Skip so that one bad
+		// entry doesn't break the index
+		err = idx.notes.ApplyLog(e)
+		if err != nil {
+			logCtxErrorf(ctx, "userIndex.updateLocked: user '%s', skipping log entry %d: %s\n", u.ID, idx.nLogs-1, err)
+			continue
+		}
+		changed[logEntryNoteID(e)] = true
+	}
+	for id := range changed {
+		note := idx.notes.Get(id)
+		if note == nil {
+			delete(idx.tasks, id)
+			delete(idx.tags, id)
+			delete(idx.meta, id)
+			delete(idx.encrypted, id)
+			continue
+		}
+		if contentRecs == nil {
+			contentRecs = storeContentRecords(u)
+		}
+		idx.reindexNote(ctx, u, note, contentRecs)
+	}
+	return nil
+}
+
+func (idx *userIndex) getNote(id string) *Note {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if note := idx.notes.Get(id); note != nil {
+		c := *note
+		return &c
+	}
+	return nil
+}
+
+func (idx *userIndex) isEncrypted(id string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.encrypted[id]
+}
+
+func (idx *userIndex) allTasks() []*Task {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var res []*Task
+	for _, note := range idx.notes.Notes {
+		for _, t := range idx.tasks[note.ID] {
+			c := *t
+			res = append(res, &c)
+		}
+	}
+	return res
+}
+
+// returns up-to-date index, building it if necessary
+func getUserIndex(ctx context.Context, u *UserInfo) (*userIndex, error) {
+	muStore.Lock()
+	if u.index == nil {
+		u.index = &userIndex{}
+	}
+	idx := u.index
+	muStore.Unlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	err := idx.updateLocked(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// called after appending to the log so that index is updated on save
+// we don't build the index if it wasn't needed yet
+func updateUserIndexIfBuilt(ctx context.Context, u *UserInfo) {
+	muStore.Lock()
+	idx := u.index
+	muStore.Unlock()
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	err := idx.updateLocked(ctx, u)
+	if err != nil {
+		logCtxErrorf(ctx, "updateUserIndexIfBuilt: %s\n", err)
+	}
+}
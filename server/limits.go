@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// limits so that a runaway client can't fill the disk. Configurable in secrets:
+// NOTED_MAX_CONTENT_SIZE : max size of a single content record (note version)
+// NOTED_MAX_LOG_ENTRY_SIZE : max size of a single log entry
+// NOTED_USER_QUOTA : max size of user's store, 0 means no limit
+// Values are bytes with optional KB, MB or GB suffix e.g. "16MB"
+
+var (
+	maxContentSize  int64 = 16 * 1024 * 1024
+	maxLogEntrySize int64 = 64 * 1024
+	userQuota       int64 = 1024 * 1024 * 1024
+)
+
+// limitError is sent to the client as JSON with 413 or 507 status
+type limitError struct {
+	Code  int
+	Msg   string
+	Limit int64
+}
+
+func (e *limitError) Error() string {
+	return e.Msg
+}
+
+func errTooLarge(what string, size int64, limit int64) error {
+	return &limitError{
+		Code:  http.StatusRequestEntityTooLarge,
+		Msg:   fmt.Sprintf("%s is too large: %s, the limit is %s", what, formatSize(size), formatSize(limit)),
+		Limit: limit,
+	}
+}
+
+func errQuotaExceeded(used int64, size int64) error {
+	return &limitError{
+		Code:  http.StatusInsufficientStorage,
+		Msg:   fmt.Sprintf("storage quota exceeded: using %s of %s, can't add %s", formatSize(used), formatSize(userQuota), formatSize(size)),
+		Limit: userQuota,
+	}
+}
+
+// returns false if err is not a limit error
+func serveIfLimitError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var le *limitError
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &le):
+	case errors.As(err, &mbe):
+		le = &limitError{
+			Code:  http.StatusRequestEntityTooLarge,
+			Msg:   fmt.Sprintf("request body is too large, the limit is %s", formatSize(mbe.Limit)),
+			Limit: mbe.Limit,
+		}
+	default:
+		return false
+	}
+	logCtxWarnf(r.Context(), "serveIfLimitError: %d %s\n", le.Code, le.Msg)
+	v := map[string]any{
+		"error": le.Msg,
+		"limit": le.Limit,
+	}
+	d, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.WriteHeader(le.Code)
+	w.Write(d)
+	return true
+}
+
+// reserves size in user's quota before appending a record to user's store
+// so that concurrent appends can't go over the quota together.
+// If append fails, the caller gives the space back with u.storeSize.Add(-size)
+func reserveUserQuota(u *UserInfo, size int64) error {
+	for {
+		used := u.storeSize.Load()
+		if userQuota > 0 && used+size > userQuota {
+			return errQuotaExceeded(used, size)
+		}
+		if u.storeSize.CompareAndSwap(used, used+size) {
+			return nil
+		}
+	}
+}
+
+// approximate size of a record in data and index files
+func recordSizeOnDisk(kind string, meta string, d []byte) int64 {
+	// index line has offset, size, timestamp, kind and meta
+	return int64(len(d) + len(kind) + len(meta) + 48)
+}
+
+// parses "1024", "64KB", "16MB", "1GB"
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, suffix := range []struct {
+		s string
+		n int64
+	}{{"KB", 1024}, {"MB", 1024 * 1024}, {"GB", 1024 * 1024 * 1024}} {
+		if v, ok := strings.CutSuffix(s, suffix.s); ok {
+			s, mult = strings.TrimSpace(v), suffix.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * mult, nil
+}
+
+func loadLimitsFromSecrets(m map[string]string) {
+	get := func(key string, v *int64) {
+		s := strings.TrimSpace(m[key])
+		if s == "" {
+			return
+		}
+		n, err := parseByteSize(s)
+		panicIf(err != nil, "invalid %s: %v", key, err)
+		*v = n
+		logf("Got %s: %s\n", key, formatSize(n))
+	}
+	get("NOTED_MAX_CONTENT_SIZE", &maxContentSize)
+	get("NOTED_MAX_LOG_ENTRY_SIZE", &maxLogEntrySize)
+	get("NOTED_USER_QUOTA", &userQuota)
+}
+
+// /api/store/usage
+func handleUsage(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	if !checkScope(w, r, scopeRead) {
+		return
+	}
+	byKind := map[string]int64{}
+	for _, rec := range u.Store.Records() {
+		byKind[rec.Kind] += rec.Size
+	}
+	res := map[string]any{
+		"store_size":         u.storeSize.Load(),
+		"quota":              userQuota,
+		"max_content_size":   maxContentSize,
+		"max_log_entry_size": maxLogEntrySize,
+		"records_count":      len(u.Store.Records()),
+		"size_by_kind":       byKind,
+	}
+	serveJSONOK(w, r, res)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"1024", 1024},
+		{"64KB", 64 * 1024},
+		{" 16 mb", 16 * 1024 * 1024},
+		{"1GB", 1024 * 1024 * 1024},
+	}
+	for _, tc := range tests {
+		got, err := parseByteSize(tc.s)
+		assert.NoError(t, err)
+		assert.Equal(t, got, tc.want, tc.s)
+	}
+	for _, s := range []string{"", "MB", "-1", "1TB"} {
+		_, err := parseByteSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	defer func(q int64) { userQuota = q }(userQuota)
+	userQuota = 100
+	u := &UserInfo{}
+	u.storeSize.Store(80)
+	assert.NoError(t, reserveUserQuota(u, 10))
+	assert.Equal(t, u.storeSize.Load(), int64(90))
+	err := reserveUserQuota(u, 11)
+	var le *limitError
+	assert.True(t, errors.As(err, &le))
+	assert.Equal(t, le.Code, http.StatusInsufficientStorage)
+	assert.Equal(t, u.storeSize.Load(), int64(90))
+
+	// concurrent appends can't go over the quota together
+	u.storeSize.Store(0)
+	var wg sync.WaitGroup
+	var nOK atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveUserQuota(u, 10) == nil {
+				nOK.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, nOK.Load(), int32(10))
+	assert.Equal(t, u.storeSize.Load(), int64(100))
+
+	userQuota = 0
+	assert.NoError(t, reserveUserQuota(u, 1000))
+}
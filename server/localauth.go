@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// local accounts with username / password, for self-hosted instances
+// users are in data/local_users.json, managed with:
+// noted -set-local-user ${login}:${email} (reads password from stdin)
+
+type LocalUser struct {
+	Login        string    `json:"login"`
+	Email        string    `json:"email"`
+	Name         string    `json:"name,omitempty"`
+	PasswordHash string    `json:"password_hash"` // bcrypt
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const minLocalPasswordLen = 8
+
+var (
+	rxLocalLogin = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+	muLocalUsers sync.Mutex
+)
+
+func localUsersFilePath() string {
+	return filepath.Join(getDataDirMust(), "local_users.json")
+}
+
+func loadLocalUsers() ([]*LocalUser, error) {
+	var res []*LocalUser
+	err := readJSONFile(localUsersFilePath(), &res)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// creates a user or changes the password of existing user
+func setLocalUser(login, email, password string) error {
+	login = strings.ToLower(strings.TrimSpace(login))
+	if !rxLocalLogin.MatchString(login) {
+		return fmt.Errorf("invalid login '%s', must be lowercase letters, digits, _ or -", login)
+	}
+	if len(password) < minLocalPasswordLen {
+		return fmt.Errorf("password must be at least %d characters", minLocalPasswordLen)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	muLocalUsers.Lock()
+	defer muLocalUsers.Unlock()
+	users, err := loadLocalUsers()
+	if err != nil {
+		return err
+	}
+	var lu *LocalUser
+	for _, u := range users {
+		if u.Login == login {
+			lu = u
+		}
+	}
+	if lu == nil {
+		lu = &LocalUser{Login: login, CreatedAt: time.Now().UTC()}
+		users = append(users, lu)
+	}
+	if email != "" {
+		lu.Email = email
+	}
+	if lu.Email == "" {
+		return fmt.Errorf("email is required for new user '%s'", login)
+	}
+	lu.PasswordHash = string(hash)
+	return writeJSONFileAtomic(localUsersFilePath(), users)
+}
+
+// -set-local-user ${login}:${email}
+func setLocalUserFromCmdLine(s string) {
+	login, email, _ := strings.Cut(s, ":")
+	fmt.Printf("password for '%s': ", login)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	must(err)
+	password = strings.TrimRight(password, "\r\n")
+	must(setLocalUser(login, email, password))
+	logf("set password of local user '%s'\n", login)
+}
+
+// localAuthProvider implements PasswordProvider
+type localAuthProvider struct{}
+
+func (p *localAuthProvider) Name() string {
+	return "local"
+}
+
+func (p *localAuthProvider) DisplayName() string {
+	return "Username and password"
+}
+
+func (p *localAuthProvider) hasUsers() bool {
+	users, err := loadLocalUsers()
+	return err == nil && len(users) > 0
+}
+
+// used when login doesn't exist so that timing doesn't reveal
+// which logins exist
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	d, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	must(err)
+	return d
+})
+
+func (p *localAuthProvider) Authenticate(login string, password string) (*AuthIdentity, error) {
+	login = strings.ToLower(strings.TrimSpace(login))
+	users, err := loadLocalUsers()
+	if err != nil {
+		return nil, err
+	}
+	var lu *LocalUser
+	for _, u := range users {
+		if u.Login == login {
+			lu = u
+		}
+	}
+	if lu == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, fmt.Errorf("invalid login or password")
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(lu.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("invalid login or password")
+	}
+	return &AuthIdentity{
+		UserID: "local-" + lu.Login,
+		Login:  lu.Login,
+		Emails: []string{lu.Email},
+		Name:   lu.Name,
+	}, nil
+}
+
+var passwordLoginTmpl = template.Must(template.New("login").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Log in to noted</title></head>
+<body style="font-family: sans-serif; display: flex; justify-content: center; margin-top: 4em">
+<form method="POST" action="{{.Action}}" style="display: flex; flex-direction: column; gap: 0.5em; width: 20em">
+<div style="font-weight: bold">{{.DisplayName}}</div>
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<input name="login" placeholder="login" autocomplete="username" required>
+<input name="password" type="password" placeholder="password" autocomplete="current-password" required>
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// GET shows login form, POST checks login and password
+func handlePasswordLogin(w http.ResponseWriter, r *http.Request, p PasswordProvider, redirectURL string) {
+	if r.Method == http.MethodGet {
+		v := map[string]string{
+			"Action":      "/auth/" + p.Name() + "/login",
+			"DisplayName": p.DisplayName(),
+			"Redirect":    redirectURL,
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := passwordLoginTmpl.Execute(w, v)
+		logIfErrf(ctx(), err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		serveError(w, r, "only GET and POST supported", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := p.Authenticate(r.FormValue("login"), r.FormValue("password"))
+	if err != nil {
+		redirectLoginFailed(w, r, err.Error())
+		return
+	}
+	completeLogin(w, r, id, redirectURL)
+}
@@ -3,13 +3,89 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
-func logf(s string, args ...interface{}) {
+// until initLogging() is called we print plain text. After that we log
+// with slog, as text or JSON (-log-format), at -log-level and above.
+// Log lines logged with request's context have request id and user.
+var (
+	logger   *slog.Logger
+	logLevel = new(slog.LevelVar)
+)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level '%s', must be debug, info, warn or error", s)
+}
+
+func initLogging(w io.Writer, format string, level string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(lvl)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "", "text":
+		logger = slog.New(requestLogHandler{slog.NewTextHandler(w, opts)})
+	case "json":
+		logger = slog.New(requestLogHandler{slog.NewJSONHandler(w, opts)})
+	default:
+		return fmt.Errorf("invalid log format '%s', must be text or json", format)
+	}
+	return nil
+}
+
+func logAt(ctx context.Context, level slog.Level, s string, args ...any) {
 	if len(args) > 0 {
 		s = fmt.Sprintf(s, args...)
 	}
-	fmt.Print(s)
+	if logger == nil {
+		if level >= logLevel.Level() {
+			fmt.Print(s)
+		}
+		return
+	}
+	logger.Log(ctx, level, strings.TrimSpace(s))
+}
+
+func logf(s string, args ...interface{}) {
+	logAt(context.Background(), slog.LevelInfo, s, args...)
+}
+
+func logDebugf(s string, args ...interface{}) {
+	logAt(context.Background(), slog.LevelDebug, s, args...)
+}
+
+func logWarnf(s string, args ...interface{}) {
+	logAt(context.Background(), slog.LevelWarn, s, args...)
+}
+
+// logs with request id and user from ctx
+func logCtxf(ctx context.Context, s string, args ...interface{}) {
+	logAt(ctx, slog.LevelInfo, s, args...)
+}
+
+func logCtxDebugf(ctx context.Context, s string, args ...interface{}) {
+	logAt(ctx, slog.LevelDebug, s, args...)
+}
+
+func logCtxWarnf(ctx context.Context, s string, args ...interface{}) {
+	logAt(ctx, slog.LevelWarn, s, args...)
 }
 
 func logErrorf(format string, args ...interface{}) {
@@ -18,7 +94,25 @@ func logErrorf(format string, args ...interface{}) {
 		s = fmt.Sprintf(format, args...)
 	}
 	cs := getCallstack(1)
-	logf("Error: %s\n%s\n", s, cs)
+	logErrorWithCallstack(context.Background(), s, cs)
+}
+
+func logCtxErrorf(ctx context.Context, format string, args ...interface{}) {
+	s := format
+	if len(args) > 0 {
+		s = fmt.Sprintf(format, args...)
+	}
+	cs := getCallstack(1)
+	logErrorWithCallstack(ctx, s, cs)
+}
+
+func logErrorWithCallstack(ctx context.Context, s string, cs string) {
+	rememberError(s, cs)
+	if logger == nil {
+		fmt.Printf("Error: %s\n%s\n", s, cs)
+		return
+	}
+	logger.Log(ctx, slog.LevelError, strings.TrimSpace(s), "callstack", cs)
 }
 
 // return true if there was an error
@@ -37,10 +131,62 @@ func logIfErrf(ctx context.Context, err error, msgAndArgs ...interface{}) bool {
 
 	cs := getCallstack(1)
 	if msg != "" {
-		logf("Error: %s\n%s\n%s\n", err, msg, cs)
-
+		logErrorWithCallstack(ctx, err.Error()+": "+msg, cs)
 	} else {
-		logf("Error: %s\n%s\n", err, cs)
+		logErrorWithCallstack(ctx, err.Error(), cs)
 	}
 	return true
 }
+
+// request id and user of HTTP request, stored in request's context.
+// Goroutines started by a handler get it by using request's context.
+type requestLogInfo struct {
+	RequestID string
+	userID    atomic.Pointer[string]
+}
+
+type requestLogKey struct{}
+
+func getRequestLogInfo(ctx context.Context) *requestLogInfo {
+	if ctx == nil {
+		return nil
+	}
+	ri, _ := ctx.Value(requestLogKey{}).(*requestLogInfo)
+	return ri
+}
+
+// call when starting to handle HTTP request
+func withRequestLog(r *http.Request, requestID string) *http.Request {
+	ri := &requestLogInfo{RequestID: requestID}
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey{}, ri))
+}
+
+// called once we know who is making the request
+func setRequestLogUser(ctx context.Context, userID string) {
+	if ri := getRequestLogInfo(ctx); ri != nil {
+		ri.userID.Store(&userID)
+	}
+}
+
+// adds request id and user from context to log records
+type requestLogHandler struct {
+	slog.Handler
+}
+
+func (h requestLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if ri := getRequestLogInfo(ctx); ri != nil {
+		rec.AddAttrs(slog.String("req_id", ri.RequestID))
+		if userID := ri.userID.Load(); userID != nil {
+			rec.AddAttrs(slog.String("user", *userID))
+		}
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestLogHandler) WithGroup(name string) slog.Handler {
+	return requestLogHandler{h.Handler.WithGroup(name)}
+}
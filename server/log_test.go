@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, initLogging(&buf, "json", "info"))
+	defer func() {
+		logger = nil
+		logLevel.Set(0)
+	}()
+	assert.Error(t, initLogging(&buf, "xml", "info"))
+	assert.Error(t, initLogging(&buf, "json", "verbose"))
+
+	logf("before request\n")
+	r := withRequestLog(httptest.NewRequest("GET", "/", nil), "req1")
+	setRequestLogUser(r.Context(), "github-1")
+	logCtxf(r.Context(), "in request: %d\n", 5)
+	logCtxErrorf(r.Context(), "failed")
+	// goroutines started by a handler log with request's context
+	done := make(chan bool)
+	go func() {
+		logCtxWarnf(r.Context(), "in goroutine")
+		done <- true
+	}()
+	<-done
+	logDebugf("not logged at info level\n")
+	logf("after request\n")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(lines), 5)
+	var recs []map[string]any
+	for _, line := range lines {
+		var m map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		recs = append(recs, m)
+	}
+	assert.Nil(t, recs[0]["req_id"])
+	assert.Equal(t, recs[1]["msg"], "in request: 5")
+	assert.Equal(t, recs[1]["req_id"], "req1")
+	assert.Equal(t, recs[1]["user"], "github-1")
+	assert.Equal(t, recs[2]["level"], "ERROR")
+	assert.Equal(t, recs[2]["req_id"], "req1")
+	assert.NotNil(t, recs[2]["callstack"])
+	assert.Equal(t, recs[3]["level"], "WARN")
+	assert.Equal(t, recs[3]["user"], "github-1")
+	assert.Nil(t, recs[4]["req_id"])
+
+	buf.Reset()
+	assert.NoError(t, initLogging(&buf, "text", "debug"))
+	logDebugf("debug message\n")
+	assert.True(t, strings.Contains(buf.String(), "level=DEBUG"))
+}
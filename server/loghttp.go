@@ -1,17 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/kjk/common/httplogger"
-	"github.com/kjk/minioutil"
+	"github.com/kjk/common/siser"
+	"github.com/minio/minio-go/v7"
 )
 
+// http access log in siser format, in data/httplog/httplog-${date}_${hour}.txt
+// A new file every hour. Rotated files are brotli-compressed to .txt.br
+// and uploaded to every configured httpLogUploader:
+// - Spaces / S3 if SPACES_KEY and SPACES_SECRET are set. HTTPLOG_S3_ENDPOINT,
+//   HTTPLOG_S3_BUCKET and HTTPLOG_S3_REGION over-ride the default Spaces bucket
+//   (use http://host:port endpoint for local S3-compatible server)
+// - a local directory if HTTPLOG_ARCHIVE_DIR is set
+// Logs can be searched with -query-httplog
+
+const httpLogApp = "noted"
+
 var (
 	httpLogger *httplogger.File
+
+	httpLogUploaders []httpLogUploader
 )
 
 func logHTTPReq(r *http.Request, code int, size int64, dur time.Duration) {
@@ -20,9 +42,9 @@ func logHTTPReq(r *http.Request, code int, size int64, dur time.Duration) {
 	}
 	if code >= 400 {
 		// make 400 stand out more in logs
-		logf("%s %d %s %s in %s\n", "   ", code, r.RequestURI, formatSize(size), dur)
+		logCtxWarnf(r.Context(), "%s %d %s %s in %s\n", "   ", code, r.RequestURI, formatSize(size), dur)
 	} else {
-		logf("%s %d %s %s in %s\n", r.Method, code, r.RequestURI, formatSize(size), dur)
+		logCtxf(r.Context(), "%s %d %s %s in %s\n", r.Method, code, r.RequestURI, formatSize(size), dur)
 	}
 
 	if code >= 300 && code < 400 {
@@ -30,66 +52,442 @@ func logHTTPReq(r *http.Request, code int, size int64, dur time.Duration) {
 		return
 	}
 
-	err := httpLogger.LogReq(r, code, size, dur)
+	if httpLogger == nil {
+		return
+	}
+	err := httpLogger.LogReq(withoutSecretHeaders(r), code, size, dur)
 	if err != nil {
 		logErrorf("httpLogger.LogReq() failed with '%s'\n", err)
 	}
 }
 
-// upload httplog-2021-10-06_01.txt as
-// apps/${app}/httplog/2021/10-06/2021-10-06_01.txt.br
-func uploadCompressedHTTPLog(app, path string) {
+// headers with credentials (api tokens, session cookies) must not end up
+// in logs that are uploaded to s3
+var httpLogSecretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// returns a shallow copy of r without headers with credentials
+func withoutSecretHeaders(r *http.Request) *http.Request {
+	hasSecret := slices.ContainsFunc(httpLogSecretHeaders, func(h string) bool {
+		return r.Header.Get(h) != ""
+	})
+	if !hasSecret {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	for _, h := range httpLogSecretHeaders {
+		r2.Header.Del(h)
+	}
+	return r2
+}
+
+// httpLogUploader uploads compressed http log file to remotePath
+// e.g. apps/noted/httplog/2021/10-06/2021-10-06_01.txt.br
+type httpLogUploader interface {
+	Name() string
+	Upload(remotePath string, path string) error
+}
+
+type s3LogUploader struct {
+	mc     *minio.Client
+	bucket string
+	name   string
+}
+
+func newS3LogUploader(c *s3Config) (*s3LogUploader, error) {
+	mc, endpoint, err := newS3Client(c)
+	if err != nil {
+		return nil, err
+	}
+	return &s3LogUploader{
+		mc:     mc,
+		bucket: c.Bucket,
+		name:   fmt.Sprintf("s3:%s/%s", endpoint, c.Bucket),
+	}, nil
+}
+
+func (l *s3LogUploader) Name() string {
+	return l.name
+}
+
+func (l *s3LogUploader) Upload(remotePath string, path string) error {
+	opts := minio.PutObjectOptions{
+		ContentType: "text/plain",
+		// not ContentEncoding because we want to download the file as is
+	}
+	_, err := l.mc.FPutObject(context.Background(), l.bucket, remotePath, path, opts)
+	return err
+}
+
+// copies files to a directory, e.g. a mounted backup volume
+type dirLogUploader struct {
+	dir string
+}
+
+func (l *dirLogUploader) Name() string {
+	return "dir:" + l.dir
+}
+
+func (l *dirLogUploader) Upload(remotePath string, path string) error {
+	dstPath := filepath.Join(l.dir, filepath.FromSlash(remotePath))
+	err := os.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err != nil {
+		return err
+	}
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmpPath := dstPath + ".tmp"
+	err = os.WriteFile(tmpPath, d, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dstPath)
+}
+
+func initHTTPLogUploaders(m map[string]string) {
+	httpLogUploaders = nil
+	get := func(key string) string {
+		if v := strings.TrimSpace(m[key]); v != "" {
+			return v
+		}
+		return os.Getenv(key)
+	}
+	access, secret := get("SPACES_KEY"), get("SPACES_SECRET")
+	if access != "" && secret != "" && !isWinOrMac() {
+		c := &s3Config{
+			Endpoint: get("HTTPLOG_S3_ENDPOINT"),
+			Bucket:   get("HTTPLOG_S3_BUCKET"),
+			Region:   get("HTTPLOG_S3_REGION"),
+			Access:   access,
+			Secret:   secret,
+		}
+		if c.Endpoint == "" {
+			c.Endpoint = defaultS3Endpoint
+		}
+		if c.Bucket == "" {
+			c.Bucket = "kjklogs"
+		}
+		ul, err := newS3LogUploader(c)
+		must(err)
+		httpLogUploaders = append(httpLogUploaders, ul)
+	}
+	if dir := get("HTTPLOG_ARCHIVE_DIR"); dir != "" {
+		httpLogUploaders = append(httpLogUploaders, &dirLogUploader{dir: dir})
+	}
+	for _, ul := range httpLogUploaders {
+		logf("http log uploader: %s\n", ul.Name())
+	}
+}
+
+func httpLogDir() string {
+	return filepath.Join(getDataDirMust(), "httplog")
+}
+
+// compresses path to path.br and deletes path
+func compressHTTPLog(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dstPath := path + ".br"
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	w := brotli.NewWriterLevel(dst, brotli.BestCompression)
+	_, err = io.Copy(w, f)
+	if err == nil {
+		err = w.Close()
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	f.Close()
+	return dstPath, os.Remove(path)
+}
+
+// called for rotated log files
+func compressAndUploadHTTPLog(path string) {
 	timeStart := time.Now()
-	mc := newMinioSpacesClient()
-	remotePath := httplogger.RemotePathFromFilePath(app, path)
-	if remotePath == "" {
-		logf("uploadCompressedHTTPLog: remotePathFromFilePath() failed for '%s'\n", path)
+	brPath, err := compressHTTPLog(path)
+	if err != nil {
+		logErrorf("compressAndUploadHTTPLog: compressHTTPLog('%s') failed with '%s'\n", path, err)
 		return
 	}
-	remotePath += ".br"
-	_, err := mc.UploadFileBrotliCompressed(remotePath, path, true)
-	if err != nil {
-		logErrorf("uploadCompressedHTTPLog: minioUploadFilePublic() failed with '%s'\n", err)
+	remotePath := httplogger.RemotePathFromFilePath(httpLogApp, path)
+	if remotePath == "" {
+		logf("compressAndUploadHTTPLog: RemotePathFromFilePath() failed for '%s'\n", path)
 		return
 	}
-	logf("uploadCompressedHTTPLog: uploaded '%s' as '%s' in %s\n", path, remotePath, time.Since(timeStart))
+	for _, ul := range httpLogUploaders {
+		err = ul.Upload(remotePath, brPath)
+		if err != nil {
+			logErrorf("compressAndUploadHTTPLog: upload of '%s' to '%s' failed with '%s'\n", brPath, ul.Name(), err)
+			continue
+		}
+		logf("compressAndUploadHTTPLog: uploaded '%s' to '%s' as '%s' in %s\n", brPath, ul.Name(), remotePath, time.Since(timeStart))
+	}
+}
+
+func httpLogFileName(t time.Time) string {
+	return "httplog-" + t.Format("2006-01-02_15") + ".txt"
+}
+
+// log files not compressed because we were stopped before rotating them
+func pendingHTTPLogs(dir string, now time.Time) []string {
+	entries, _ := os.ReadDir(dir)
+	var res []string
+	curr := httpLogFileName(now)
+	for _, de := range entries {
+		name := de.Name()
+		if strings.HasPrefix(name, "httplog-") && strings.HasSuffix(name, ".txt") && name != curr {
+			res = append(res, filepath.Join(dir, name))
+		}
+	}
+	return res
 }
 
-func OpenHTTPLog(app string) func() {
-	panicIf(app == "")
-	dir := "logs"
+func OpenHTTPLog() func() {
+	dir := httpLogDir()
 	must(os.MkdirAll(dir, 0755))
 
-	didRotate := func(path string) {
-		canUpload := hasSpacesCreds() && !isWinOrMac()
-		logf("didRotateHTTPLog: '%s', hasSpacesCreds: %v\n", path, canUpload)
-		if !canUpload {
-			return
+	pending := pendingHTTPLogs(dir, time.Now())
+	go func() {
+		for _, path := range pending {
+			compressAndUploadHTTPLog(path)
 		}
-		go uploadCompressedHTTPLog(app, path)
+	}()
+
+	didRotate := func(path string) {
+		logf("didRotateHTTPLog: '%s', uploaders: %d\n", path, len(httpLogUploaders))
+		go compressAndUploadHTTPLog(path)
 	}
 	var err error
 	httpLogger, err = httplogger.New(dir, didRotate)
 	must(err)
-	// TODO: should I change filerotate so that it opens the file immedaitely?
-	logf("opened http log file\n")
+	logf("opened http log in '%s'\n", dir)
 	return func() {
 		httpLogger.Close()
+		httpLogger = nil
+	}
+}
+
+// HTTPLogEntry is a request read from http log
+type HTTPLogEntry struct {
+	Time      time.Time
+	Method    string
+	URI       string
+	Status    int
+	Size      int64
+	Dur       time.Duration
+	IP        string
+	Host      string
+	Referer   string
+	UserAgent string
+}
+
+// httpLogQuery is parsed from -query-httplog argument e.g.
+// "path=/api/store/ status=5xx from=2025-01-02 to=2025-01-03T12"
+// All conditions are optional. path is a prefix, status is e.g. 404 or 4xx.
+// Times are local. to is inclusive if it's a day or an hour
+type httpLogQuery struct {
+	PathPrefix string
+	Status     string
+	From       time.Time
+	To         time.Time
+}
+
+var httpLogTimeFormats = []struct {
+	layout string
+	period time.Duration
+}{
+	{"2006-01-02", 24 * time.Hour},
+	{"2006-01-02T15", time.Hour},
+	{"2006-01-02T15:04", time.Minute},
+	{"2006-01-02T15:04:05", time.Second},
+}
+
+func parseTimeArg(s string, isEnd bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, f := range httpLogTimeFormats {
+		t, err := time.ParseInLocation(f.layout, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if isEnd {
+			t = t.Add(f.period)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', must be e.g. 2025-01-02, 2025-01-02T15 or 2025-01-02T15:04", s)
+}
+
+func parseHTTPLogQuery(s string) (*httpLogQuery, error) {
+	q := &httpLogQuery{}
+	var err error
+	for _, part := range strings.Fields(s) {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid condition '%s', must be key=value", part)
+		}
+		switch k {
+		case "path":
+			q.PathPrefix = v
+		case "status":
+			v = strings.ToLower(v)
+			if len(v) != 3 || strings.Trim(v, "0123456789x") != "" {
+				return nil, fmt.Errorf("invalid status '%s', must be e.g. 404 or 4xx", v)
+			}
+			q.Status = v
+		case "from":
+			q.From, err = parseTimeArg(v, false)
+		case "to":
+			q.To, err = parseTimeArg(v, true)
+		default:
+			return nil, fmt.Errorf("unknown condition '%s', must be path, status, from or to", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *httpLogQuery) matches(e *HTTPLogEntry) bool {
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	if q.PathPrefix != "" {
+		path, _, _ := strings.Cut(e.URI, "?")
+		if !strings.HasPrefix(path, q.PathPrefix) {
+			return false
+		}
+	}
+	if q.Status != "" {
+		status := strconv.Itoa(e.Status)
+		for i := range 3 {
+			if q.Status[i] != 'x' && q.Status[i] != status[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// file covers [hour, hour + 1 hour)
+func (q *httpLogQuery) matchesFile(name string) bool {
+	s := strings.TrimPrefix(name, "httplog-")
+	s, _, _ = strings.Cut(s, ".")
+	hour, err := time.ParseInLocation("2006-01-02_15", s, time.Local)
+	if err != nil {
+		return false
+	}
+	if !q.From.IsZero() && !hour.Add(time.Hour).After(q.From) {
+		return false
 	}
+	if !q.To.IsZero() && !hour.Before(q.To) {
+		return false
+	}
+	return true
 }
 
-func hasSpacesCreds() bool {
-	return os.Getenv("SPACES_KEY") != "" && os.Getenv("SPACES_SECRET") != ""
+// record is written by httplogger.WriteToRecord
+func httpLogEntryFromRecord(rec *siser.ReadRecord) *HTTPLogEntry {
+	e := &HTTPLogEntry{
+		Time: rec.Timestamp,
+	}
+	req, _ := rec.Get("req")
+	// "GET /foo?bar 200"
+	parts := strings.Fields(req)
+	if len(parts) == 3 {
+		e.Method, e.URI = parts[0], parts[1]
+		e.Status, _ = strconv.Atoi(parts[2])
+	}
+	e.Host, _ = rec.Get("host")
+	e.IP, _ = rec.Get("ipaddr")
+	e.Referer, _ = rec.Get("Referer")
+	e.UserAgent, _ = rec.Get("User-Agent")
+	s, _ := rec.Get("size")
+	e.Size, _ = strconv.ParseInt(s, 10, 64)
+	s, _ = rec.Get("durmicro")
+	n, _ := strconv.ParseInt(s, 10, 64)
+	e.Dur = time.Duration(n) * time.Microsecond
+	return e
 }
 
-func newMinioSpacesClient() *minioutil.Client {
-	config := &minioutil.Config{
-		Bucket:   "kjklogs",
-		Access:   os.Getenv("SPACES_KEY"),
-		Secret:   os.Getenv("SPACES_SECRET"),
-		Endpoint: "nyc3.digitaloceanspaces.com",
+func readHTTPLogFile(path string, q *httpLogQuery, fn func(*HTTPLogEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	mc, err := minioutil.New(config)
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".br") {
+		r = brotli.NewReader(f)
+	}
+	sr := siser.NewReader(bufio.NewReader(r))
+	for sr.ReadNextRecord() {
+		e := httpLogEntryFromRecord(sr.Record)
+		if q.matches(e) {
+			fn(e)
+		}
+	}
+	return sr.Err()
+}
+
+// reads .txt and .txt.br logs in dir, oldest first
+func queryHTTPLogs(dir string, q *httpLogQuery) ([]*HTTPLogEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, de := range entries {
+		name := de.Name()
+		isLog := strings.HasSuffix(name, ".txt") || strings.HasSuffix(name, ".txt.br")
+		if strings.HasPrefix(name, "httplog-") && isLog && q.matchesFile(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	var res []*HTTPLogEntry
+	for _, name := range names {
+		err = readHTTPLogFile(filepath.Join(dir, name), q, func(e *HTTPLogEntry) {
+			res = append(res, e)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading '%s' failed with '%w'", name, err)
+		}
+	}
+	return res, nil
+}
+
+// -query-httplog "path=/api/ status=5xx from=2025-01-02"
+func runQueryHTTPLog(s string) {
+	q, err := parseHTTPLogQuery(s)
+	must(err)
+	res, err := queryHTTPLogs(httpLogDir(), q)
 	must(err)
-	return mc
+	for _, e := range res {
+		fmt.Printf("%s %s %d %s %s %s %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Method, e.Status, e.URI, formatSize(e.Size), e.Dur, e.IP)
+	}
+	logf("found %d requests\n", len(res))
 }
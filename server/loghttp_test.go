@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/kjk/common/assert"
+	"github.com/kjk/common/httplogger"
+	"github.com/kjk/common/siser"
+)
+
+// minimal S3-compatible server that stores uploaded objects
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3Object
+}
+
+type fakeS3Object struct {
+	Key  string
+	Size int
+	ETag string
+}
+
+// /${bucket}/${key}
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Has("list-type"):
+		prefix := r.URL.Query().Get("prefix")
+		res := fakeS3ListResult{Name: bucket, Prefix: prefix}
+		for _, path := range sortedKeys(s.objects) {
+			k := strings.TrimPrefix(path, "/"+bucket+"/")
+			if strings.HasPrefix(k, prefix) {
+				res.Contents = append(res.Contents, fakeS3Object{Key: k, Size: len(s.objects[path]), ETag: `"etag"`})
+			}
+		}
+		res.KeyCount = len(res.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(res)
+		return
+	case r.Method == http.MethodGet && key != "":
+		d, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message><Key>%s</Key></Error>", key)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(d)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		w.Write(d)
+		return
+	case r.Method == http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case r.Method != http.MethodPut:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	d, err := io.ReadAll(r.Body)
+	if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		d, err = decodeAWSChunked(d)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.objects[r.URL.Path] = d
+	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// "${hex size};chunk-signature=${sig}\r\n${data}\r\n" ... with last chunk of size 0
+func decodeAWSChunked(d []byte) ([]byte, error) {
+	var res []byte
+	for {
+		hdr, rest, ok := bytes.Cut(d, []byte("\r\n"))
+		if !ok {
+			return nil, errors.New("missing chunk header")
+		}
+		sizeHex, _, _ := bytes.Cut(hdr, []byte(";"))
+		n, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || int64(len(rest)) < n+2 {
+			return nil, fmt.Errorf("invalid chunk header '%s'", hdr)
+		}
+		if n == 0 {
+			return res, nil
+		}
+		res = append(res, rest[:n]...)
+		d = rest[n+2:]
+	}
+}
+
+func writeTestHTTPLog(t *testing.T, path string, tm time.Time, reqs ...string) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	w := siser.NewWriter(f)
+	var rec siser.Record
+	for _, s := range reqs {
+		// "GET /api/store/foo 200"
+		parts := strings.Fields(s)
+		r := httptest.NewRequest(parts[0], parts[1], nil)
+		code := 200
+		if parts[2] != "200" {
+			code = 500
+		}
+		httplogger.WriteToRecord(&rec, r, code, 100, time.Millisecond)
+		rec.Timestamp = tm
+		_, err = w.WriteRecord(&rec)
+		assert.NoError(t, err)
+		tm = tm.Add(time.Minute)
+	}
+}
+
+func TestHTTPLogUploadAndQuery(t *testing.T) {
+	dataDir = t.TempDir()
+	archiveDir := t.TempDir()
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(s3)
+	defer func() {
+		srv.Close()
+		dataDir = ""
+		httpLogUploaders = nil
+	}()
+
+	s3ul, err := newS3LogUploader(&s3Config{
+		Endpoint: srv.URL,
+		Bucket:   "logs",
+		Region:   "us-east-1",
+		Access:   "access",
+		Secret:   "secret",
+	})
+	assert.NoError(t, err)
+	httpLogUploaders = []httpLogUploader{s3ul, &dirLogUploader{dir: archiveDir}}
+
+	dir := httpLogDir()
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	hour := time.Date(2025, 1, 2, 10, 0, 0, 0, time.Local)
+	path := filepath.Join(dir, httpLogFileName(hour))
+	writeTestHTTPLog(t, path, hour.Add(time.Minute), "GET /api/store/getNotes 200", "POST /api/store/setContent 500", "GET /index.html 200")
+
+	pending := pendingHTTPLogs(dir, time.Now())
+	assert.Equal(t, pending, []string{path})
+	compressAndUploadHTTPLog(path)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	brData, err := os.ReadFile(path + ".br")
+	assert.NoError(t, err)
+	uncompressed, err := io.ReadAll(brotli.NewReader(bytes.NewReader(brData)))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(uncompressed, []byte("POST /api/store/setContent 500")))
+
+	remotePath := "apps/noted/httplog/2025/01-02/2025-01-02_10.txt.br"
+	d, err := os.ReadFile(filepath.Join(archiveDir, filepath.FromSlash(remotePath)))
+	assert.NoError(t, err)
+	assert.Equal(t, d, brData)
+	assert.Equal(t, s3.objects["/logs/"+remotePath], brData)
+
+	// current log file is not compressed
+	writeTestHTTPLog(t, filepath.Join(dir, httpLogFileName(time.Now())), time.Now(), "GET /api/store/getNotes 200")
+	assert.Equal(t, len(pendingHTTPLogs(dir, time.Now())), 0)
+
+	query := func(s string) []*HTTPLogEntry {
+		q, err := parseHTTPLogQuery(s)
+		assert.NoError(t, err)
+		res, err := queryHTTPLogs(dir, q)
+		assert.NoError(t, err)
+		return res
+	}
+	assert.Equal(t, len(query("")), 4)
+	res := query("path=/api/store/ status=5xx")
+	assert.Equal(t, len(res), 1)
+	assert.Equal(t, res[0].Method, "POST")
+	assert.Equal(t, res[0].URI, "/api/store/setContent")
+	assert.Equal(t, res[0].Dur, time.Millisecond)
+	assert.Equal(t, len(query("path=/api/ from=2025-01-02 to=2025-01-02")), 2)
+	assert.Equal(t, len(query("from=2025-01-02T10:02 to=2025-01-02T10:02")), 1)
+	assert.Equal(t, len(query("status=200 from=2025-01-03")), 1)
+
+	for _, s := range []string{"status=42", "path", "foo=bar", "from=yesterday"} {
+		_, err = parseHTTPLogQuery(s)
+		assert.Error(t, err)
+	}
+}
+
+func TestHTTPLogNoSecrets(t *testing.T) {
+	dir := t.TempDir()
+	var err error
+	httpLogger, err = httplogger.New(dir, nil)
+	assert.NoError(t, err)
+	defer func() { httpLogger = nil }()
+
+	r := httptest.NewRequest("GET", "/api/store/getNotes", nil)
+	r.Header.Set("Authorization", "Bearer noted_secret-token")
+	r.Header.Set("Cookie", "ck=secret-cookie")
+	r.Header.Set("User-Agent", "test-agent")
+	logHTTPReq(r, 200, 100, time.Millisecond)
+	assert.NoError(t, httpLogger.Close())
+	// the request itself is not modified
+	assert.Equal(t, r.Header.Get("Authorization"), "Bearer noted_secret-token")
+
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), 1)
+	d, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(d, []byte("test-agent")))
+	assert.False(t, bytes.Contains(d, []byte("secret-token")))
+	assert.False(t, bytes.Contains(d, []byte("secret-cookie")))
+}
@@ -17,7 +17,9 @@ var (
 // in production deployment secrets are stored in binary as secretsEnv
 // when running non-prod we read secrets from secrets repo we assume
 // is parallel to this repo
-func loadSecrets() {
+// forServer is false for maintenance commands (e.g. -fsck) which don't
+// need secrets required to run the server
+func loadSecrets(forServer bool) {
 	var m map[string]string
 	if len(secretsEnv) > 0 {
 		logf("loading secrets from secretsEnv\n")
@@ -28,12 +30,14 @@ func loadSecrets() {
 		must(err)
 		m = u.ParseEnvMust(d)
 	}
-	validateSecrets(m)
+	if forServer {
+		validateSecrets(m)
+	}
 
 	getEnv := func(key string, val *string, minLen int) {
 		v := strings.TrimSpace(m[key])
 		if len(v) < minLen {
-			logf("Missing %s\n", key)
+			logWarnf("Missing %s\n", key)
 			return
 		}
 		*val = v
@@ -45,6 +49,51 @@ func loadSecrets() {
 	if isDev() {
 		getEnv("GITHUB_SECRET_LOCAL", &secretGitHub, 40)
 	}
+
+	// optional, enables encryption at rest, see atrest.go
+	if v := strings.TrimSpace(m["NOTED_MASTER_KEYS"]); v != "" {
+		var err error
+		masterKeys, err = parseMasterKeys(v)
+		must(err)
+		logf("Got NOTED_MASTER_KEYS, %d keys, current: '%s'\n", len(masterKeys), masterKeys[0].ID)
+	} else {
+		logWarnf("Missing NOTED_MASTER_KEYS, user stores will not be encrypted\n")
+	}
+
+	// required in production, see validateSecrets()
+	if v := strings.TrimSpace(m["COOKIE_KEYS"]); v != "" {
+		var err error
+		cookieKeyPairs, err = parseCookieKeys(v)
+		must(err)
+		logf("Got COOKIE_KEYS, %d key pairs\n", len(cookieKeyPairs)/2)
+	} else {
+		logWarnf("Missing COOKIE_KEYS\n")
+	}
+
+	loadLimitsFromSecrets(m)
+
+	// optional, see requestIP()
+	if v := strings.TrimSpace(m["TRUSTED_PROXIES"]); v != "" {
+		nets, err := parseIPNets(v)
+		must(err)
+		trustedProxies = append(trustedProxies, nets...)
+		logf("Got TRUSTED_PROXIES, %d networks\n", len(nets))
+	}
+
+	// optional, enables /metrics
+	metricsToken = strings.TrimSpace(m["METRICS_TOKEN"])
+
+	// optional, enables /api/admin/*, see admin.go
+	adminLogins = parseAdminLogins(m["NOTED_ADMINS"])
+	logf("Got %d admins\n", len(adminLogins))
+
+	initAuthProviders(m)
+
+	// optional, see loghttp.go
+	initHTTPLogUploaders(m)
+
+	// optional, see backup.go
+	initBackups(m)
 }
 
 var (
@@ -88,7 +137,24 @@ func main() {
 		flgBuildLocalProd  bool
 		flgExtractFrontend bool
 		flgUpdateGoDeps    bool
+		flgEncryptStores   bool
+		flgRotateMasterKey bool
+		flgRotateDataKeys  bool
+		flgSetLocalUser    string
+		flgLogFormat       string
+		flgLogLevel        string
+		flgQueryHTTPLog    string
+		flgRestoreBackup   string
+		flgRestoreAt       string
+		flgFsck            bool
+		flgFsckUser        string
+		flgRepair          bool
 	)
+	// user-facing sub-commands like "noted notes list"
+	if runCLI(os.Args[1:]) {
+		return
+	}
+
 	{
 		flag.BoolVar(&flgRunDev, "run-dev", false, "run the server in dev mode")
 		flag.BoolVar(&flgRunProd, "run-prod", false, "run server in production")
@@ -100,6 +166,18 @@ func main() {
 		flag.BoolVar(&flgNoBrowserOpen, "no-open", false, "don't open browser when running dev server")
 		flag.BoolVar(&flgVisualizeBundle, "visualize-bundle", false, "visualize bundle")
 		flag.BoolVar(&flgUpdateGoDeps, "update-go-deps", false, "update go dependencies")
+		flag.BoolVar(&flgEncryptStores, "encrypt-stores", false, "encrypt user stores with keys from NOTED_MASTER_KEYS")
+		flag.BoolVar(&flgRotateMasterKey, "rotate-master-key", false, "re-wrap data keys with the first key in NOTED_MASTER_KEYS")
+		flag.BoolVar(&flgRotateDataKeys, "rotate-data-keys", false, "re-encrypt user stores with new data keys")
+		flag.StringVar(&flgSetLocalUser, "set-local-user", "", "create local user or change password, ${login}:${email}")
+		flag.StringVar(&flgLogFormat, "log-format", "text", "log format: text or json")
+		flag.StringVar(&flgLogLevel, "log-level", "info", "log messages at this level and above: debug, info, warn or error")
+		flag.BoolVar(&flgFsck, "fsck", false, "check integrity of all user stores")
+		flag.StringVar(&flgFsckUser, "fsck-user", "", "check integrity of store of a given user")
+		flag.BoolVar(&flgRepair, "repair", false, "with -fsck or -fsck-user, repair torn index and data files")
+		flag.StringVar(&flgRestoreBackup, "restore-backup", "", "restore backup of all user stores to a given directory")
+		flag.StringVar(&flgRestoreAt, "restore-at", "", "with -restore-backup, restore state at a given time e.g. 2025-01-02T15:04 instead of latest")
+		flag.StringVar(&flgQueryHTTPLog, "query-httplog", "", "show requests from http log matching e.g. \"path=/api/ status=5xx from=2025-01-02 to=2025-01-03T12\"")
 
 		flag.Parse()
 	}
@@ -109,7 +187,9 @@ func main() {
 		return
 	}
 
-	loadSecrets()
+	must(initLogging(os.Stdout, flgLogFormat, flgLogLevel))
+
+	loadSecrets(flgRunDev || flgRunProd)
 
 	if false {
 		v := []interface{}{"s", 5, "hala"}
@@ -163,5 +243,42 @@ func main() {
 		return
 	}
 
+	if flgEncryptStores {
+		encryptAllStores()
+		return
+	}
+
+	if flgRotateMasterKey {
+		rotateMasterKey()
+		return
+	}
+
+	if flgRotateDataKeys {
+		rotateDataKeys()
+		return
+	}
+
+	if flgSetLocalUser != "" {
+		setLocalUserFromCmdLine(flgSetLocalUser)
+		return
+	}
+
+	if flgFsck || flgFsckUser != "" {
+		// flags after a non-flag argument are not parsed so e.g. -repair would be ignored
+		panicIf(flag.NArg() > 0, "unexpected arguments: %v, use: -fsck-user ${user} -repair", flag.Args())
+		runFsck(flgFsckUser, flgRepair)
+		return
+	}
+
+	if flgRestoreBackup != "" {
+		runRestoreBackup(flgRestoreBackup, flgRestoreAt)
+		return
+	}
+
+	if flgQueryHTTPLog != "" {
+		runQueryHTTPLog(flgQueryHTTPLog)
+		return
+	}
+
 	flag.Usage()
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /metrics in Prometheus text format, for scraping by monitoring.
+// Protected by METRICS_TOKEN secret, sent as "Authorization: Bearer ${token}".
+// Disabled if METRICS_TOKEN is not set.
+
+var (
+	metricsToken string
+	startTime    = time.Now()
+)
+
+// in seconds
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w *bytes.Buffer, name string, labels string) {
+	var cum uint64
+	for i, b := range durationBuckets {
+		if h.counts != nil {
+			cum += h.counts[i]
+		}
+		le := strconv.FormatFloat(b, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+type routeCode struct {
+	route string
+	code  int
+}
+
+var (
+	httpRequests      = map[routeCode]uint64{}
+	httpResponseBytes = map[string]uint64{}
+	httpDurations     = map[string]*histogram{}
+	storeOpDurations  = map[string]*histogram{}
+
+	muMetrics sync.Mutex
+)
+
+// api routes that get their own time series. Anything else is bucketed
+// as other so that random urls can't create unbounded number of series
+var metricsAPIRoutes = map[string]bool{
+	"/api/store/appendLog":       true,
+	"/api/store/createToken":     true,
+	"/api/store/export":          true,
+	"/api/store/getContent":      true,
+	"/api/store/getLogs":         true,
+	"/api/store/import":          true,
+	"/api/store/keys":            true,
+	"/api/store/listTokens":      true,
+	"/api/store/query":           true,
+	"/api/store/restore":         true,
+	"/api/store/revokeToken":     true,
+	"/api/store/setContent":      true,
+	"/api/store/tasks":           true,
+	"/api/store/toggleTask":      true,
+	"/api/store/usage":           true,
+	"/api/admin/backup":          true,
+	"/api/admin/closeStore":      true,
+	"/api/admin/compact":         true,
+	"/api/admin/errors":          true,
+	"/api/admin/events":          true,
+	"/api/admin/gc":              true,
+	"/api/admin/users":           true,
+	"/api/sessions/revoke":       true,
+	"/api/sessions/revokeOthers": true,
+}
+
+// maps url to a small set of routes so that we don't create
+// a time series for every note url
+func metricsRoute(uri string) string {
+	if metricsAPIRoutes[uri] {
+		return uri
+	}
+	for _, prefix := range []string{"/api/store/", "/api/admin/", "/api/sessions/"} {
+		if strings.HasPrefix(uri, prefix) {
+			return prefix + "other"
+		}
+	}
+	if strings.HasPrefix(uri, "/event/") {
+		return "/event/"
+	}
+	switch uri {
+	case "/api/sessions", "/metrics", "/ping", "/ping.txt", "/auth/ghlogin", "/auth/githubcb",
+		"/auth/logout", "/auth/ghlogout", "/auth/user", "/auth/providers":
+		return uri
+	}
+	if rest, ok := strings.CutPrefix(uri, "/auth/"); ok {
+		_, action, _ := strings.Cut(rest, "/")
+		if action == "login" || action == "callback" {
+			return "/auth/${provider}/" + action
+		}
+		return "/auth/other"
+	}
+	return "static"
+}
+
+// called for every request from handlerWithMetrics
+func recordHTTPMetrics(r *http.Request, code int, size int64, dur time.Duration) {
+	route := metricsRoute(r.URL.Path)
+	muMetrics.Lock()
+	defer muMetrics.Unlock()
+	httpRequests[routeCode{route, code}]++
+	httpResponseBytes[route] += uint64(size)
+	h := httpDurations[route]
+	if h == nil {
+		h = &histogram{}
+		httpDurations[route] = h
+	}
+	h.observe(dur.Seconds())
+}
+
+// op is e.g. "contentGet"
+func observeStoreOp(op string, dur time.Duration) {
+	muMetrics.Lock()
+	defer muMetrics.Unlock()
+	h := storeOpDurations[op]
+	if h == nil {
+		h = &histogram{}
+		storeOpDurations[op] = h
+	}
+	h.observe(dur.Seconds())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var res []string
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// size of data and index files of all stores
+func storesBytesOnDisk() int64 {
+	dirs, err := listUserStoreDirs()
+	if err != nil {
+		return 0
+	}
+	var res int64
+	for _, dir := range dirs {
+		for _, name := range []string{"data.bin", "index.txt"} {
+			if st, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				res += st.Size()
+			}
+		}
+	}
+	return res
+}
+
+func writeMetrics(w *bytes.Buffer) {
+	help := func(name, typ, desc string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, desc, name, typ)
+	}
+
+	muMetrics.Lock()
+	help("noted_http_requests_total", "counter", "HTTP requests by route and status code.")
+	var keys []routeCode
+	for k := range httpRequests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "noted_http_requests_total{route=%q,code=\"%d\"} %d\n", k.route, k.code, httpRequests[k])
+	}
+	help("noted_http_response_bytes_total", "counter", "Bytes sent in HTTP responses by route.")
+	for _, route := range sortedKeys(httpResponseBytes) {
+		fmt.Fprintf(w, "noted_http_response_bytes_total{route=%q} %d\n", route, httpResponseBytes[route])
+	}
+	help("noted_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range sortedKeys(httpDurations) {
+		httpDurations[route].write(w, "noted_http_request_duration_seconds", fmt.Sprintf("route=%q", route))
+	}
+	help("noted_store_op_duration_seconds", "histogram", "Duration of user store operations.")
+	for _, op := range sortedKeys(storeOpDurations) {
+		storeOpDurations[op].write(w, "noted_store_op_duration_seconds", fmt.Sprintf("op=%q", op))
+	}
+	muMetrics.Unlock()
+
+	help("noted_rate_limited_total", "counter", "Requests rejected by rate limiting by budget.")
+	for _, l := range rateLimiters {
+		fmt.Fprintf(w, "noted_rate_limited_total{budget=%q} %d\n", l.name, l.rejectedCount())
+	}
+
+	muStore.Lock()
+	nOpen := len(users)
+	muStore.Unlock()
+	help("noted_open_user_stores", "gauge", "User stores open in memory.")
+	fmt.Fprintf(w, "noted_open_user_stores %d\n", nOpen)
+	help("noted_store_bytes", "gauge", "Size of all user stores on disk.")
+	fmt.Fprintf(w, "noted_store_bytes %d\n", storesBytesOnDisk())
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	help("go_goroutines", "gauge", "Number of goroutines.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	help("go_memstats_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", ms.HeapAlloc)
+	help("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.")
+	fmt.Fprintf(w, "go_memstats_heap_objects %d\n", ms.HeapObjects)
+	help("go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", ms.Sys)
+	help("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", ms.NumGC)
+	help("go_gc_pause_seconds_total", "counter", "Total time spent in GC stop-the-world pauses.")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %g\n", float64(ms.PauseTotalNs)/1e9)
+	help("process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.")
+	fmt.Fprintf(w, "process_start_time_seconds %d\n", startTime.Unix())
+}
+
+// /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if metricsToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := getBearerToken(r)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+		serveError(w, r, "invalid metrics token", http.StatusUnauthorized)
+		return
+	}
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestMetricsRoute(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/api/store/getLogs", "/api/store/getLogs"},
+		{"/api/store/../x", "/api/store/other"},
+		{"/api/store/randomName", "/api/store/other"},
+		{"/api/admin/users", "/api/admin/users"},
+		{"/api/sessions/foo", "/api/sessions/other"},
+		{"/auth/google/login", "/auth/${provider}/login"},
+		{"/event/foo", "/event/"},
+		{"/n/abc-some-note", "static"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, metricsRoute(tc.uri), tc.want, tc.uri)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dataDir = t.TempDir()
+	defer func() { dataDir = "" }()
+	r := httptest.NewRequest("GET", "/api/store/getLogs", nil)
+	recordHTTPMetrics(r, 200, 10, 20*time.Millisecond)
+	recordHTTPMetrics(r, 200, 10, 3*time.Second)
+	observeStoreOp("test", time.Millisecond)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	s := buf.String()
+	assert.True(t, strings.Contains(s, `noted_http_requests_total{route="/api/store/getLogs",code="200"} 2`))
+	assert.True(t, strings.Contains(s, `noted_http_request_duration_seconds_bucket{route="/api/store/getLogs",le="0.025"} 1`))
+	assert.True(t, strings.Contains(s, `noted_http_request_duration_seconds_bucket{route="/api/store/getLogs",le="+Inf"} 2`))
+	assert.True(t, strings.Contains(s, `noted_store_op_duration_seconds_count{op="test"} 1`))
+
+	metricsToken = "secret"
+	defer func() { metricsToken = "" }()
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, w.Code, 401)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	handleMetrics(w, r)
+	assert.Equal(t, w.Code, 200)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Go version of the log format from frontend/src/notesStore.js
+// each log entry is an array:
+// [op, timestampMs, noteID, ...data for op]
+
+const (
+	kLogCreateNote    = 1 // [op, ts, id, title, kind, isDaily]
+	kLogChangeTitle   = 2 // [op, ts, id, title]
+	kLogChangeContent = 3 // [op, ts, id, contentID, size]
+	kLogChangeKind    = 4 // [op, ts, id, kind]
+	kLogDeleteNote    = 5 // [op, ts, id]
+)
+
+// matches kNoteIDLength and kNoteCotentIDLength in notesStore.js
+const (
+	noteIDLength        = 6
+	noteContentIDLength = 4
+)
+
+type Note struct {
+	ID        string
+	Title     string
+	Kind      string
+	IsDaily   bool
+	ContentID string // id of latest version of content, "" if no content
+	CreatedAt int64  // unix milliseconds
+	UpdatedAt int64  // unix milliseconds
+	Size      int64
+}
+
+// Notes is the state of notes reconstructed by re-playing the log
+type Notes struct {
+	// in order of creation
+	Notes []*Note
+	byID  map[string]*Note
+}
+
+func newNotes() *Notes {
+	return &Notes{
+		byID: map[string]*Note{},
+	}
+}
+
+func (n *Notes) Get(id string) *Note {
+	return n.byID[id]
+}
+
+// json decodes numbers as float64
+func logEntryInt(e []any, idx int) int64 {
+	if idx >= len(e) {
+		return 0
+	}
+	if f, ok := e[idx].(float64); ok {
+		return int64(f)
+	}
+	if i, ok := e[idx].(int64); ok {
+		return i
+	}
+	if i, ok := e[idx].(int); ok {
+		return int64(i)
+	}
+	return 0
+}
+
+func logEntryStr(e []any, idx int) string {
+	if idx >= len(e) {
+		return ""
+	}
+	s, _ := e[idx].(string)
+	return s
+}
+
+func logEntryBool(e []any, idx int) bool {
+	if idx >= len(e) {
+		return false
+	}
+	b, _ := e[idx].(bool)
+	return b
+}
+
+func logEntryOp(e []any) int {
+	return int(logEntryInt(e, 0))
+}
+
+func logEntryTimestamp(e []any) int64 {
+	return logEntryInt(e, 1)
+}
+
+func logEntryNoteID(e []any) string {
+	return logEntryStr(e, 2)
+}
+
+// ApplyLog mirrors StoreCommon.applyLog() in notesStore.js
+func (n *Notes) ApplyLog(e []any) error {
+	if len(e) < 3 {
+		return fmt.Errorf("invalid log entry %v", e)
+	}
+	op := logEntryOp(e)
+	ts := logEntryTimestamp(e)
+	id := logEntryNoteID(e)
+	if op == kLogCreateNote {
+		note := &Note{
+			ID:        id,
+			Title:     logEntryStr(e, 3),
+			Kind:      logEntryStr(e, 4),
+			IsDaily:   logEntryBool(e, 5),
+			CreatedAt: ts,
+			UpdatedAt: ts,
+		}
+		n.Notes = append(n.Notes, note)
+		n.byID[id] = note
+		return nil
+	}
+
+	note := n.byID[id]
+	if note == nil {
+		// the note was deleted, not an error
+		return nil
+	}
+	switch op {
+	case kLogChangeTitle:
+		note.Title = logEntryStr(e, 3)
+	case kLogChangeContent:
+		note.ContentID = logEntryStr(e, 3)
+		// compat: older entries didn't have size
+		note.Size = logEntryInt(e, 4)
+	case kLogChangeKind:
+		note.Kind = logEntryStr(e, 3)
+	case kLogDeleteNote:
+		delete(n.byID, id)
+		for i, el := range n.Notes {
+			if el == note {
+				n.Notes = append(n.Notes[:i], n.Notes[i+1:]...)
+				break
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown log op %d in %v", op, e)
+	}
+	note.UpdatedAt = ts
+	return nil
+}
+
+// invalid entries are skipped, like in notesStore.js, so that one bad entry
+// doesn't make all notes inaccessible
+func notesFromLogs(logs [][]any) *Notes {
+	res := newNotes()
+	for i, e := range logs {
+		err := res.ApplyLog(e)
+		if err != nil {
+			logErrorf("notesFromLogs: skipping log entry %d: %s\n", i, err)
+		}
+	}
+	return res
+}
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+func genNoteID() string {
+	return genRandomID(noteIDLength)
+}
+
+func genContentID(noteID string) string {
+	return noteID + "-" + genRandomID(noteContentIDLength)
+}
+
+func mkLogCreateNote(id string, title string, kind string, isDaily bool) []any {
+	return []any{kLogCreateNote, nowMs(), id, title, kind, isDaily}
+}
+
+func mkLogChangeTitle(id string, title string) []any {
+	return []any{kLogChangeTitle, nowMs(), id, title}
+}
+
+func mkLogChangeContent(id string, contentID string, size int) []any {
+	return []any{kLogChangeContent, nowMs(), id, contentID, size}
+}
+
+func mkLogChangeKind(id string, kind string) []any {
+	return []any{kLogChangeKind, nowMs(), id, kind}
+}
+
+func mkLogDeleteNote(id string) []any {
+	return []any{kLogDeleteNote, nowMs(), id}
+}
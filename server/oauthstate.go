@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth state is a random value we send to the provider and get back in
+// the callback. We remember it in data/oauth_states.json (so that a restart
+// in the middle of a login doesn't break it) together with where to redirect
+// after login.
+//
+// To protect against login CSRF (an attacker making the victim's browser
+// complete attacker's login) the state is bound to a random nonce in
+// a short-lived pre-login cookie set in the browser that started the login.
+
+const (
+	oauthStateTTL = 10 * time.Minute
+	// bounds the size of the file if someone spams /auth/${name}/login.
+	// When full, we reject new logins instead of dropping logins in progress
+	maxOAuthStates = 1024
+
+	loginCookieName = "nlogin"
+)
+
+type OAuthState struct {
+	State     string    `json:"state"`
+	Nonce     string    `json:"nonce"`
+	Provider  string    `json:"provider"`
+	Redirect  string    `json:"redirect"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	errTooManyOAuthStates = errors.New("too many logins in progress, please try again in a few minutes")
+
+	oauthStates       []*OAuthState
+	oauthStatesLoaded bool
+
+	muOAuthStates sync.Mutex
+)
+
+func oauthStatesFilePath() string {
+	return filepath.Join(getDataDirMust(), "oauth_states.json")
+}
+
+func loadOAuthStatesLocked() {
+	if oauthStatesLoaded {
+		return
+	}
+	oauthStatesLoaded = true
+	path := oauthStatesFilePath()
+	err := readJSONFile(path, &oauthStates)
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf("loadOAuthStatesLocked: readJSONFile('%s') failed with '%s'\n", path, err)
+	}
+}
+
+func saveOAuthStatesLocked() error {
+	oauthStates = slices.DeleteFunc(oauthStates, func(s *OAuthState) bool {
+		return time.Since(s.CreatedAt) > oauthStateTTL
+	})
+	return writeJSONFileAtomic(oauthStatesFilePath(), oauthStates)
+}
+
+func setLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     loginCookieName,
+		Value:    value,
+		Path:     "/auth/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !isDev(),
+		// must be sent on redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+}
+
+// returns state to send to the provider
+func createOAuthState(w http.ResponseWriter, provider string, redirectURL string) (string, error) {
+	s := &OAuthState{
+		State:     genSecureRandomHex(16),
+		Nonce:     genSecureRandomHex(16),
+		Provider:  provider,
+		Redirect:  redirectURL,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	muOAuthStates.Lock()
+	defer muOAuthStates.Unlock()
+	loadOAuthStatesLocked()
+	nActive := 0
+	for _, s := range oauthStates {
+		if time.Since(s.CreatedAt) <= oauthStateTTL {
+			nActive++
+		}
+	}
+	if nActive >= maxOAuthStates {
+		return "", errTooManyOAuthStates
+	}
+	oauthStates = append(oauthStates, s)
+	err := saveOAuthStatesLocked()
+	if err != nil {
+		return "", err
+	}
+	setLoginCookie(w, s.Nonce, int(oauthStateTTL/time.Second))
+	return s.State, nil
+}
+
+// state can only be used once. Returns redirect url for the login.
+func consumeOAuthState(w http.ResponseWriter, r *http.Request, provider string) (string, error) {
+	state := r.FormValue("state")
+	if state == "" {
+		return "", fmt.Errorf("missing oauth state")
+	}
+	muOAuthStates.Lock()
+	defer muOAuthStates.Unlock()
+	loadOAuthStatesLocked()
+
+	idx := slices.IndexFunc(oauthStates, func(s *OAuthState) bool {
+		return s.State == state
+	})
+	if idx < 0 {
+		return "", fmt.Errorf("invalid or expired oauth state")
+	}
+	s := oauthStates[idx]
+	oauthStates = slices.Delete(oauthStates, idx, idx+1)
+	err := saveOAuthStatesLocked()
+	logIfErrf(ctx(), err)
+	setLoginCookie(w, "", -1)
+
+	if time.Since(s.CreatedAt) > oauthStateTTL {
+		return "", fmt.Errorf("invalid or expired oauth state")
+	}
+	if s.Provider != provider {
+		return "", fmt.Errorf("oauth state is for provider '%s', not '%s'", s.Provider, provider)
+	}
+	nonce := ""
+	if c, err := r.Cookie(loginCookieName); err == nil {
+		nonce = c.Value
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(s.Nonce)) != 1 {
+		return "", fmt.Errorf("login was started in a different browser")
+	}
+	return s.Redirect, nil
+}
+
+// only allow redirecting to our own pages to prevent open redirect
+// returns "/" if uri is not a same-origin path
+func safeRedirectURL(uri string) string {
+	uri = strings.TrimSpace(uri)
+	// "//evil.com" and "/\evil.com" are treated by browsers as another host
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.HasPrefix(uri, "/\\") {
+		return "/"
+	}
+	if strings.ContainsAny(uri, "\r\n\t") {
+		return "/"
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return uri
+}
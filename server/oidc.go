@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/common/u"
+)
+
+// generic OpenID Connect provider (Google, GitLab, Keycloak etc.)
+// configured in secrets:
+//
+// OIDC_<NAME>_ISSUER=https://accounts.google.com
+// OIDC_<NAME>_CLIENT_ID=...
+// OIDC_<NAME>_CLIENT_SECRET=...
+// OIDC_<NAME>_DISPLAY_NAME=Google (optional)
+// OIDC_<NAME>_SCOPES=openid email profile (optional)
+//
+// We use authorization code flow and get claims from userinfo endpoint
+// (called with access token over TLS) so we don't have to verify id_token.
+// Callback url is /auth/<name>/callback
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+type oidcUserInfo struct {
+	Sub               string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     any    `json:"email_verified"` // some providers send "true"
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	Picture           string `json:"picture"`
+}
+
+func (i *oidcUserInfo) isEmailVerified() bool {
+	switch v := i.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// oidcAuthProvider implements OAuthProvider
+type oidcAuthProvider struct {
+	name         string
+	displayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+var rxProviderName = regexp.MustCompile(`^[a-z0-9]+$`)
+
+func newOIDCAuthProvider(name, issuer, clientID, clientSecret string) (*oidcAuthProvider, error) {
+	if !rxProviderName.MatchString(name) {
+		return nil, fmt.Errorf("invalid provider name '%s', must be lowercase letters and digits", name)
+	}
+	if issuer == "" || clientID == "" {
+		return nil, fmt.Errorf("issuer and client id are required for provider '%s'", name)
+	}
+	return &oidcAuthProvider{
+		name:         name,
+		displayName:  name,
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+	}, nil
+}
+
+func oidcProvidersFromSecrets(m map[string]string) ([]*oidcAuthProvider, error) {
+	var names []string
+	for k := range m {
+		s, ok := strings.CutPrefix(k, "OIDC_")
+		if !ok {
+			continue
+		}
+		if name, ok := strings.CutSuffix(s, "_ISSUER"); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var res []*oidcAuthProvider
+	for _, name := range names {
+		get := func(suffix string) string {
+			return strings.TrimSpace(m["OIDC_"+name+"_"+suffix])
+		}
+		p, err := newOIDCAuthProvider(strings.ToLower(name), get("ISSUER"), get("CLIENT_ID"), get("CLIENT_SECRET"))
+		if err != nil {
+			return res, err
+		}
+		if v := get("DISPLAY_NAME"); v != "" {
+			p.displayName = v
+		}
+		if v := get("SCOPES"); v != "" {
+			p.Scopes = strings.Fields(v)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func (p *oidcAuthProvider) Name() string {
+	return p.name
+}
+
+func (p *oidcAuthProvider) DisplayName() string {
+	return p.displayName
+}
+
+func oidcGetJSON(ctx context.Context, uri string, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return oidcDoJSON(req, v)
+}
+
+func oidcDoJSON(req *http.Request, v any) error {
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer u.CloseNoError(resp.Body)
+	d, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var m map[string]any
+		if json.Unmarshal(d, &m) == nil {
+			if err = oauthFormError(m); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("%s %s failed with '%s'", req.Method, req.URL, resp.Status)
+	}
+	return json.Unmarshal(d, v)
+}
+
+// fetched once and cached
+func (p *oidcAuthProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	uri := p.Issuer + "/.well-known/openid-configuration"
+	err := oidcGetJSON(ctx, uri, "", &d)
+	if err != nil {
+		return nil, fmt.Errorf("OpenID Connect discovery for '%s' failed: %w", p.name, err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("issuer mismatch for '%s': expected '%s', got '%s'", p.name, p.Issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("OpenID Connect discovery for '%s' is missing endpoints", p.name)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *oidcAuthProvider) AuthCodeURL(state string, callbackURL string) (string, error) {
+	d, err := p.getDiscovery(context.Background())
+	if err != nil {
+		return "", err
+	}
+	vals := url.Values{}
+	vals.Add("response_type", "code")
+	vals.Add("client_id", p.ClientID)
+	vals.Add("redirect_uri", callbackURL)
+	vals.Add("scope", strings.Join(p.Scopes, " "))
+	vals.Add("state", state)
+	return addQueryToURL(d.AuthorizationEndpoint, vals), nil
+}
+
+func (p *oidcAuthProvider) Exchange(ctx context.Context, code string, callbackURL string) (*AuthIdentity, error) {
+	if code == "" {
+		return nil, fmt.Errorf("missing code")
+	}
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vals := url.Values{}
+	vals.Add("grant_type", "authorization_code")
+	vals.Add("code", code)
+	vals.Add("redirect_uri", callbackURL)
+	vals.Add("client_id", p.ClientID)
+	vals.Add("client_secret", p.ClientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(vals.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	err = oidcDoJSON(req, &tok)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token from '%s': %w", p.name, err)
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("'%s' didn't return access token", p.name)
+	}
+
+	var ui oidcUserInfo
+	err = oidcGetJSON(ctx, d.UserinfoEndpoint, tok.AccessToken, &ui)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info from '%s': %w", p.name, err)
+	}
+	if ui.Sub == "" {
+		return nil, fmt.Errorf("'%s' didn't return user id (sub)", p.name)
+	}
+	id := &AuthIdentity{
+		UserID:    "oidc-" + p.name + "-" + safeUserIDPart(ui.Sub),
+		Login:     ui.PreferredUsername,
+		Name:      ui.Name,
+		AvatarURL: ui.Picture,
+	}
+	// only verified emails: they're used to find data of existing users
+	if ui.Email != "" && ui.isEmailVerified() {
+		id.Emails = append(id.Emails, ui.Email)
+	}
+	if len(id.Emails) == 0 {
+		host := p.Issuer
+		if uri, err := url.Parse(p.Issuer); err == nil {
+			host = uri.Host
+		}
+		id.Emails = append(id.Emails, safeUserIDPart(ui.Sub)+"@"+host)
+	}
+	if id.Login == "" {
+		id.Login, _, _ = strings.Cut(id.Emails[0], "@")
+	}
+	return id, nil
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A small query language, evaluated over user's index:
+
+query notes where tag = "work" and updated > -7d order by title limit 20
+query tasks where not done and (due <= today or priority = high)
+query tags order by count desc limit 10
+
+"query" is optional. Operators: = != < <= > >= contains, combined with
+and, or, not and parenthesis. String comparisons are case-insensitive.
+
+Values: "quoted strings", bare words, numbers, true / false, dates
+(2026-10-20), now, today and times relative to now (-7d, +3h, -2w).
+
+Multi-valued fields (tag, assignee) match if any of the values matches.
+*/
+
+type queryFieldKind int
+
+const (
+	qString queryFieldKind = iota
+	qNumber
+	qBool
+	// unix milliseconds
+	qTime
+	// YYYY-MM-DD string
+	qDate
+)
+
+// a row is *QueryNote, *Task or *QueryTag
+type queryField struct {
+	kind queryFieldKind
+	get  func(row any) []any
+}
+
+type QueryNote struct {
+	*Note
+	Tags []string          `json:"tags,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+	// we don't know tags and meta of encrypted notes
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+type QueryTag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func qval(v any) []any {
+	return []any{v}
+}
+
+func qvals(a []string) []any {
+	res := make([]any, len(a))
+	for i, s := range a {
+		res[i] = s
+	}
+	return res
+}
+
+var queryFields = map[string]map[string]*queryField{
+	"notes": {
+		"id":        {qString, func(r any) []any { return qval(r.(*QueryNote).ID) }},
+		"title":     {qString, func(r any) []any { return qval(r.(*QueryNote).Title) }},
+		"kind":      {qString, func(r any) []any { return qval(r.(*QueryNote).Kind) }},
+		"created":   {qTime, func(r any) []any { return qval(r.(*QueryNote).CreatedAt) }},
+		"updated":   {qTime, func(r any) []any { return qval(r.(*QueryNote).UpdatedAt) }},
+		"size":      {qNumber, func(r any) []any { return qval(float64(r.(*QueryNote).Size)) }},
+		"daily":     {qBool, func(r any) []any { return qval(r.(*QueryNote).IsDaily) }},
+		"tag":       {qString, func(r any) []any { return qvals(r.(*QueryNote).Tags) }},
+		"encrypted": {qBool, func(r any) []any { return qval(r.(*QueryNote).Encrypted) }},
+	},
+	"tasks": {
+		"text":       {qString, func(r any) []any { return qval(r.(*Task).Text) }},
+		"done":       {qBool, func(r any) []any { return qval(r.(*Task).Done) }},
+		"due":        {qDate, func(r any) []any { return qvalNonEmpty(r.(*Task).Due) }},
+		"priority":   {qString, func(r any) []any { return qvalNonEmpty(r.(*Task).Priority) }},
+		"assignee":   {qString, func(r any) []any { return qvals(r.(*Task).Assignees) }},
+		"note":       {qString, func(r any) []any { return qval(r.(*Task).NoteID) }},
+		"note_title": {qString, func(r any) []any { return qval(r.(*Task).NoteTitle) }},
+		"line":       {qNumber, func(r any) []any { return qval(float64(r.(*Task).Line)) }},
+	},
+	"tags": {
+		"name":  {qString, func(r any) []any { return qval(r.(*QueryTag).Name) }},
+		"count": {qNumber, func(r any) []any { return qval(float64(r.(*QueryTag).Count)) }},
+	},
+}
+
+func qvalNonEmpty(s string) []any {
+	if s == "" {
+		return nil
+	}
+	return qval(s)
+}
+
+// meta.<key> is a value from front matter of the note
+func lookupQueryField(source string, name string) *queryField {
+	if f := queryFields[source][name]; f != nil {
+		return f
+	}
+	if source == "notes" {
+		if key, ok := strings.CutPrefix(name, "meta."); ok && key != "" {
+			return &queryField{qString, func(r any) []any {
+				v, ok := r.(*QueryNote).Meta[key]
+				if !ok {
+					return nil
+				}
+				return qval(v)
+			}}
+		}
+	}
+	return nil
+}
+
+type queryTokenKind int
+
+const (
+	tokWord queryTokenKind = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	s    string
+}
+
+func tokenizeQuery(s string) ([]queryToken, error) {
+	var res []queryToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			res = append(res, queryToken{tokLParen, "("})
+			i++
+		case c == ')':
+			res = append(res, queryToken{tokRParen, ")"})
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(s) && s[end] != c {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			v := s[i+1 : end]
+			if c == '"' {
+				uv, err := strconv.Unquote(s[i : end+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string %s", s[i:end+1])
+				}
+				v = uv
+			}
+			res = append(res, queryToken{tokString, v})
+			i = end + 1
+		case strings.ContainsRune("=!<>", rune(c)):
+			op := string(c)
+			if i+1 < len(s) && s[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("invalid operator '!' at position %d", i)
+			}
+			res = append(res, queryToken{tokOp, op})
+			i += len(op)
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t\r\n()=!<>\"'", rune(s[end])) {
+				end++
+			}
+			res = append(res, queryToken{tokWord, s[i:end]})
+			i = end
+		}
+	}
+	return res, nil
+}
+
+// queryExpr is a node of parsed where clause
+type queryExpr struct {
+	op string // "and", "or", "not" or "cond"
+	// for "and", "or", "not"
+	args []*queryExpr
+
+	// for "cond"
+	field   *queryField
+	cmpOp   string
+	val     any
+	isEmpty bool // compares with "" i.e. checks if value is missing
+}
+
+type Query struct {
+	Source  string
+	where   *queryExpr
+	orderBy *queryField
+	desc    bool
+	limit   int
+}
+
+type queryParser struct {
+	toks   []queryToken
+	pos    int
+	source string
+	now    time.Time
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	return &p.toks[p.pos]
+}
+
+func (p *queryParser) next() *queryToken {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+// returns true and consumes next token if it's keyword kw
+func (p *queryParser) keyword(kw string) bool {
+	t := p.peek()
+	if t != nil && t.kind == tokWord && strings.EqualFold(t.s, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (*queryExpr, error) {
+	e, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		e2, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		e = &queryExpr{op: "or", args: []*queryExpr{e, e2}}
+	}
+	return e, nil
+}
+
+func (p *queryParser) parseAnd() (*queryExpr, error) {
+	e, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		e2, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		e = &queryExpr{op: "and", args: []*queryExpr{e, e2}}
+	}
+	return e, nil
+}
+
+func (p *queryParser) parseUnary() (*queryExpr, error) {
+	if p.keyword("not") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryExpr{op: "not", args: []*queryExpr{e}}, nil
+	}
+	t := p.peek()
+	if t != nil && t.kind == tokLParen {
+		p.pos++
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		t = p.next()
+		if t == nil || t.kind != tokRParen {
+			return nil, fmt.Errorf("expected ')'")
+		}
+		return e, nil
+	}
+	return p.parseCond()
+}
+
+func (p *queryParser) parseCond() (*queryExpr, error) {
+	t := p.next()
+	if t == nil || t.kind != tokWord {
+		return nil, fmt.Errorf("expected field name")
+	}
+	name := strings.ToLower(t.s)
+	f := lookupQueryField(p.source, name)
+	if f == nil {
+		return nil, fmt.Errorf("unknown field '%s' for %s", t.s, p.source)
+	}
+	e := &queryExpr{op: "cond", field: f}
+
+	t = p.peek()
+	if t == nil || t.kind == tokRParen || (t.kind == tokWord && (strings.EqualFold(t.s, "and") || strings.EqualFold(t.s, "or") || strings.EqualFold(t.s, "order") || strings.EqualFold(t.s, "limit"))) {
+		// "where done" is a shortcut for "where done = true"
+		if f.kind != qBool {
+			return nil, fmt.Errorf("expected operator after '%s'", name)
+		}
+		e.cmpOp = "="
+		e.val = true
+		return e, nil
+	}
+	p.pos++
+	switch {
+	case t.kind == tokOp:
+		e.cmpOp = t.s
+	case t.kind == tokWord && strings.EqualFold(t.s, "contains"):
+		e.cmpOp = "contains"
+	default:
+		return nil, fmt.Errorf("expected operator after '%s', got '%s'", name, t.s)
+	}
+
+	t = p.next()
+	if t == nil || (t.kind != tokWord && t.kind != tokString) {
+		return nil, fmt.Errorf("expected value after '%s %s'", name, e.cmpOp)
+	}
+	if t.kind == tokString && t.s == "" {
+		if e.cmpOp != "=" && e.cmpOp != "!=" {
+			return nil, fmt.Errorf("only = and != can be used with empty value")
+		}
+		e.isEmpty = true
+		return e, nil
+	}
+	kind := f.kind
+	if e.cmpOp == "contains" {
+		if kind != qString {
+			return nil, fmt.Errorf("contains can only be used with text fields")
+		}
+	}
+	if kind == qBool && e.cmpOp != "=" && e.cmpOp != "!=" {
+		return nil, fmt.Errorf("only = and != can be used with '%s'", name)
+	}
+	v, err := parseQueryValue(t.s, kind, p.now)
+	if err != nil {
+		return nil, err
+	}
+	e.val = v
+	return e, nil
+}
+
+var rxRelTime = regexp.MustCompile(`^([+-]?\d+)([hdw])$`)
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// parses now, today, 2026-10-20, RFC3339 or -7d (relative to now)
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	switch strings.ToLower(s) {
+	case "now":
+		return now, nil
+	case "today":
+		return startOfDay(now), nil
+	}
+	if m := rxRelTime.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "h":
+			return now.Add(time.Duration(n) * time.Hour), nil
+		case "d":
+			return now.AddDate(0, 0, n), nil
+		case "w":
+			return now.AddDate(0, 0, n*7), nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s'", s)
+}
+
+func parseQueryValue(s string, kind queryFieldKind, now time.Time) (any, error) {
+	switch kind {
+	case qString:
+		return strings.ToLower(s), nil
+	case qNumber:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", s)
+		}
+		return n, nil
+	case qBool:
+		switch strings.ToLower(s) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("invalid boolean '%s', must be true or false", s)
+	case qTime:
+		t, err := parseQueryTime(s, now)
+		if err != nil {
+			return nil, err
+		}
+		return t.UnixMilli(), nil
+	case qDate:
+		t, err := parseQueryTime(s, now)
+		if err != nil {
+			return nil, err
+		}
+		return t.Format("2006-01-02"), nil
+	}
+	return nil, fmt.Errorf("unknown field kind %d", kind)
+}
+
+func ParseQuery(s string, now time.Time) (*Query, error) {
+	toks, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks, now: now}
+	p.keyword("query")
+	t := p.next()
+	if t == nil || t.kind != tokWord {
+		return nil, fmt.Errorf("expected notes, tasks or tags")
+	}
+	q := &Query{Source: strings.ToLower(t.s)}
+	if queryFields[q.Source] == nil {
+		return nil, fmt.Errorf("unknown source '%s', must be notes, tasks or tags", t.s)
+	}
+	p.source = q.Source
+	if p.keyword("where") {
+		q.where, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("order") {
+		if !p.keyword("by") {
+			return nil, fmt.Errorf("expected 'by' after 'order'")
+		}
+		t = p.next()
+		if t == nil || t.kind != tokWord {
+			return nil, fmt.Errorf("expected field name after 'order by'")
+		}
+		q.orderBy = lookupQueryField(q.Source, strings.ToLower(t.s))
+		if q.orderBy == nil {
+			return nil, fmt.Errorf("unknown field '%s' for %s", t.s, q.Source)
+		}
+		if p.keyword("desc") {
+			q.desc = true
+		} else {
+			p.keyword("asc")
+		}
+	}
+	if p.keyword("limit") {
+		t = p.next()
+		if t == nil {
+			return nil, fmt.Errorf("expected number after 'limit'")
+		}
+		q.limit, err = strconv.Atoi(t.s)
+		if err != nil || q.limit < 0 {
+			return nil, fmt.Errorf("invalid limit '%s'", t.s)
+		}
+	}
+	if t := p.peek(); t != nil {
+		return nil, fmt.Errorf("unexpected '%s'", t.s)
+	}
+	return q, nil
+}
+
+func compareQueryValues(v1, v2 any) int {
+	switch v := v1.(type) {
+	case string:
+		return strings.Compare(strings.ToLower(v), v2.(string))
+	case float64:
+		return cmp.Compare(v, v2.(float64))
+	case int64:
+		return cmp.Compare(v, v2.(int64))
+	case bool:
+		if v == v2.(bool) {
+			return 0
+		}
+		if !v {
+			return -1
+		}
+		return 1
+	}
+	panic(fmt.Sprintf("unsupported type %T", v1))
+}
+
+func (e *queryExpr) matches(row any) bool {
+	switch e.op {
+	case "and":
+		return e.args[0].matches(row) && e.args[1].matches(row)
+	case "or":
+		return e.args[0].matches(row) || e.args[1].matches(row)
+	case "not":
+		return !e.args[0].matches(row)
+	}
+	vals := e.field.get(row)
+	if e.isEmpty {
+		return (len(vals) == 0) == (e.cmpOp == "=")
+	}
+	// "tag != work" means no tag is work, not that some tag isn't work
+	if e.cmpOp == "!=" {
+		for _, v := range vals {
+			if compareQueryValues(v, e.val) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range vals {
+		if e.cmpOp == "contains" {
+			if strings.Contains(strings.ToLower(v.(string)), e.val.(string)) {
+				return true
+			}
+			continue
+		}
+		if compareOp(compareQueryValues(v, e.val), e.cmpOp) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryData is a snapshot of index data that queries are evaluated over
+type queryData struct {
+	notes []*QueryNote
+	tasks []*Task
+}
+
+func (idx *userIndex) queryData() *queryData {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	res := &queryData{}
+	for _, note := range idx.notes.Notes {
+		c := *note
+		res.notes = append(res.notes, &QueryNote{
+			Note:      &c,
+			Tags:      idx.tags[note.ID],
+			Meta:      idx.meta[note.ID],
+			Encrypted: idx.encrypted[note.ID],
+		})
+		for _, t := range idx.tasks[note.ID] {
+			tc := *t
+			res.tasks = append(res.tasks, &tc)
+		}
+	}
+	return res
+}
+
+func (d *queryData) allTags() []*QueryTag {
+	counts := map[string]int{}
+	for _, n := range d.notes {
+		for _, tag := range n.Tags {
+			counts[tag]++
+		}
+	}
+	var res []*QueryTag
+	for name, n := range counts {
+		res = append(res, &QueryTag{Name: name, Count: n})
+	}
+	slices.SortFunc(res, func(t1, t2 *QueryTag) int {
+		return strings.Compare(t1.Name, t2.Name)
+	})
+	return res
+}
+
+// rows without a value for order by field are sorted last
+func (q *Query) sortRows(rows []any) {
+	slices.SortStableFunc(rows, func(r1, r2 any) int {
+		v1, v2 := q.orderBy.get(r1), q.orderBy.get(r2)
+		if len(v1) == 0 || len(v2) == 0 {
+			return cmp.Compare(len(v2), len(v1))
+		}
+		v := v2[0]
+		if s, ok := v.(string); ok {
+			v = strings.ToLower(s)
+		}
+		c := compareQueryValues(v1[0], v)
+		if q.desc {
+			return -c
+		}
+		return c
+	})
+}
+
+// Run returns matching rows: []*QueryNote, []*Task or []*QueryTag
+func (q *Query) Run(d *queryData) []any {
+	var rows []any
+	switch q.Source {
+	case "notes":
+		// most recently updated first, unless order by says otherwise
+		notes := slices.Clone(d.notes)
+		slices.SortStableFunc(notes, func(n1, n2 *QueryNote) int {
+			return cmp.Compare(n2.UpdatedAt, n1.UpdatedAt)
+		})
+		for _, n := range notes {
+			rows = append(rows, n)
+		}
+	case "tasks":
+		tasks := slices.Clone(d.tasks)
+		sortTasks(tasks)
+		for _, t := range tasks {
+			rows = append(rows, t)
+		}
+	case "tags":
+		for _, t := range d.allTags() {
+			rows = append(rows, t)
+		}
+	}
+
+	res := []any{}
+	for _, row := range rows {
+		if q.where == nil || q.where.matches(row) {
+			res = append(res, row)
+		}
+	}
+	if q.orderBy != nil {
+		q.sortRows(res)
+	}
+	if q.limit > 0 && len(res) > q.limit {
+		res = res[:q.limit]
+	}
+	return res
+}
+
+// /api/store/query?q=${query}, query can also be sent as POST body
+func handleQuery(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	if !checkScope(w, r, scopeRead) {
+		return
+	}
+	s := r.URL.Query().Get("q")
+	if s == "" && r.Method == http.MethodPost {
+		d, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if serveIfError(w, r, err) {
+			return
+		}
+		s = string(d)
+	}
+	if strings.TrimSpace(s) == "" {
+		serveError(w, r, "missing query", http.StatusBadRequest)
+		return
+	}
+	q, err := ParseQuery(s, time.Now())
+	if err != nil {
+		serveError(w, r, fmt.Sprintf("invalid query: %s", err), http.StatusBadRequest)
+		return
+	}
+	idx, err := getUserIndex(r.Context(), u)
+	if serveIfError(w, r, err) {
+		return
+	}
+	res := q.Run(idx.queryData())
+	logCtxf(r.Context(), "handleQuery: '%s' returned %d results\n", s, len(res))
+	v := map[string]any{
+		"source":  q.Source,
+		"results": res,
+	}
+	serveJSONOK(w, r, v)
+}
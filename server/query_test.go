@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kjk/common/assert"
+)
+
+func testQueryData(now time.Time) *queryData {
+	ms := func(d time.Duration) int64 {
+		return now.Add(d).UnixMilli()
+	}
+	day := 24 * time.Hour
+	return &queryData{
+		notes: []*QueryNote{
+			{Note: &Note{ID: "aaaaaa", Title: "Work log", Kind: "md", UpdatedAt: ms(-1 * day), Size: 100}, Tags: []string{"log", "work"}},
+			{Note: &Note{ID: "bbbbbb", Title: "Old work", Kind: "md", UpdatedAt: ms(-30 * day), Size: 20}, Tags: []string{"work"}},
+			{Note: &Note{ID: "cccccc", Title: "Recipes", Kind: "md", UpdatedAt: ms(-2 * day), Size: 300}, Meta: map[string]string{"status": "Draft"}},
+		},
+		tasks: []*Task{
+			{NoteID: "aaaaaa", Text: "call Bob", Due: now.Format("2006-01-02"), Priority: "high", Assignees: []string{"kjk"}},
+			{NoteID: "aaaaaa", Text: "write report", Due: now.AddDate(0, 0, 10).Format("2006-01-02")},
+			{NoteID: "cccccc", Text: "buy eggs", Done: true},
+		},
+	}
+}
+
+func queryIDs(t *testing.T, s string, d *queryData, now time.Time) []string {
+	q, err := ParseQuery(s, now)
+	assert.NoError(t, err)
+	var res []string
+	for _, row := range q.Run(d) {
+		switch v := row.(type) {
+		case *QueryNote:
+			res = append(res, v.ID)
+		case *Task:
+			res = append(res, v.Text)
+		case *QueryTag:
+			res = append(res, v.Name)
+		}
+	}
+	return res
+}
+
+func TestQuery(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	d := testQueryData(now)
+
+	tests := []struct {
+		q   string
+		exp []string
+	}{
+		{`query notes where tag = "work" and updated > -7d order by title limit 20`, []string{"aaaaaa"}},
+		{`notes where tag = work order by title`, []string{"bbbbbb", "aaaaaa"}},
+		{`notes`, []string{"aaaaaa", "cccccc", "bbbbbb"}},
+		{`notes where tag != work`, []string{"cccccc"}},
+		{`notes where tag = ""`, []string{"cccccc"}},
+		{`notes where meta.status = draft`, []string{"cccccc"}},
+		{`notes where title contains WORK or size >= 300 order by size desc limit 2`, []string{"cccccc", "aaaaaa"}},
+		{`notes where not (tag = log or tag = "")`, []string{"bbbbbb"}},
+		{`notes where updated < 2026-10-01`, []string{"bbbbbb"}},
+		{`tasks where not done and due <= today`, []string{"call Bob"}},
+		{`tasks where not done and due <= +2w`, []string{"call Bob", "write report"}},
+		{`tasks where done`, []string{"buy eggs"}},
+		{`tasks where assignee = kjk or priority = high`, []string{"call Bob"}},
+		{`tasks where due = ""`, []string{"buy eggs"}},
+		{`tags order by count desc`, []string{"work", "log"}},
+		{`tags where name = log`, []string{"log"}},
+	}
+	for _, tc := range tests {
+		got := queryIDs(t, tc.q, d, now)
+		assert.Equal(t, got, tc.exp, tc.q)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	now := time.Now()
+	invalid := []string{
+		``,
+		`files`,
+		`notes where`,
+		`notes where foo = 1`,
+		`notes where title`,
+		`notes where size = big`,
+		`notes where updated > yesterdayish`,
+		`notes where (tag = work`,
+		`notes where daily > true`,
+		`notes where size contains 3`,
+		`notes order title`,
+		`notes limit -1`,
+		`notes where title = "unterminated`,
+		`tags where name = x extra`,
+	}
+	for _, s := range invalid {
+		_, err := ParseQuery(s, now)
+		assert.Error(t, err, s)
+	}
+}
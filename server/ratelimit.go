@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// token bucket rate limiting. Each budget has a bucket per user (for logged in
+// requests) or per IP (for anonymous requests). A bucket holds up to burst
+// tokens and refills at perSec tokens per second. A request takes a token
+// and is rejected with 429 if there are none.
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	name   string
+	perSec float64
+	burst  float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// when we last removed idle buckets
+	lastPrune time.Time
+	// number of rejected requests, for metrics
+	rejected int64
+}
+
+const (
+	// when we have that many buckets, we remove full ones
+	maxRateLimitBuckets = 10000
+	// we also remove them periodically so that buckets of one-time
+	// visitors don't stay in memory forever
+	rateLimitPruneInterval = 10 * time.Minute
+)
+
+func newRateLimiter(name string, perSec float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		name:    name,
+		perSec:  perSec,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+var (
+	readLimiter  = newRateLimiter("read", 20, 200)
+	writeLimiter = newRateLimiter("write", 5, 100)
+	// password attempts and OAuth logins, per IP
+	loginLimiter = newRateLimiter("login", 1.0/6, 10)
+	// anonymous /event/ requests, per IP
+	eventLimiter = newRateLimiter("event", 1, 30)
+
+	rateLimiters = []*rateLimiter{readLimiter, writeLimiter, loginLimiter, eventLimiter}
+)
+
+// returns 0 if allowed or how long to wait until a token is available
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		l.removeFullBucketsLocked(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.removeFullBucketsLocked(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSec)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	l.rejected++
+	wait := (1 - b.tokens) / l.perSec
+	return time.Duration(wait * float64(time.Second))
+}
+
+// full buckets are the same as no bucket
+func (l *rateLimiter) removeFullBucketsLocked(now time.Time) {
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.perSec >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) rejectedCount() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rejected
+}
+
+// user id from cookie or api token, without side effects like
+// extending the session. "" if anonymous or the token is not valid
+// so that random tokens don't get a fresh bucket.
+func rateLimitUserKey(r *http.Request) string {
+	if t, hasToken := requestAPIToken(r); hasToken {
+		if t != nil {
+			return "user:" + t.UserID
+		}
+		return ""
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return ""
+	}
+	var v SecureCookieValue
+	err = securecookie.DecodeMulti(cookieName, cookie.Value, &v, cookieCodecs...)
+	if err != nil || v.UserID == "" {
+		return ""
+	}
+	return "user:" + v.UserID
+}
+
+func isLoginURL(r *http.Request) bool {
+	uri := r.URL.Path
+	if uri == "/auth/ghlogin" || uri == "/auth/githubcb" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(uri, "/auth/")
+	if !ok {
+		return false
+	}
+	_, action, _ := strings.Cut(rest, "/")
+	return action == "login" || action == "callback"
+}
+
+// returns limiter and bucket key for the request or nil if not rate limited
+func rateLimiterFor(r *http.Request) (*rateLimiter, string) {
+	uri := r.URL.Path
+	ipKey := "ip:" + requestIP(r)
+	if isLoginURL(r) {
+		return loginLimiter, ipKey
+	}
+	if strings.HasPrefix(uri, "/event/") {
+		return eventLimiter, ipKey
+	}
+	if !strings.HasPrefix(uri, "/api/") {
+		return nil, ""
+	}
+	key := rateLimitUserKey(r)
+	if key == "" {
+		key = ipKey
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return readLimiter, key
+	}
+	return writeLimiter, key
+}
+
+// returns false if request was rejected
+func checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	l, key := rateLimiterFor(r)
+	if l == nil {
+		return true
+	}
+	wait := l.take(key, time.Now())
+	if wait == 0 {
+		return true
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	logCtxWarnf(r.Context(), "checkRateLimit: rejected %s %s, budget: %s, key: %s, retry after %ds\n", r.Method, r.URL.Path, l.name, key, retryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	msg := fmt.Sprintf("too many requests, retry after %d seconds", retryAfter)
+	http.Error(w, msg, http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter("test", 2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, l.take("a", now), time.Duration(0))
+	}
+	wait := l.take("a", now)
+	assert.Equal(t, wait, 500*time.Millisecond)
+	// other keys have their own buckets
+	assert.Equal(t, l.take("b", now), time.Duration(0))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, l.take("a", now), time.Duration(0))
+	assert.True(t, l.take("a", now) > 0)
+	assert.Equal(t, l.rejectedCount(), int64(2))
+
+	// refills up to burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, l.take("a", now), time.Duration(0))
+	}
+	assert.True(t, l.take("a", now) > 0)
+}
+
+func TestRateLimiterPrunesIdleBuckets(t *testing.T) {
+	// refills one token per prune interval
+	l := newRateLimiter("test", 1/rateLimitPruneInterval.Seconds(), 2)
+	now := time.Now()
+	assert.Equal(t, l.take("a", now), time.Duration(0))
+	assert.Equal(t, l.take("b", now), time.Duration(0))
+	assert.Equal(t, l.take("b", now), time.Duration(0))
+	assert.Equal(t, len(l.buckets), 2)
+
+	// "a" is full again so it's removed, "b" is not
+	now = now.Add(rateLimitPruneInterval + time.Second)
+	assert.Equal(t, l.take("b", now), time.Duration(0))
+	assert.Equal(t, len(l.buckets), 1)
+	assert.True(t, l.take("b", now) > 0)
+}
+
+func TestRateLimiterFor(t *testing.T) {
+	r := httptest.NewRequest("POST", "/auth/local/login", nil)
+	l, key := rateLimiterFor(r)
+	assert.Equal(t, l, loginLimiter)
+	assert.Equal(t, key, "ip:192.0.2.1")
+
+	dataDir = t.TempDir()
+	defer func() {
+		dataDir = ""
+		apiTokens = nil
+		apiTokensLoaded = false
+	}()
+	token, _, err := createAPIToken("local-jo", "jo", "jo@example.com", "test", scopeRead)
+	assert.NoError(t, err)
+	r = httptest.NewRequest("GET", "/api/store/getLogs", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	l, key = rateLimiterFor(r)
+	assert.Equal(t, l, readLimiter)
+	assert.Equal(t, key, "user:local-jo")
+	// unknown tokens don't get their own bucket
+	r.Header.Set("Authorization", "Bearer nt_abc")
+	_, key = rateLimiterFor(r)
+	assert.Equal(t, key, "ip:192.0.2.1")
+
+	r = httptest.NewRequest("POST", "/api/store/appendLog", nil)
+	l, _ = rateLimiterFor(r)
+	assert.Equal(t, l, writeLimiter)
+
+	r = httptest.NewRequest("GET", "/event/foo", nil)
+	l, _ = rateLimiterFor(r)
+	assert.Equal(t, l, eventLimiter)
+
+	r = httptest.NewRequest("GET", "/n/abc", nil)
+	l, _ = rateLimiterFor(r)
+	assert.Nil(t, l)
+}
+
+func TestRequestIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	// not from a trusted proxy so X-Forwarded-For is ignored
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, requestIP(r), "203.0.113.5")
+
+	// caddy appends the client ip, earlier entries are from the client
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.5")
+	assert.Equal(t, requestIP(r), "203.0.113.5")
+	r.Header.Set("X-Forwarded-For", "203.0.113.5, 127.0.0.1")
+	assert.Equal(t, requestIP(r), "203.0.113.5")
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, requestIP(r), "127.0.0.1")
+
+	nets, err := parseIPNets("10.0.0.0/8, 192.168.1.1,::2")
+	assert.NoError(t, err)
+	assert.Equal(t, len(nets), 3)
+	_, err = parseIPNets("foo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// point-in-time restore of all notes of a user:
+// /api/store/restore?at=${time}&preview=1
+//
+// We re-play the log up to at to get notes as they were at that time and
+// append log entries that change current notes to that state. Nothing
+// is deleted so the restore itself can be undone by restoring to the time
+// right before it. at is when entries were written to the store, not timestamps
+// in log entries, because imported entries have timestamps from the past.
+// at is unix milliseconds or RFC3339.
+
+// RestoreChange describes a log entry that restore appends
+type RestoreChange struct {
+	// "delete", "create", "title", "kind" or "content"
+	Op     string `json:"op"`
+	NoteID string `json:"note_id"`
+	Title  string `json:"title"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+
+	// nil for content change to empty content
+	entry []any
+}
+
+// notes as they were at a given time (unix milliseconds)
+func storeNotesAt(ctx context.Context, u *UserInfo, atMs int64) (*Notes, *Notes, error) {
+	var past, curr [][]any
+	for _, rec := range u.Store.Records() {
+		if rec.Kind != "log" {
+			continue
+		}
+		d, err := storeReadRecord(u, rec)
+		if err != nil {
+			return nil, nil, err
+		}
+		var e []any
+		err = json.Unmarshal(d, &e)
+		if err != nil {
+			logCtxErrorf(ctx, "storeNotesAt: skipping invalid log entry at offset %d: %s\n", rec.Offset, err)
+			continue
+		}
+		curr = append(curr, e)
+		if rec.TimestampMs <= atMs {
+			past = append(past, e)
+		}
+	}
+	return notesFromLogs(past), notesFromLogs(curr), nil
+}
+
+func contentChange(p *Note, from string) *RestoreChange {
+	c := &RestoreChange{
+		Op:     "content",
+		NoteID: p.ID,
+		Title:  p.Title,
+		From:   from,
+		To:     p.ContentID,
+	}
+	if p.ContentID != "" {
+		c.entry = mkLogChangeContent(p.ID, p.ContentID, int(p.Size))
+	}
+	return c
+}
+
+// changes that turn curr into past
+func restoreChanges(past *Notes, curr *Notes) []*RestoreChange {
+	res := []*RestoreChange{}
+	for _, n := range curr.Notes {
+		if past.Get(n.ID) == nil {
+			res = append(res, &RestoreChange{
+				Op:     "delete",
+				NoteID: n.ID,
+				Title:  n.Title,
+				entry:  mkLogDeleteNote(n.ID),
+			})
+		}
+	}
+	for _, p := range past.Notes {
+		n := curr.Get(p.ID)
+		if n == nil {
+			e := mkLogCreateNote(p.ID, p.Title, p.Kind, p.IsDaily)
+			e[1] = p.CreatedAt
+			res = append(res, &RestoreChange{
+				Op:     "create",
+				NoteID: p.ID,
+				Title:  p.Title,
+				entry:  e,
+			})
+			if p.ContentID != "" {
+				res = append(res, contentChange(p, ""))
+			}
+			continue
+		}
+		if n.Title != p.Title {
+			res = append(res, &RestoreChange{
+				Op:     "title",
+				NoteID: p.ID,
+				Title:  p.Title,
+				From:   n.Title,
+				To:     p.Title,
+				entry:  mkLogChangeTitle(p.ID, p.Title),
+			})
+		}
+		if n.Kind != p.Kind {
+			res = append(res, &RestoreChange{
+				Op:     "kind",
+				NoteID: p.ID,
+				Title:  p.Title,
+				From:   n.Kind,
+				To:     p.Kind,
+				entry:  mkLogChangeKind(p.ID, p.Kind),
+			})
+		}
+		if n.ContentID != p.ContentID {
+			res = append(res, contentChange(p, n.ContentID))
+		}
+	}
+	return res
+}
+
+func storeApplyRestore(ctx context.Context, u *UserInfo, changes []*RestoreChange) error {
+	for _, c := range changes {
+		var err error
+		if c.entry == nil {
+			err = storeAddNoteVersion(ctx, u, c.NoteID, nil, 0, false)
+		} else {
+			err = storeAppendLog(ctx, u, c.entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRestoreTime(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', must be unix milliseconds or RFC3339", s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// /api/store/restore?at=${time}&preview=1
+func handleRestore(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	preview := r.FormValue("preview") == "1"
+	if preview {
+		if !checkScope(w, r, scopeRead) {
+			return
+		}
+	} else if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeWrite) {
+		return
+	}
+	atMs, err := parseRestoreTime(r.FormValue("at"))
+	if err != nil {
+		serveError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if atMs > nowMs() {
+		serveError(w, r, "at must not be in the future", http.StatusBadRequest)
+		return
+	}
+
+	u.editMu.Lock()
+	defer u.editMu.Unlock()
+
+	past, curr, err := storeNotesAt(r.Context(), u, atMs)
+	if serveIfError(w, r, err) {
+		return
+	}
+	changes := restoreChanges(past, curr)
+	if !preview {
+		logCtxf(r.Context(), "handleRestore: user '%s', at: %d, %d changes\n", u.ID, atMs, len(changes))
+		err = storeApplyRestore(r.Context(), u, changes)
+		if serveIfError(w, r, err) {
+			return
+		}
+	}
+	res := map[string]any{
+		"at":          atMs,
+		"preview":     preview,
+		"notes_count": len(past.Notes),
+		"changes":     changes,
+	}
+	serveJSONOK(w, r, res)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func TestRestore(t *testing.T) {
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer u.Store.CloseFiles()
+
+	addLog := func(ts int64, e []any) {
+		d, err := json.Marshal(e)
+		assert.NoError(t, err)
+		assert.NoError(t, u.Store.AppendRecordWithTimestamp("log", "", d, ts))
+	}
+	addContent := func(ts int64, noteID, contentID string, s string) {
+		assert.NoError(t, u.Store.AppendRecordWithTimestamp("content", contentID, []byte(s), ts))
+		addLog(ts, mkLogChangeContent(noteID, contentID, len(s)))
+	}
+	addLog(1000, mkLogCreateNote("n1", "first", "md", false))
+	addContent(1000, "n1", "n1-c1", "hello")
+	e := mkLogCreateNote("n2", "second", "md", false)
+	e[1] = 900
+	addLog(1000, e)
+	// invalid entries, appended before we validated log entries, are skipped
+	assert.NoError(t, u.Store.AppendRecordWithTimestamp("log", "", []byte(`[42,1000,"n1"]`), 1000))
+	assert.NoError(t, u.Store.AppendRecordWithTimestamp("log", "", []byte(`not json`), 1000))
+	// bad bulk import with timestamps from the past
+	addLog(2000, mkLogChangeTitle("n1", "renamed"))
+	addLog(2000, mkLogChangeKind("n1", "txt"))
+	addContent(2000, "n1", "n1-c2", "bye")
+	addLog(2000, mkLogDeleteNote("n2"))
+	addLog(2000, mkLogCreateNote("n3", "imported", "md", false))
+	e = mkLogCreateNote("n4", "imported old", "md", false)
+	e[1] = 500
+	addLog(2000, e)
+	addLog(2000, mkLogCreateNote("n5", "empty", "md", false))
+	addContent(2000, "n5", "n5-c1", "text")
+
+	past, curr, err := storeNotesAt(ctx(), u, 1500)
+	assert.NoError(t, err)
+	assert.Equal(t, len(past.Notes), 2)
+	changes := restoreChanges(past, curr)
+	var ops []string
+	for _, c := range changes {
+		ops = append(ops, c.Op+" "+c.NoteID)
+	}
+	assert.Equal(t, ops, []string{"delete n3", "delete n4", "delete n5", "title n1", "kind n1", "content n1", "create n2"})
+
+	// preview doesn't change anything
+	nRecords := len(u.Store.Records())
+	r := httptest.NewRequest("GET", "/api/store/restore?at=1500&preview=1", nil)
+	w := httptest.NewRecorder()
+	handleRestore(w, r, u)
+	assert.Equal(t, w.Code, 200)
+	var res struct {
+		Changes []*RestoreChange `json:"changes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, len(res.Changes), 7)
+	assert.Equal(t, len(u.Store.Records()), nRecords)
+
+	r = httptest.NewRequest("POST", "/api/store/restore?at=1500", nil)
+	w = httptest.NewRecorder()
+	handleRestore(w, r, u)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, len(u.Store.Records()), nRecords+7)
+
+	_, curr, err = storeNotesAt(ctx(), u, nowMs())
+	assert.NoError(t, err)
+	assert.Equal(t, len(restoreChanges(past, curr)), 0)
+	n1 := curr.Get("n1")
+	assert.Equal(t, n1.Title, "first")
+	assert.Equal(t, n1.Kind, "md")
+	assert.Equal(t, n1.ContentID, "n1-c1")
+	// re-created note keeps its original creation time
+	assert.Equal(t, curr.Get("n2").CreatedAt, int64(900))
+
+	// restoring to before the restore undoes it, n5 gets its content back
+	past, curr, err = storeNotesAt(ctx(), u, 2000)
+	assert.NoError(t, err)
+	assert.Equal(t, len(restoreChanges(past, curr)), 8)
+
+	for _, uri := range []string{"/api/store/restore?at=foo", "/api/store/restore?at=99999999999999"} {
+		w = httptest.NewRecorder()
+		handleRestore(w, httptest.NewRequest("POST", uri, nil), u)
+		assert.Equal(t, w.Code, 400)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3-compatible storage (Digital Ocean Spaces, Cloudflare R2, MinIO)
+// used for http logs (see loghttp.go) and backups (see backup.go)
+
+const defaultS3Endpoint = "nyc3.digitaloceanspaces.com"
+
+type s3Config struct {
+	// host or http://host:port for local server without TLS
+	Endpoint string
+	Bucket   string
+	Region   string
+	Access   string
+	Secret   string
+}
+
+// returns client and endpoint host
+func newS3Client(c *s3Config) (*minio.Client, string, error) {
+	endpoint := c.Endpoint
+	secure := true
+	if rest, ok := strings.CutPrefix(endpoint, "http://"); ok {
+		endpoint, secure = rest, false
+	}
+	endpoint = strings.TrimPrefix(endpoint, "https://")
+	mc, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.Access, c.Secret, ""),
+		Secure: secure,
+		Region: c.Region,
+	})
+	return mc, endpoint, err
+}
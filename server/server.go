@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io/fs"
 	"net/http"
@@ -12,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"slices"
 	"strings"
 	"syscall"
@@ -20,29 +20,58 @@ import (
 	"github.com/felixge/httpsnoop"
 	"github.com/gorilla/securecookie"
 	hutil "github.com/kjk/common/httputil"
-	"github.com/sanity-io/litter"
 
 	"github.com/kjk/common/u"
 )
 
 var (
-	cookieName   = "nckie" // noted cookie
-	secureCookie *securecookie.SecureCookie
-
-	cookieAuthKeyHexStr = "81615f1aed7f857b4cb9c539acb5f9b5a88c9d6c4e87a4141079490773d17f5b"
-	cookieEncrKeyHexStr = "00db6337a267be94a44813335bf3bd9e35868875b896fbe3758e613fbb8ec8d4"
+	cookieName = "nckie" // noted cookie
+	// first is used to encode, all are tried when decoding
+	cookieCodecs []securecookie.Codec
+	// alternating auth and encryption keys, from COOKIE_KEYS secret
+	cookieKeyPairs [][]byte
 
 	proxyURLStr = "http://localhost:3047"
-	// maps ouath secret to login info
-	loginsInProress = map[string]string{}
 )
 
+// COOKIE_KEYS is "${authKeyHex}:${encrKeyHex},..." with auth key of 32 or 64 bytes
+// and encryption key of 32 bytes. The first pair is current. To rotate,
+// put a new pair first and remove the old pair after sessions expire.
+func parseCookieKeys(s string) ([][]byte, error) {
+	var res [][]byte
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		authHex, encrHex, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid cookie key pair, expected ${authKeyHex}:${encrKeyHex}")
+		}
+		authKey, err := hex.DecodeString(authHex)
+		if err != nil || (len(authKey) != 32 && len(authKey) != 64) {
+			return nil, fmt.Errorf("cookie auth key must be 32 or 64 bytes in hex")
+		}
+		encrKey, err := hex.DecodeString(encrHex)
+		if err != nil || len(encrKey) != 32 {
+			return nil, fmt.Errorf("cookie encryption key must be 32 bytes in hex")
+		}
+		res = append(res, authKey, encrKey)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no cookie keys")
+	}
+	return res, nil
+}
+
 func makeSecureCookie() {
-	cookieAuthKey, err := hex.DecodeString(cookieAuthKeyHexStr)
-	panicIfErr(err)
-	cookieEncrKey, err := hex.DecodeString(cookieEncrKeyHexStr)
-	panicIfErr(err)
-	secureCookie = securecookie.New(cookieAuthKey, cookieEncrKey)
+	keyPairs := cookieKeyPairs
+	if len(keyPairs) == 0 {
+		// validateSecrets() ensures we have keys in production
+		logWarnf("makeSecureCookie: no COOKIE_KEYS, using ephemeral keys, logins won't survive restart\n")
+		keyPairs = [][]byte{securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)}
+	}
+	cookieCodecs = securecookie.CodecsFromPairs(keyPairs...)
 }
 
 func getGitHubSecrets() (string, string) {
@@ -53,41 +82,52 @@ func getGitHubSecrets() (string, string) {
 }
 
 type SecureCookieValue struct {
+	SessionID string // see sessions.go
+	UserID    string // "github-1234", see users.go
 	User      string // "kjk"
 	Email     string // "kkowalczyk@gmail.com"
 	Name      string // Krzysztof Kowalczyk
 	AvatarURL string
 }
 
-func setSecureCookie(w http.ResponseWriter, c *SecureCookieValue) {
-	panicIf(c.User == "", "setSecureCookie: empty user")
-	panicIf(c.Email == "", "setSecureCookie: empty email")
+func setSecureCookie(w http.ResponseWriter, c *SecureCookieValue) error {
+	if c.User == "" || c.Email == "" {
+		return fmt.Errorf("setSecureCookie: empty user ('%s') or email ('%s')", c.User, c.Email)
+	}
 
 	logf("setSecureCookie: user: '%s', email: '%s'\n", c.User, c.Email)
-	if encoded, err := secureCookie.Encode(cookieName, c); err == nil {
-		// TODO: set expiration (Expires    time.Time) long time in the future?
-		cookie := &http.Cookie{
-			Name:  cookieName,
-			Value: encoded,
-			Path:  "/",
-		}
-		http.SetCookie(w, cookie)
-	} else {
-		panicIfErr(err)
+	encoded, err := securecookie.EncodeMulti(cookieName, c, cookieCodecs...)
+	if err != nil {
+		return err
+	}
+	// expires together with the session, re-set in handleAuthUser
+	// so that it slides like the session
+	cookie := &http.Cookie{
+		Name:     cookieName,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   int(sessionIdleTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   !isDev(),
+		// Lax and not Strict so that the cookie is sent when following
+		// a link to a note from another site
+		SameSite: http.SameSiteLaxMode,
 	}
+	http.SetCookie(w, cookie)
+	return nil
 }
 
-// TODO: make it even longer?
-const MonthInSeconds = 60 * 60 * 24 * 31
-
 // to delete the cookie value (e.g. for logging out), we need to set an
 // invalid value
 func deleteSecureCookie(w http.ResponseWriter) {
 	cookie := &http.Cookie{
-		Name:   cookieName,
-		Value:  "deleted",
-		MaxAge: MonthInSeconds,
-		Path:   "/",
+		Name:     cookieName,
+		Value:    "deleted",
+		MaxAge:   -1,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !isDev(),
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, cookie)
 }
@@ -102,15 +142,22 @@ func getSecureCookie(r *http.Request) *SecureCookieValue {
 	if cookie.Value == "deleted" {
 		return nil
 	}
-	err = secureCookie.Decode(cookieName, cookie.Value, &ret)
+	err = securecookie.DecodeMulti(cookieName, cookie.Value, &ret, cookieCodecs...)
 	if err != nil {
 		// most likely expired cookie, so ignore. Ideally should delete the
 		// cookie, but that requires access to http.ResponseWriter, so not
 		// convenient for us
 		return nil
 	}
-	panicIf(ret.User == "", "getSecureCookie: empty user")
-	panicIf(ret.Email == "", "getSecureCookie: empty email")
+	if ret.User == "" || ret.Email == "" {
+		logErrorf("getSecureCookie: empty user ('%s') or email ('%s')\n", ret.User, ret.Email)
+		return nil
+	}
+	// cookies issued before we had sessions can't be revoked so we
+	// don't accept them and the user has to log in again
+	if touchSession(ret.SessionID, ret.UserID) == nil {
+		return nil
+	}
 	return &ret
 }
 
@@ -118,7 +165,7 @@ var (
 	pongTxt = []byte("pong")
 )
 
-func logLogin(ctx context.Context, r *http.Request, user *GitHubUser) {
+func logLogin(ctx context.Context, r *http.Request, user *AuthIdentity) {
 	if user == nil || isDev() {
 		return
 	}
@@ -132,59 +179,32 @@ func httpScheme(r *http.Request) string {
 	return "https://"
 }
 
-// /auth/ghlogin
-func handleLoginGitHub(w http.ResponseWriter, r *http.Request) {
-	redirectURL := strings.TrimSpace(r.FormValue("redirect"))
-	if redirectURL == "" {
-		redirectURL = "/"
-	}
-	logf("handleLoginGitHub: '%s', redirect: '%s'\n", r.RequestURI, redirectURL)
-	clientID, _ := getGitHubSecrets()
-
-	// secret value passed to auth server and then back to us
-	state := genRandomID(8)
-	muStore.Lock()
-	loginsInProress[state] = redirectURL
-	muStore.Unlock()
-
-	cb := httpScheme(r) + r.Host + "/auth/githubcb"
-	logf("handleLogin: cb='%s'\n", cb)
-
-	vals := url.Values{}
-	vals.Add("client_id", clientID)
-	vals.Add("scope", "read:user")
-	vals.Add("state", state)
-	vals.Add("redirect_uri", cb)
-
-	authURL := "https://github.com/login/oauth/authorize?" + vals.Encode()
-	logf("handleLogin: doing auth 302 redirect to '%s'\n", authURL)
-	http.Redirect(w, r, authURL, http.StatusFound) // 302
-}
-
 // use if fn() needs to modify users slice under lock
-func doUserOpByEmail(email string, fn func(*UserInfo, int) error) error {
+func doUserOpByID(id string, fn func(*UserInfo, int) error) error {
 	muStore.Lock()
 	defer muStore.Unlock()
 
 	for i, u := range users {
-		if u.Email == email {
+		if u.ID == id {
 			return fn(u, i)
 		}
 	}
 	return fn(nil, -1)
 }
 
-// /auth/ghlogout
-func handleLogoutGitHub(w http.ResponseWriter, r *http.Request) {
-	logf("handleLogoutGitHub()\n")
+// /auth/logout, /auth/ghlogout
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	logCtxf(r.Context(), "handleLogout()\n")
 	cookie := getSecureCookie(r)
 	if cookie == nil {
-		logf("handleLogoutGitHub: already logged out\n")
+		logCtxf(r.Context(), "handleLogout: already logged out\n")
 		http.Redirect(w, r, "/", http.StatusFound) // 302
 		return
 	}
-	email := cookie.Email
+	userID := cookie.UserID
 	deleteSecureCookie(w)
+	err := revokeSession(userID, cookie.SessionID)
+	logIfErrf(ctx(), err)
 
 	removeUserFn := func(u *UserInfo, i int) error {
 		if i >= 0 {
@@ -192,108 +212,45 @@ func handleLogoutGitHub(w http.ResponseWriter, r *http.Request) {
 		}
 		return nil
 	}
-	doUserOpByEmail(email, removeUserFn)
+	if userID != "" {
+		doUserOpByID(userID, removeUserFn)
+	}
 	http.Redirect(w, r, "/", http.StatusFound) // 302
 }
 
 const errorURL = "/github_login_failed"
 
+// GithubLoginFailed.svelte shows the reason from err arg
+func redirectLoginFailed(w http.ResponseWriter, r *http.Request, reason string) {
+	logCtxWarnf(r.Context(), "login failed: %s\n", reason)
+	uri := errorURL + "?err=" + url.QueryEscape(reason)
+	// not 307 because password login is a POST
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
 // /auth/user
 // returns JSON with user info in the body
 func handleAuthUser(w http.ResponseWriter, r *http.Request) {
-	logf("handleAuthUser: '%s'\n", r.URL)
+	logCtxDebugf(r.Context(), "handleAuthUser: '%s'\n", r.URL)
 	v := map[string]any{}
 	cookie := getSecureCookie(r)
 	if cookie == nil {
 		v["error"] = "not logged in"
-		logf("handleAuthUser: not logged in\n")
+		logCtxDebugf(r.Context(), "handleAuthUser: not logged in\n")
 	} else {
+		setRequestLogUser(r.Context(), cookie.UserID)
 		v["user"] = cookie.User
 		v["login"] = cookie.User
 		v["email"] = cookie.Email
 		v["avatar_url"] = cookie.AvatarURL
-		logf("handleAuthUser: logged in as '%s', '%s'\n", cookie.User, cookie.Email)
+		logCtxDebugf(r.Context(), "handleAuthUser: logged in as '%s', '%s'\n", cookie.User, cookie.Email)
+		// called when the app loads, extends cookie expiration
+		err := setSecureCookie(w, cookie)
+		logIfErrf(r.Context(), err)
 	}
 	serveJSONOK(w, r, v)
 }
 
-// /auth/githubcb
-// as set in:
-// https://github.com/settings/applications/2175661
-// https://github.com/settings/applications/2175803
-func handleGithubCallback(w http.ResponseWriter, r *http.Request) {
-	logf("handleGithubCallback: '%s'\n", r.URL)
-	state := r.FormValue("state")
-	redirectURL := loginsInProress[state]
-	if redirectURL == "" {
-		logErrorf("invalid oauth state, no redirect for state '%s'\n", state)
-		uri := "/github_login_failed?err=" + url.QueryEscape("invalid oauth state")
-		http.Redirect(w, r, uri, http.StatusTemporaryRedirect)
-		return
-	}
-
-	// https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/authorizing-oauth-apps#2-users-are-redirected-back-to-your-site-by-github
-	code := r.FormValue("code")
-	vals := url.Values{}
-	clientId, clientSecret := getGitHubSecrets()
-	vals.Add("client_id", clientId)
-	vals.Add("client_secret", clientSecret)
-	vals.Add("code", code)
-	// redirectURL := httpScheme(r) + r.Host + "/oauthgithubcb2"
-	// vals.Add("redirect_uri", redirectURL)
-	uri := "https://github.com/login/oauth/access_token?" + vals.Encode()
-	hdrs := map[string]string{
-		"Accept": "application/json",
-	}
-	resp, err := postWithHeaders(uri, hdrs)
-	if err != nil {
-		logf("http.Post() failed with '%s'\n", err)
-		// logForm(r)
-		http.Redirect(w, r, errorURL+"?error="+url.QueryEscape(err.Error()), http.StatusTemporaryRedirect)
-		return
-	}
-	var m map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&m)
-	if err != nil {
-		logf("json.NewDecoder() failed with '%s'\n", err)
-		// logForm(r)
-		http.Redirect(w, r, errorURL+"?error="+url.QueryEscape(err.Error()), http.StatusTemporaryRedirect)
-	}
-
-	errorStr := mapStr(m, "error")
-	if errorStr != "" {
-		http.Redirect(w, r, errorURL+"?error="+url.QueryEscape(errorStr), http.StatusTemporaryRedirect)
-		return
-	}
-
-	access_token := mapStr(m, "access_token")
-	token_type := mapStr(m, "token_type")
-	scope := mapStr(m, "scope")
-
-	logf("access_token: %s, token_type: %s, scope: %s\n", access_token, token_type, scope)
-
-	_, i, err := getGitHubUserInfo(access_token)
-	if err != nil {
-		logf("getGitHubUserInfo() failed with '%s'\n", err)
-		http.Redirect(w, r, errorURL+"?error="+url.QueryEscape(err.Error()), http.StatusTemporaryRedirect)
-		return
-	}
-	litter.Dump(i)
-	cookie := &SecureCookieValue{}
-	cookie.User = i.Login
-	cookie.Email = i.Email
-	cookie.Name = i.Name
-	cookie.AvatarURL = i.AvatarURL
-	litter.Dump(cookie)
-	logf("github user: '%s', email: '%s'\n", cookie.User, cookie.Email)
-	setSecureCookie(w, cookie)
-	logf("handleOauthGitHubCallback: redirect: '%s'\n", redirectURL)
-	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
-
-	// can't put in the background because that cancels ctx
-	logLogin(ctx(), r, i)
-}
-
 func mapStr(m map[string]any, key string) string {
 	if v, ok := m[key]; ok {
 		if s, ok := v.(string); ok {
@@ -321,54 +278,14 @@ func read404(fsys fs.FS) []byte {
 	return d
 }
 
-// log event
-// /event/${name}
-// body is JSON with metadata for POST / PUT or ?foo=bar keys
-// if duration is included, it's dur field in metadata
-func handleEvent(w http.ResponseWriter, r *http.Request) {
-	uri := r.URL.Path
-	name := strings.TrimPrefix(uri, "/event/")
-	if name == "" {
-		logErrorf("/event/ has no name\n")
-		http.NotFound(w, r)
-		return
-	}
-
-	//durMs := 0
-	meta := map[string]string{}
-	logKV := func(k, v string) {
-		if k == "dur" {
-			//durMs, _ = strconv.Atoi(v)
-			return
-		}
-		if v != "" {
-			meta[k] = v
-		}
-	}
+var rxRequestID = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
 
-	if r.Method == http.MethodPost || r.Method == http.MethodPut {
-		var m map[string]any
-		dec := json.NewDecoder(r.Body)
-		err := dec.Decode(&meta)
-		if err != nil {
-			// ignore but log
-			logErrorf("dec.Decode() failed with '%s'\n", err)
-		} else {
-			for k, v := range m {
-				vs := fmt.Sprintf("%s", v)
-				logKV(k, vs)
-			}
-		}
-	}
-	vals := r.Form
-	for k := range vals {
-		v := vals.Get(k)
-		logKV(k, v)
+// use X-Request-ID set by reverse proxy or client, if valid
+func getRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); rxRequestID.MatchString(id) {
+		return id
 	}
-
-	// TODO: send event
-	content := bytes.NewReader([]byte("ok"))
-	http.ServeContent(w, r, "foo.txt", time.Time{}, content)
+	return genRandomID(12)
 }
 
 // in dev, proxyHandler redirects assets to vite web server
@@ -387,23 +304,37 @@ func makeHTTPServer(proxyHandler *httputil.ReverseProxy, fsys fs.FS) *http.Serve
 		}
 		uri := r.URL.Path
 
+		if !checkRateLimit(w, r) {
+			return
+		}
+
 		switch uri {
 		case "/ping", "/ping.txt":
 			content := bytes.NewReader(pongTxt)
 			http.ServeContent(w, r, "foo.txt", time.Time{}, content)
 			return
 		case "/auth/ghlogin":
-			handleLoginGitHub(w, r)
+			handleAuthLogin(w, r, &githubAuthProvider{})
 			return
-		case "/auth/ghlogout":
-			handleLogoutGitHub(w, r)
+		case "/auth/logout", "/auth/ghlogout":
+			handleLogout(w, r)
 			return
 		case "/auth/githubcb":
-			handleGithubCallback(w, r)
+			handleAuthCallback(w, r, &githubAuthProvider{})
 			return
 		case "/auth/user":
 			handleAuthUser(w, r)
 			return
+		case "/auth/providers":
+			handleAuthProviders(w, r)
+			return
+		case "/metrics":
+			handleMetrics(w, r)
+			return
+		}
+
+		if handleAuthProviderURL(w, r) {
+			return
 		}
 
 		if strings.HasPrefix(uri, "/event/") {
@@ -416,6 +347,16 @@ func makeHTTPServer(proxyHandler *httputil.ReverseProxy, fsys fs.FS) *http.Serve
 			return
 		}
 
+		if uri == "/api/sessions" || strings.HasPrefix(uri, "/api/sessions/") {
+			handleSessions(w, r)
+			return
+		}
+
+		if strings.HasPrefix(uri, "/api/admin/") {
+			handleAdmin(w, r)
+			return
+		}
+
 		if tryServeRedirect(uri) {
 			return
 		}
@@ -466,14 +407,20 @@ func makeHTTPServer(proxyHandler *httputil.ReverseProxy, fsys fs.FS) *http.Serve
 	}
 
 	handlerWithMetrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := getRequestID(r)
+		w.Header().Set("X-Request-ID", requestID)
+		r = withRequestLog(r, requestID)
+		r = withAPIToken(r)
+
 		m := httpsnoop.CaptureMetrics(http.HandlerFunc(mainHandler), w, r)
 		defer func() {
 			if p := recover(); p != nil {
-				logf("handlerWithMetrics: panicked with with %v\n", p)
+				logCtxErrorf(r.Context(), "handlerWithMetrics: panicked with with %v\n", p)
 				errStr := fmt.Sprintf("Error: %v", p)
-				serveError(w, errStr, http.StatusInternalServerError)
+				serveError(w, r, errStr, http.StatusInternalServerError)
 				return
 			}
+			recordHTTPMetrics(r, m.Code, m.Written, m.Duration)
 			if isDev() {
 				return
 			}
@@ -512,6 +459,11 @@ func runServerProd() {
 	}
 
 	httpSrv := makeHTTPServer(nil, fsys)
+	migrateLegacyUserDirs()
+	closeHTTPLog := OpenHTTPLog()
+	defer closeHTTPLog()
+	startBackups()
+
 	logf("runServerProd(): starting on 'http://%s', dev: %v\n", httpSrv.Addr, isDev())
 	waitFn := serverListenAndWait(httpSrv)
 	if isWinOrMac() {
@@ -535,9 +487,10 @@ func runServerDev() {
 
 	fsys := os.DirFS(frontEndBuildDir)
 	httpSrv := makeHTTPServer(proxyHandler, fsys)
+	migrateLegacyUserDirs()
 
-	//closeHTTPLog := OpenHTTPLog("noted")
-	//defer closeHTTPLog()
+	closeHTTPLog := OpenHTTPLog()
+	defer closeHTTPLog()
 
 	logf("runServerDev(): starting on '%s', dev: %v\n", httpSrv.Addr, isDev())
 	waitFn := serverListenAndWait(httpSrv)
@@ -579,5 +532,6 @@ func serverListenAndWait(httpSrv *http.Server) func() {
 			// timeout
 			logf("timed out trying to shut down http server")
 		}
+		closeEventLog()
 	}
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a session is created when user logs in and its id is stored in the cookie.
+// Sessions are in data/sessions.json so that we can list them and log out
+// a device (e.g. a lost laptop) by revoking its session.
+// Session expires if not used for sessionIdleTimeout.
+
+const (
+	sessionIdleTimeout = 30 * 24 * time.Hour
+	// how often we persist LastSeenAt changes
+	sessionSaveInterval = time.Minute
+)
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+var (
+	sessions       []*Session
+	sessionsLoaded bool
+	// when we last persisted LastSeenAt changes
+	sessionsSavedAt time.Time
+
+	muSessions sync.Mutex
+)
+
+func sessionsFilePath() string {
+	return filepath.Join(getDataDirMust(), "sessions.json")
+}
+
+func loadSessionsLocked() {
+	if sessionsLoaded {
+		return
+	}
+	sessionsLoaded = true
+	path := sessionsFilePath()
+	err := readJSONFile(path, &sessions)
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf("loadSessionsLocked: readJSONFile('%s') failed with '%s'\n", path, err)
+	}
+	logf("loaded %d sessions\n", len(sessions))
+}
+
+func saveSessionsLocked() error {
+	now := time.Now()
+	sessions = slices.DeleteFunc(sessions, func(s *Session) bool {
+		return now.After(s.ExpiresAt)
+	})
+	sessionsSavedAt = now
+	return writeJSONFileAtomic(sessionsFilePath(), sessions)
+}
+
+// in production we're behind caddy on the same machine. Additional proxies
+// can be added with TRUSTED_PROXIES secret (comma-separated ips or cidrs)
+var trustedProxies = mustParseIPNets("127.0.0.0/8,::1/128")
+
+func parseIPNets(s string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip or cidr '%s'", part)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func mustParseIPNets(s string) []*net.IPNet {
+	res, err := parseIPNets(s)
+	must(err)
+	return res
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// X-Forwarded-For is only used if the request comes from a trusted proxy.
+// Clients can send any X-Forwarded-For so we take the right-most ip that
+// is not a trusted proxy i.e. the one added by our proxy
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	var hops []string
+	for _, s := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(s, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func createSession(userID string, r *http.Request) (*Session, error) {
+	now := time.Now().UTC()
+	s := &Session{
+		ID:         genSecureRandomHex(16),
+		UserID:     userID,
+		UserAgent:  r.UserAgent(),
+		IP:         requestIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionIdleTimeout),
+	}
+
+	muSessions.Lock()
+	defer muSessions.Unlock()
+	loadSessionsLocked()
+	sessions = append(sessions, s)
+	err := saveSessionsLocked()
+	if err != nil {
+		sessions = sessions[:len(sessions)-1]
+		return nil, err
+	}
+	logf("createSession: created session for '%s'\n", userID)
+	c := *s
+	return &c, nil
+}
+
+// returns nil if session doesn't exist or has expired. Extends the session.
+func touchSession(id string, userID string) *Session {
+	if id == "" {
+		return nil
+	}
+	muSessions.Lock()
+	defer muSessions.Unlock()
+	loadSessionsLocked()
+
+	for _, s := range sessions {
+		if s.ID != id {
+			continue
+		}
+		now := time.Now().UTC()
+		if s.UserID != userID || now.After(s.ExpiresAt) {
+			return nil
+		}
+		s.LastSeenAt = now
+		s.ExpiresAt = now.Add(sessionIdleTimeout)
+		// don't re-write the file on every request
+		if time.Since(sessionsSavedAt) > sessionSaveInterval {
+			err := saveSessionsLocked()
+			logIfErrf(ctx(), err)
+		}
+		c := *s
+		return &c
+	}
+	return nil
+}
+
+// returns copies of non-expired sessions of a given user, most recently used first
+func listSessions(userID string) []*Session {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+	loadSessionsLocked()
+
+	now := time.Now()
+	res := []*Session{}
+	for _, s := range sessions {
+		if s.UserID != userID || now.After(s.ExpiresAt) {
+			continue
+		}
+		c := *s
+		res = append(res, &c)
+	}
+	slices.SortFunc(res, func(a, b *Session) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+	return res
+}
+
+// maps user id to when we last saw any of user's sessions
+func sessionsLastSeen() map[string]time.Time {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+	loadSessionsLocked()
+
+	res := map[string]time.Time{}
+	for _, s := range sessions {
+		if s.LastSeenAt.After(res[s.UserID]) {
+			res[s.UserID] = s.LastSeenAt
+		}
+	}
+	return res
+}
+
+// revokes sessions of a user for which shouldRevoke returns true
+// returns number of revoked sessions
+func revokeSessions(userID string, shouldRevoke func(*Session) bool) (int, error) {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+	loadSessionsLocked()
+
+	n := len(sessions)
+	sessions = slices.DeleteFunc(sessions, func(s *Session) bool {
+		return s.UserID == userID && shouldRevoke(s)
+	})
+	n -= len(sessions)
+	if n == 0 {
+		return 0, nil
+	}
+	logf("revokeSessions: revoked %d sessions of '%s'\n", n, userID)
+	return n, saveSessionsLocked()
+}
+
+func revokeSession(userID string, id string) error {
+	n, err := revokeSessions(userID, func(s *Session) bool {
+		return s.ID == id
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("session '%s' not found", id)
+	}
+	return nil
+}
+
+// /api/sessions : list of sessions, current is marked
+// /api/sessions/revoke?id=${id}
+// /api/sessions/revokeOthers : log out all other devices
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	u, err := getLoggedUser(r, w)
+	if serveIfError(w, r, err) {
+		return
+	}
+	if !checkScope(w, r, scopeAdmin) {
+		return
+	}
+	currentID := ""
+	if c := getSecureCookie(r); c != nil {
+		currentID = c.SessionID
+	}
+
+	switch r.URL.Path {
+	case "/api/sessions":
+		res := []map[string]any{}
+		for _, s := range listSessions(u.ID) {
+			res = append(res, map[string]any{
+				"id":           s.ID,
+				"user_agent":   s.UserAgent,
+				"ip":           s.IP,
+				"created_at":   s.CreatedAt,
+				"last_seen_at": s.LastSeenAt,
+				"expires_at":   s.ExpiresAt,
+				"current":      s.ID == currentID,
+			})
+		}
+		serveJSONOK(w, r, res)
+	case "/api/sessions/revoke":
+		if !checkMethodPOSTorPUT(w, r) {
+			return
+		}
+		err = revokeSession(u.ID, r.FormValue("id"))
+		if err != nil {
+			serveError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		serveJSONOK(w, r, map[string]any{"ok": true})
+	case "/api/sessions/revokeOthers":
+		if !checkMethodPOSTorPUT(w, r) {
+			return
+		}
+		n, err := revokeSessions(u.ID, func(s *Session) bool {
+			return s.ID != currentID
+		})
+		if serveIfError(w, r, err) {
+			return
+		}
+		serveJSONOK(w, r, map[string]any{"ok": true, "revoked": n})
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/kjk/common/assert"
+)
+
+func TestSessions(t *testing.T) {
+	dataDir = t.TempDir()
+	sessions, sessionsLoaded = nil, false
+	defer func() {
+		dataDir = ""
+		sessions, sessionsLoaded = nil, false
+	}()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "laptop")
+	s1, err := createSession("github-1", r)
+	assert.NoError(t, err)
+	assert.Equal(t, s1.UserAgent, "laptop")
+	s2, err := createSession("github-1", r)
+	assert.NoError(t, err)
+	_, err = createSession("github-2", r)
+	assert.NoError(t, err)
+
+	assert.NotNil(t, touchSession(s1.ID, "github-1"))
+	assert.Nil(t, touchSession(s1.ID, "github-2"))
+	assert.Nil(t, touchSession("", "github-1"))
+	assert.Equal(t, len(listSessions("github-1")), 2)
+
+	// persisted
+	sessions, sessionsLoaded = nil, false
+	assert.Equal(t, len(listSessions("github-1")), 2)
+
+	assert.NoError(t, revokeSession("github-1", s1.ID))
+	assert.Nil(t, touchSession(s1.ID, "github-1"))
+	assert.Error(t, revokeSession("github-2", s2.ID))
+
+	// expires when not used
+	muSessions.Lock()
+	for _, s := range sessions {
+		s.ExpiresAt = time.Now().Add(-time.Second)
+	}
+	muSessions.Unlock()
+	assert.Nil(t, touchSession(s2.ID, "github-1"))
+	assert.Equal(t, len(listSessions("github-1")), 0)
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	pair := func(b string) string {
+		return strings.Repeat(b, 64) + ":" + strings.Repeat(b, 64)
+	}
+	_, err := parseCookieKeys("abcd:1234")
+	assert.Error(t, err)
+	_, err = parseCookieKeys("")
+	assert.Error(t, err)
+
+	oldKeys, err := parseCookieKeys(pair("a"))
+	assert.NoError(t, err)
+	newKeys, err := parseCookieKeys(pair("b") + "," + pair("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, len(newKeys), 4)
+
+	v := &SecureCookieValue{User: "jo", Email: "jo@example.com"}
+	encoded, err := securecookie.EncodeMulti(cookieName, v, securecookie.CodecsFromPairs(oldKeys...)...)
+	assert.NoError(t, err)
+
+	// cookies encoded with old keys are still valid after rotation
+	var got SecureCookieValue
+	err = securecookie.DecodeMulti(cookieName, encoded, &got, securecookie.CodecsFromPairs(newKeys...)...)
+	assert.NoError(t, err)
+	assert.Equal(t, got.Email, "jo@example.com")
+
+	// but not after the old keys are removed
+	err = securecookie.DecodeMulti(cookieName, encoded, &got, securecookie.CodecsFromPairs(newKeys[:2]...)...)
+	assert.Error(t, err)
+}
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kjk/common/appendstore"
 )
 
 type UserInfo struct {
+	ID    string // stable id, also the name of data directory, see users.go
 	User  string
 	Email string
 	Store *appendstore.Store
+	// nil if store is not encrypted at rest, see atrest.go
+	dataKeys *dataKeys
+
+	// built on demand, see index.go
+	index *userIndex
+	// serializes read-modify-write edits of notes done on the server
+	editMu sync.Mutex
+	// store IO holds it for reading, closing the store (see admin.go)
+	// for writing so that we don't write to a store being compacted
+	storeMu     sync.RWMutex
+	storeClosed bool
+	// size of data and index files, for quota, see limits.go
+	storeSize atomic.Int64
 }
 
 var (
@@ -26,40 +43,61 @@ var (
 	muStore sync.Mutex
 )
 
-func serveIfError(w http.ResponseWriter, err error) bool {
+func serveIfError(w http.ResponseWriter, r *http.Request, err error) bool {
 	if err == nil {
 		return false
 	}
-	logErrorf("serveIfError(): %s\n", err)
+	if serveIfLimitError(w, r, err) {
+		return true
+	}
+	logCtxErrorf(r.Context(), "serveIfError(): %s\n", err)
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 	return true
 }
 
-func serveError(w http.ResponseWriter, s string, code int) {
-	logErrorf("%s\n", s)
+func serveError(w http.ResponseWriter, r *http.Request, s string, code int) {
+	if code >= 500 {
+		logCtxErrorf(r.Context(), "%s\n", s)
+	} else {
+		logCtxWarnf(r.Context(), "%s\n", s)
+	}
 	http.Error(w, s, code)
 }
 
-func storeAppendLog(u *UserInfo, v []any) error {
-	logf("storeAppendLog()\n")
+func storeAppendLog(ctx context.Context, u *UserInfo, v []any) error {
+	logCtxDebugf(ctx, "storeAppendLog()\n")
+	// a bad entry would break re-playing the log
+	err := checkLogEntry(v)
+	if err != nil {
+		return err
+	}
 	jsonStr, err := json.Marshal(v)
 	if err != nil {
-		logf("storeAppendLog(): failed to marshal '%#v', err: %s\n", v, err)
+		logCtxErrorf(ctx, "storeAppendLog(): failed to marshal '%#v', err: %s\n", v, err)
 		return err
 	}
+	if int64(len(jsonStr)) > maxLogEntrySize {
+		return errTooLarge("log entry", int64(len(jsonStr)), maxLogEntrySize)
+	}
 
-	err = u.Store.AppendRecord("log", "", jsonStr)
-	return err
+	err = storeAppendRecord(u, "log", "", jsonStr)
+	if err != nil {
+		return err
+	}
+	updateUserIndexIfBuilt(ctx, u)
+	return nil
 }
 
-func storeGetLogs(u *UserInfo, start int) ([][]any, error) {
+func storeGetLogs(ctx context.Context, u *UserInfo, start int) ([][]any, error) {
 	if start < 0 {
 		start = 0
 	}
-	logf("storeGetLogs(): userEmail: '%s', start: %d\n", u.Email, start)
+	logCtxDebugf(ctx, "storeGetLogs(): userEmail: '%s', start: %d\n", u.Email, start)
 	timeStart := time.Now()
 	defer func() {
-		logf("  took %s\n", time.Since(timeStart))
+		dur := time.Since(timeStart)
+		observeStoreOp("storeGetLogs", dur)
+		logCtxDebugf(ctx, "  took %s\n", dur)
 	}()
 
 	logs := make([][]any, 0)
@@ -73,7 +111,7 @@ func storeGetLogs(u *UserInfo, start int) ([][]any, error) {
 		if n < start {
 			continue
 		}
-		d, err := u.Store.ReadRecord(rec)
+		d, err := storeReadRecord(u, rec)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read record %s: %w", rec.Meta, err)
 		}
@@ -84,55 +122,111 @@ func storeGetLogs(u *UserInfo, start int) ([][]any, error) {
 		}
 		logs = append(logs, v)
 	}
-	logf("%d log entries for user %s\n", len(logs), u.Email)
+	logCtxDebugf(ctx, "%d log entries for user %s\n", len(logs), u.Email)
 	return logs, nil
 }
 
 func checkMethodPOSTorPUT(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != "POST" && r.Method != "PUT" {
-		serveError(w, "only POST and PUT supported", http.StatusBadRequest)
+		serveError(w, r, "only POST and PUT supported", http.StatusBadRequest)
 		return false
 	}
 	return true
 }
 
-func contentPut(u *UserInfo, contentID string, r io.Reader) error {
+// encrypted is true if content is ciphertext of end-to-end encrypted note
+func contentPut(ctx context.Context, u *UserInfo, contentID string, r io.Reader, encrypted bool) error {
 	// Note: tried to PustObject(r) but the way minio client does multi-part
 	// uploads is not compatible with r2
 	d, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	if int64(len(d)) > maxContentSize {
+		return errTooLarge("note content", int64(len(d)), maxContentSize)
+	}
 	timeStart := time.Now()
 	defer func() {
-		logf("  took %s\n", time.Since(timeStart))
+		dur := time.Since(timeStart)
+		observeStoreOp("contentPut", dur)
+		logCtxDebugf(ctx, "  took %s\n", dur)
 	}()
 
-	err = u.Store.AppendRecord("content", contentID, d)
+	err = storeAppendRecord(u, "content", contentRecordMeta(contentID, encrypted), d)
 	return err
 }
 
-func contentGet(u *UserInfo, contentID string) ([]byte, error) {
-	timeStart := time.Now()
-	defer func() {
-		logf("  took %s\n", time.Since(timeStart))
-	}()
+// same as addNoteVersion() in notesStore.js
+// if timestampMs is 0, we use current time
+func storeAddNoteVersion(ctx context.Context, u *UserInfo, noteID string, d []byte, timestampMs int64, encrypted bool) error {
+	contentID := genContentID(noteID)
+	err := contentPut(ctx, u, contentID, bytes.NewReader(d), encrypted)
+	if err != nil {
+		return err
+	}
+	e := mkLogChangeContent(noteID, contentID, len(d))
+	if timestampMs != 0 {
+		e[1] = timestampMs
+	}
+	return storeAppendLog(ctx, u, e)
+}
+
+// rules for ids of notes and content
+func isValidStoreID(id string) bool {
+	return len(id) >= 6 && !strings.Contains(id, " ")
+}
 
+// returns nil if not found
+func contentGetRecord(u *UserInfo, contentID string) *appendstore.Record {
 	recs := u.Store.Records()
 	for _, rec := range recs {
-		if rec.Kind == "content" && rec.Meta == contentID {
-			return u.Store.ReadRecord(rec)
+		if rec.Kind != "content" {
+			continue
+		}
+		if id, _ := parseContentRecordMeta(rec.Meta); id == contentID {
+			return rec
 		}
 	}
-	return nil, fmt.Errorf("content not found for user %s, contentID %s", u.Email, contentID)
+	return nil
 }
 
+func contentGet(ctx context.Context, u *UserInfo, contentID string) ([]byte, error) {
+	timeStart := time.Now()
+	defer func() {
+		dur := time.Since(timeStart)
+		observeStoreOp("contentGet", dur)
+		logCtxDebugf(ctx, "  took %s\n", dur)
+	}()
+
+	rec := contentGetRecord(u, contentID)
+	if rec == nil {
+		return nil, fmt.Errorf("content not found for user %s, contentID %s", u.Email, contentID)
+	}
+	return storeReadRecord(u, rec)
+}
+
+// user is authenticated either with a cookie (browser) or with
+// "Authorization: Bearer ${token}" header (scripts)
 func getLoggedUser(r *http.Request, _ http.ResponseWriter) (*UserInfo, error) {
 	cookie := getSecureCookie(r)
+	if t, hasToken := requestAPIToken(r); hasToken {
+		if t == nil {
+			return nil, fmt.Errorf("invalid api token")
+		}
+		cookie = &SecureCookieValue{
+			UserID: t.UserID,
+			User:   t.User,
+			Email:  t.Email,
+		}
+	}
 	if cookie == nil || cookie.Email == "" {
 		return nil, fmt.Errorf("user not logged in (no cookie)")
 	}
-	email := cookie.Email
+	userID := cookie.UserID
+	if !isValidUserID(userID) {
+		return nil, fmt.Errorf("user not logged in (unknown user id for '%s')", cookie.Email)
+	}
+	setRequestLogUser(r.Context(), userID)
 	var userInfo *UserInfo
 
 	getOrCreateUser := func(u *UserInfo, i int) error {
@@ -141,21 +235,28 @@ func getLoggedUser(r *http.Request, _ http.ResponseWriter) (*UserInfo, error) {
 			return nil
 		}
 		u = &UserInfo{
+			ID:    userID,
 			Email: cookie.Email,
 			User:  cookie.User,
 		}
 
-		dataDir := getDataDirMust()
-		// TODO: must escape email to avoid chars not allowed in file names
-		dataDir = filepath.Join(dataDir, email)
+		dataDir := userDataDir(userID)
 		u.Store = &appendstore.Store{
 			DataDir:       dataDir,
 			IndexFileName: "index.txt",
 			DataFileName:  "data.bin",
 		}
 		err := appendstore.OpenStore(u.Store)
+		if err == nil {
+			size, _ := storeDirStats(dataDir)
+			u.storeSize.Store(size)
+			u.dataKeys, err = loadDataKeys(dataDir, true)
+			if err != nil {
+				u.Store.CloseFiles()
+			}
+		}
 		if err != nil {
-			logf("getLoggedUser(): failed to open store for user %s, err: %s\n", email, err)
+			logErrorf("getLoggedUser(): failed to open store for user %s, err: %s, check it with 'noted -fsck-user %s'\n", userID, err, userID)
 			return err
 		}
 		users = append(users, u)
@@ -163,29 +264,78 @@ func getLoggedUser(r *http.Request, _ http.ResponseWriter) (*UserInfo, error) {
 		return nil
 	}
 
-	doUserOpByEmail(email, getOrCreateUser)
+	err := doUserOpByID(userID, getOrCreateUser)
+	if err != nil {
+		return nil, err
+	}
 	return userInfo, nil
 }
 
 func handleStore(w http.ResponseWriter, r *http.Request) {
 	uri := r.URL.Path
 	u, err := getLoggedUser(r, w)
-	if serveIfError(w, err) {
-		logf("handleStore: %s, err: %s\n", uri, err)
+	if serveIfError(w, r, err) {
+		logCtxWarnf(r.Context(), "handleStore: %s, err: %s\n", uri, err)
 		return
 	}
 	userEmail := u.Email
-	logf("handleStore: %s, userEmail: %s\n", uri, userEmail)
+	logCtxf(r.Context(), "handleStore: %s, userEmail: %s\n", uri, userEmail)
+
+	if handleTokens(w, r, u) {
+		return
+	}
+
+	if uri == "/api/store/export" {
+		handleExport(w, r, u)
+		return
+	}
+
+	if uri == "/api/store/import" {
+		handleImport(w, r, u)
+		return
+	}
+
+	if uri == "/api/store/tasks" {
+		handleTasks(w, r, u)
+		return
+	}
+
+	if uri == "/api/store/keys" {
+		handleKeys(w, r, u)
+		return
+	}
+
+	if uri == "/api/store/usage" {
+		handleUsage(w, r, u)
+		return
+	}
+
+	if uri == "/api/store/query" {
+		handleQuery(w, r, u)
+		return
+	}
+	if uri == "/api/store/toggleTask" {
+		handleToggleTask(w, r, u)
+		return
+	}
+
+	if uri == "/api/store/restore" {
+		handleRestore(w, r, u)
+		return
+	}
 
 	if uri == "/api/store/getLogs" {
+		if !checkScope(w, r, scopeRead) {
+			return
+		}
 		// TODO: maybe will need to paginate
 		startStr := r.URL.Query().Get("start")
 		start, err := strconv.Atoi(startStr)
 		if err != nil {
 			start = 0
 		}
-		logs, err := storeGetLogs(u, start)
-		if serveIfError(w, err) {
+		logs, err := storeGetLogs(r.Context(), u, start)
+		if serveIfError(w, r, err) {
 			return
 		}
 		serveJSONOK(w, r, logs)
@@ -194,17 +344,22 @@ func handleStore(w http.ResponseWriter, r *http.Request) {
 
 	if uri == "/api/store/appendLog" {
 		defer r.Body.Close()
-		if !checkMethodPOSTorPUT(w, r) {
+		if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeWrite) {
 			return
 		}
 		var logEntry []interface{}
 		// validate log entry is proper JSON string
-		err := json.NewDecoder(r.Body).Decode(&logEntry)
-		if serveIfError(w, err) {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLogEntrySize)).Decode(&logEntry)
+		if serveIfError(w, r, err) {
 			return
 		}
-		err = storeAppendLog(u, logEntry)
-		if !serveIfError(w, err) {
+		err = checkLogEntry(logEntry)
+		if err != nil {
+			serveError(w, r, fmt.Sprintf("invalid log entry: %s", err), http.StatusBadRequest)
+			return
+		}
+		err = storeAppendLog(r.Context(), u, logEntry)
+		if !serveIfError(w, r, err) {
 			res := map[string]interface{}{
 				"ok": true,
 			}
@@ -214,30 +369,44 @@ func handleStore(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if uri == "/api/store/getContent" {
+		if !checkScope(w, r, scopeRead) {
+			return
+		}
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			serveError(w, "id is required", http.StatusBadRequest)
+			serveError(w, r, "id is required", http.StatusBadRequest)
 			return
 		}
-		data, err := contentGet(u, id)
-		if serveIfError(w, err) {
+		rec := contentGetRecord(u, id)
+		if rec == nil {
+			serveError(w, r, fmt.Sprintf("content '%s' not found", id), http.StatusNotFound)
 			return
 		}
+		data, err := storeReadRecord(u, rec)
+		if serveIfError(w, r, err) {
+			return
+		}
+		if _, encrypted := parseContentRecordMeta(rec.Meta); encrypted {
+			w.Header().Set("X-Noted-Encrypted", "1")
+		}
 		w.Write(data)
 		return
 	}
 
 	if uri == "/api/store/setContent" {
 		defer r.Body.Close()
-		if !checkMethodPOSTorPUT(w, r) {
+		if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeWrite) {
 			return
 		}
 		contentID := r.URL.Query().Get("id")
-		if len(contentID) < 6 {
-			serveError(w, "id must be at least 6 chars", http.StatusBadRequest)
+		if !isValidStoreID(contentID) {
+			serveError(w, r, "id must be at least 6 chars and can't contain spaces", http.StatusBadRequest)
+			return
 		}
-		err = contentPut(u, contentID, r.Body)
-		if !serveIfError(w, err) {
+		// ?encrypted=1 means the body is ciphertext of end-to-end encrypted note
+		encrypted := r.URL.Query().Get("encrypted") != ""
+		err = contentPut(r.Context(), u, contentID, http.MaxBytesReader(w, r.Body, maxContentSize), encrypted)
+		if !serveIfError(w, r, err) {
 			res := map[string]interface{}{}
 			serveJSONOK(w, r, res)
 		}
@@ -251,11 +420,12 @@ const shortIDSymbols = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRST
 
 var nShortSymbols = len(shortIDSymbols)
 
+// note: global rand is randomly seeded. Creating a new source seeded
+// with time.Now() generated the same ids when called in a tight loop
 func genRandomID(n int) string {
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 	res := ""
 	for i := 0; i < n; i++ {
-		idx := rnd.Intn(nShortSymbols)
+		idx := rand.Intn(nShortSymbols)
 		c := string(shortIDSymbols[idx])
 		res = res + c
 	}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kjk/common/u"
+)
+
+/*
+noted sync-dir [-watch] <dir> keeps notes and a directory of .md files in sync.
+
+Each note is a <title>.md file with front matter containing note id.
+We remember the state of last sync in <dir>/.noted-sync.json which allows
+us to tell which side changed:
+- changed locally: upload new content
+- changed on the server: over-write local file
+- changed on both sides: local version is saved as <title>.md.conflict
+  and the file is over-written with server version
+New .md files (without id in front matter) become new notes.
+Deleting a file deletes the note and vice-versa.
+End-to-end encrypted notes are skipped, we only have their ciphertext.
+
+With -watch we poll the directory and the server for changes. Polling
+is cheap (stat of files and fetching only new log entries) and avoids
+platform-specific file notification apis.
+*/
+
+const (
+	syncStateFileName = ".noted-sync.json"
+	conflictExt       = ".conflict"
+	// same as idSep in notesStore.js
+	titleIDSep = "~"
+)
+
+type syncedNote struct {
+	FileName  string `json:"file_name"`
+	Title     string `json:"title"`
+	ContentID string `json:"content_id"`
+	// sha1 of the file body (without front matter) at the time of last sync
+	Hash string `json:"hash"`
+	// content is end-to-end encrypted so we don't sync it
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+type syncDirState struct {
+	Server string                 `json:"server"`
+	Notes  map[string]*syncedNote `json:"notes"`
+}
+
+type localFile struct {
+	Name   string
+	NoteID string
+	Title  string // from front matter, only for new files
+	Body   []byte
+	Hash   string
+}
+
+type dirSyncer struct {
+	c     *apiClient
+	dir   string
+	state *syncDirState
+	// all log entries we've seen so far, we only ask for new ones
+	logs  [][]any
+	notes *Notes
+
+	nChanges int
+}
+
+func (s *dirSyncer) statePath() string {
+	return filepath.Join(s.dir, syncStateFileName)
+}
+
+func (s *dirSyncer) loadState() error {
+	s.state = &syncDirState{}
+	err := readJSONFile(s.statePath(), s.state)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.state.Server != "" && s.state.Server != s.c.ServerURL {
+		return fmt.Errorf("'%s' is synced with '%s', not '%s'", s.dir, s.state.Server, s.c.ServerURL)
+	}
+	s.state.Server = s.c.ServerURL
+	if s.state.Notes == nil {
+		s.state.Notes = map[string]*syncedNote{}
+	}
+	return nil
+}
+
+func (s *dirSyncer) saveState() error {
+	return writeJSONFileAtomic(s.statePath(), s.state)
+}
+
+// returns true if there were new log entries
+func (s *dirSyncer) fetchNotes() (bool, error) {
+	logs, err := s.c.getLogs(len(s.logs))
+	if err != nil {
+		return false, err
+	}
+	if len(logs) == 0 && s.notes != nil {
+		return false, nil
+	}
+	s.logs = append(s.logs, logs...)
+	s.notes = notesFromLogs(s.logs)
+	return true, nil
+}
+
+var fileNameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_",
+	"\"", "_", "<", "_", ">", "_", "|", "_", "\n", " ", "\r", " ", "\t", " ",
+)
+
+func titleToFileName(title string) string {
+	s := fileNameReplacer.Replace(title)
+	s = strings.Trim(s, " .")
+	if len(s) > 120 {
+		s = s[:120]
+	}
+	return s
+}
+
+func fileNameToTitle(name string) string {
+	title := strings.TrimSuffix(name, filepath.Ext(name))
+	// drop id we might have added to make file name unique
+	if idx := strings.LastIndex(title, titleIDSep); idx > 0 {
+		title = title[:idx]
+	}
+	return title
+}
+
+// returns a file name for a note, unique among existing files
+func (s *dirSyncer) fileNameForNote(note *Note, files map[string]*localFile) string {
+	base := titleToFileName(note.Title)
+	if base == "" {
+		base = note.ID
+	}
+	isTaken := func(name string) bool {
+		if f := files[name]; f != nil && f.NoteID != note.ID {
+			return true
+		}
+		for id, sn := range s.state.Notes {
+			if id != note.ID && strings.EqualFold(sn.FileName, name) {
+				return true
+			}
+		}
+		return false
+	}
+	name := base + ".md"
+	if isTaken(name) {
+		name = base + titleIDSep + note.ID + ".md"
+	}
+	return name
+}
+
+func (s *dirSyncer) readLocalFiles() (map[string]*localFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]*localFile{}
+	for _, de := range entries {
+		name := de.Name()
+		if de.IsDir() || !strings.EqualFold(filepath.Ext(name), ".md") {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		d, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f := &localFile{
+			Name: name,
+		}
+		f.Body = d
+		fm, body := parseFrontMatter(string(d))
+		if fm != nil {
+			f.NoteID = fm["id"]
+			f.Body = []byte(body)
+			if f.NoteID == "" {
+				f.Title = fm["title"]
+			}
+		}
+		f.Hash = u.DataSha1Hex(f.Body)
+		res[name] = f
+	}
+	return res, nil
+}
+
+func (s *dirSyncer) writeNoteFile(name string, noteID string, body []byte) error {
+	d := []byte(formatFrontMatter("id", noteID))
+	d = append(d, body...)
+	path := filepath.Join(s.dir, name)
+	return os.WriteFile(path, d, 0644)
+}
+
+func (s *dirSyncer) logChange(format string, args ...any) {
+	s.nChanges++
+	fmt.Printf(format, args...)
+}
+
+// we remember the content id so that we check again when it changes
+func (s *dirSyncer) skipEncrypted(note *Note) error {
+	sn := &syncedNote{
+		Title:     note.Title,
+		ContentID: note.ContentID,
+		Encrypted: true,
+	}
+	if prev := s.state.Notes[note.ID]; prev != nil {
+		sn.FileName = prev.FileName
+		sn.Hash = prev.Hash
+	}
+	s.state.Notes[note.ID] = sn
+	s.logChange("skipped '%s' because it's end-to-end encrypted\n", note.Title)
+	return nil
+}
+
+// server version over-writes local file
+func (s *dirSyncer) download(note *Note, files map[string]*localFile) error {
+	body, err := s.c.getNoteContent(note)
+	if errors.Is(err, errNoteEncrypted) {
+		return s.skipEncrypted(note)
+	}
+	if err != nil {
+		return err
+	}
+	sn := s.state.Notes[note.ID]
+	name := s.fileNameForNote(note, files)
+	if sn != nil && sn.FileName != name {
+		// title changed on the server
+		os.Remove(filepath.Join(s.dir, sn.FileName))
+	}
+	err = s.writeNoteFile(name, note.ID, body)
+	if err != nil {
+		return err
+	}
+	s.state.Notes[note.ID] = &syncedNote{
+		FileName:  name,
+		Title:     note.Title,
+		ContentID: note.ContentID,
+		Hash:      u.DataSha1Hex(body),
+	}
+	s.logChange("downloaded '%s'\n", name)
+	return nil
+}
+
+func (s *dirSyncer) upload(note *Note, f *localFile) error {
+	err := s.c.addNoteVersion(note, f.Body)
+	if err != nil {
+		return err
+	}
+	// we know the content id only after re-playing the log
+	_, err = s.fetchNotes()
+	if err != nil {
+		return err
+	}
+	note = s.notes.Get(note.ID)
+	fileName := f.Name
+	title := note.Title
+	if sn := s.state.Notes[note.ID]; sn != nil {
+		// renames are synced in syncNote()
+		fileName = sn.FileName
+		title = sn.Title
+	}
+	s.state.Notes[note.ID] = &syncedNote{
+		FileName:  fileName,
+		Title:     title,
+		ContentID: note.ContentID,
+		Hash:      f.Hash,
+	}
+	s.logChange("uploaded '%s'\n", f.Name)
+	return nil
+}
+
+// local file changed but so did the note on the server
+func (s *dirSyncer) saveConflict(note *Note, f *localFile, files map[string]*localFile) error {
+	conflictPath := filepath.Join(s.dir, f.Name+conflictExt)
+	err := os.WriteFile(conflictPath, f.Body, 0644)
+	if err != nil {
+		return err
+	}
+	s.logChange("conflict: local version of '%s' saved as '%s'\n", f.Name, conflictPath)
+	return s.download(note, files)
+}
+
+func (s *dirSyncer) createNoteFromFile(f *localFile) error {
+	title := f.Title
+	if title == "" {
+		title = fileNameToTitle(f.Name)
+	}
+	note, err := s.c.newNote(title, "md")
+	if err != nil {
+		return err
+	}
+	f.NoteID = note.ID
+	err = s.writeNoteFile(f.Name, note.ID, f.Body)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) == 0 {
+		s.state.Notes[note.ID] = &syncedNote{
+			FileName: f.Name,
+			Title:    title,
+			Hash:     f.Hash,
+		}
+		s.logChange("created note '%s' from '%s'\n", title, f.Name)
+		return nil
+	}
+	return s.upload(note, f)
+}
+
+func (s *dirSyncer) syncNote(note *Note, files map[string]*localFile, filesByID map[string]*localFile) error {
+	sn := s.state.Notes[note.ID]
+	f := filesByID[note.ID]
+	if sn != nil && sn.Encrypted && sn.ContentID == note.ContentID {
+		return nil
+	}
+	if sn == nil {
+		if f == nil {
+			return s.download(note, files)
+		}
+		// we lost sync state but have the file
+		body, err := s.c.getNoteContent(note)
+		if errors.Is(err, errNoteEncrypted) {
+			return s.skipEncrypted(note)
+		}
+		if err != nil {
+			return err
+		}
+		if f.Hash != u.DataSha1Hex(body) {
+			return s.saveConflict(note, f, files)
+		}
+		s.state.Notes[note.ID] = &syncedNote{
+			FileName:  f.Name,
+			Title:     note.Title,
+			ContentID: note.ContentID,
+			Hash:      f.Hash,
+		}
+		return nil
+	}
+
+	serverChanged := note.ContentID != sn.ContentID
+	if f == nil {
+		if serverChanged {
+			return s.download(note, files)
+		}
+		err := s.c.appendLog(mkLogDeleteNote(note.ID))
+		if err != nil {
+			return err
+		}
+		delete(s.state.Notes, note.ID)
+		s.logChange("deleted note '%s' because '%s' was deleted\n", note.Title, sn.FileName)
+		return nil
+	}
+
+	localChanged := f.Hash != sn.Hash
+	switch {
+	case serverChanged && localChanged:
+		return s.saveConflict(note, f, files)
+	case serverChanged:
+		return s.download(note, files)
+	}
+
+	// renamed on the server wins over local rename
+	serverRenamed := note.Title != sn.Title
+	if !serverRenamed && f.Name != sn.FileName {
+		title := fileNameToTitle(f.Name)
+		err := s.c.appendLog(mkLogChangeTitle(note.ID, title))
+		if err != nil {
+			return err
+		}
+		sn.FileName = f.Name
+		sn.Title = title
+		s.logChange("renamed note '%s' to '%s'\n", note.Title, title)
+	}
+	if localChanged {
+		err := s.upload(note, f)
+		if err != nil {
+			return err
+		}
+		note = s.notes.Get(note.ID)
+	}
+	if serverRenamed {
+		return s.download(note, files)
+	}
+	return nil
+}
+
+func (s *dirSyncer) syncOnce() error {
+	_, err := s.fetchNotes()
+	if err != nil {
+		return err
+	}
+	files, err := s.readLocalFiles()
+	if err != nil {
+		return err
+	}
+	filesByID := map[string]*localFile{}
+	for _, f := range files {
+		if f.NoteID != "" {
+			filesByID[f.NoteID] = f
+		}
+	}
+
+	// notes deleted on the server
+	for id, sn := range s.state.Notes {
+		if s.notes.Get(id) != nil {
+			continue
+		}
+		f := filesByID[id]
+		if f != nil && f.Hash != sn.Hash {
+			// changed locally so don't lose the changes
+			err = os.Rename(filepath.Join(s.dir, f.Name), filepath.Join(s.dir, f.Name+conflictExt))
+			if err != nil {
+				return err
+			}
+		} else {
+			os.Remove(filepath.Join(s.dir, sn.FileName))
+		}
+		delete(s.state.Notes, id)
+		delete(filesByID, id)
+		if f != nil {
+			delete(files, f.Name)
+		}
+		s.logChange("note '%s' was deleted on the server\n", sn.Title)
+	}
+
+	for _, note := range s.notes.Notes {
+		err = s.syncNote(note, files, filesByID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if f.NoteID == "" || s.notes.Get(f.NoteID) == nil && s.state.Notes[f.NoteID] == nil {
+			err = s.createNoteFromFile(f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.saveState()
+}
+
+// cheap way to detect local changes
+func dirSnapshot(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, de := range entries {
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s %d %d\n", de.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sb.String()
+}
+
+func cliSyncDir(args []string) {
+	fs := flag.NewFlagSet("sync-dir", flag.ExitOnError)
+	var watch bool
+	var interval time.Duration
+	fs.BoolVar(&watch, "watch", false, "keep watching for changes")
+	fs.DurationVar(&interval, "interval", 5*time.Second, "how often to check for changes with -watch")
+	c := newAPIClientFromFlags(fs, args)
+	if fs.NArg() != 1 {
+		cliFatalf("need a directory to sync\n")
+	}
+	dir := fs.Arg(0)
+	cliFatalIfErr(os.MkdirAll(dir, 0755))
+
+	s := &dirSyncer{
+		c:   c,
+		dir: dir,
+	}
+	cliFatalIfErr(s.loadState())
+	cliFatalIfErr(s.syncOnce())
+	fmt.Printf("synced %d notes with '%s', %d changes\n", len(s.notes.Notes), dir, s.nChanges)
+	if !watch {
+		return
+	}
+
+	lastSnapshot := dirSnapshot(dir)
+	for {
+		time.Sleep(interval)
+		serverChanged, err := s.fetchNotes()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			continue
+		}
+		snapshot := dirSnapshot(dir)
+		if !serverChanged && snapshot == lastSnapshot {
+			continue
+		}
+		err = s.syncOnce()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+		// our own writes change the directory
+		lastSnapshot = dirSnapshot(dir)
+	}
+}
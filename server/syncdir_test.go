@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kjk/common/assert"
+)
+
+// body of files in dir, without front matter
+func readSyncedDir(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	res := map[string]string{}
+	for _, de := range entries {
+		if de.Name() == syncStateFileName {
+			continue
+		}
+		d, err := os.ReadFile(filepath.Join(dir, de.Name()))
+		assert.NoError(t, err)
+		_, body := parseFrontMatter(string(d))
+		res[de.Name()] = body
+	}
+	return res
+}
+
+// title => content of notes on the server
+func readServerNotes(t *testing.T, c *apiClient) map[string]string {
+	notes, err := c.getNotes()
+	assert.NoError(t, err)
+	res := map[string]string{}
+	for _, note := range notes.Notes {
+		d, err := c.getNoteContent(note)
+		if errors.Is(err, errNoteEncrypted) {
+			d, err = []byte("<encrypted>"), nil
+		}
+		assert.NoError(t, err)
+		res[note.Title] = string(d)
+	}
+	return res
+}
+
+func TestSyncDir(t *testing.T) {
+	writeFile := func(t *testing.T, dir, name, s string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(s), 0644))
+	}
+	// front matter of synced "Note.md"
+	var noteFM string
+	tests := []struct {
+		name         string
+		local        func(t *testing.T, dir string)
+		server       func(t *testing.T, c *apiClient, note *Note)
+		wantFiles    map[string]string
+		wantOnServer map[string]string
+	}{
+		{
+			name:         "nothing changed",
+			wantFiles:    map[string]string{"Note.md": "v1"},
+			wantOnServer: map[string]string{"Note": "v1"},
+		},
+		{
+			name: "local edit",
+			local: func(t *testing.T, dir string) {
+				writeFile(t, dir, "Note.md", noteFM+"v2")
+			},
+			wantFiles:    map[string]string{"Note.md": "v2"},
+			wantOnServer: map[string]string{"Note": "v2"},
+		},
+		{
+			name: "server edit",
+			server: func(t *testing.T, c *apiClient, note *Note) {
+				assert.NoError(t, c.addNoteVersion(note, []byte("v2")))
+			},
+			wantFiles:    map[string]string{"Note.md": "v2"},
+			wantOnServer: map[string]string{"Note": "v2"},
+		},
+		{
+			name: "conflict",
+			local: func(t *testing.T, dir string) {
+				writeFile(t, dir, "Note.md", noteFM+"local")
+			},
+			server: func(t *testing.T, c *apiClient, note *Note) {
+				assert.NoError(t, c.addNoteVersion(note, []byte("server")))
+			},
+			wantFiles:    map[string]string{"Note.md": "server", "Note.md.conflict": "local"},
+			wantOnServer: map[string]string{"Note": "server"},
+		},
+		{
+			name: "local delete",
+			local: func(t *testing.T, dir string) {
+				assert.NoError(t, os.Remove(filepath.Join(dir, "Note.md")))
+			},
+			wantFiles:    map[string]string{},
+			wantOnServer: map[string]string{},
+		},
+		{
+			name: "server delete",
+			server: func(t *testing.T, c *apiClient, note *Note) {
+				assert.NoError(t, c.appendLog(mkLogDeleteNote(note.ID)))
+			},
+			wantFiles:    map[string]string{},
+			wantOnServer: map[string]string{},
+		},
+		{
+			name: "server rename",
+			server: func(t *testing.T, c *apiClient, note *Note) {
+				assert.NoError(t, c.appendLog(mkLogChangeTitle(note.ID, "Other")))
+			},
+			wantFiles:    map[string]string{"Other.md": "v1"},
+			wantOnServer: map[string]string{"Other": "v1"},
+		},
+		{
+			name: "encrypted on the server",
+			local: func(t *testing.T, dir string) {
+				writeFile(t, dir, "Note.md", noteFM+"v2")
+			},
+			server: func(t *testing.T, c *apiClient, note *Note) {
+				setEncryptedContent(t, c, note, "ciphertext")
+			},
+			wantFiles:    map[string]string{"Note.md": "v2", "Note.md.conflict": "v2"},
+			wantOnServer: map[string]string{"Note": "<encrypted>"},
+		},
+		{
+			name: "new encrypted note on the server",
+			server: func(t *testing.T, c *apiClient, note *Note) {
+				secret, err := c.newNote("Secret", "md")
+				assert.NoError(t, err)
+				setEncryptedContent(t, c, secret, "ciphertext")
+			},
+			wantFiles:    map[string]string{"Note.md": "v1"},
+			wantOnServer: map[string]string{"Note": "v1", "Secret": "<encrypted>"},
+		},
+		{
+			name: "local rename and edit",
+			local: func(t *testing.T, dir string) {
+				assert.NoError(t, os.Remove(filepath.Join(dir, "Note.md")))
+				writeFile(t, dir, "Renamed.md", noteFM+"v2")
+			},
+			wantFiles:    map[string]string{"Renamed.md": "v2"},
+			wantOnServer: map[string]string{"Renamed": "v2"},
+		},
+		{
+			name: "new file with title in front matter",
+			local: func(t *testing.T, dir string) {
+				writeFile(t, dir, "new.md", formatFrontMatter("title", "Fresh")+"hello")
+			},
+			wantFiles:    map[string]string{"Note.md": "v1", "new.md": "hello"},
+			wantOnServer: map[string]string{"Note": "v1", "Fresh": "hello"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestAPIClient(t, scopeWrite)
+			note, err := c.newNote("Note", "md")
+			assert.NoError(t, err)
+			assert.NoError(t, c.addNoteVersion(note, []byte("v1")))
+			noteFM = formatFrontMatter("id", note.ID)
+
+			dir := t.TempDir()
+			s := &dirSyncer{c: c, dir: dir}
+			assert.NoError(t, s.loadState())
+			assert.NoError(t, s.syncOnce())
+			assert.Equal(t, readSyncedDir(t, dir), map[string]string{"Note.md": "v1"})
+
+			if tc.local != nil {
+				tc.local(t, dir)
+			}
+			if tc.server != nil {
+				notes, err := c.getNotes()
+				assert.NoError(t, err)
+				tc.server(t, c, notes.Get(note.ID))
+			}
+			// a fresh syncer, like a new run of sync-dir
+			s = &dirSyncer{c: c, dir: dir}
+			assert.NoError(t, s.loadState())
+			assert.NoError(t, s.syncOnce())
+			assert.Equal(t, readSyncedDir(t, dir), tc.wantFiles)
+			assert.Equal(t, readServerNotes(t, c), tc.wantOnServer)
+
+			// nothing left to sync
+			s.nChanges = 0
+			assert.NoError(t, s.syncOnce())
+			assert.Equal(t, s.nChanges, 0)
+		})
+	}
+}
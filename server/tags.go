@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// tags are #hashtags in note content or "tags: a, b" in front matter
+// "# Heading" is not a tag because tag can't start with a space
+
+var rxTag = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_][\p{L}\p{N}_/-]*)`)
+
+// returns sorted, unique, lower-cased tags
+func parseTags(s string, fm map[string]string) []string {
+	var res []string
+	add := func(tag string) {
+		tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+		if tag != "" && !slices.Contains(res, tag) {
+			res = append(res, tag)
+		}
+	}
+	if v := fm["tags"]; v != "" {
+		v = strings.Trim(v, "[]")
+		for _, tag := range strings.Split(v, ",") {
+			add(tag)
+		}
+	}
+	inCode := false
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		for _, m := range rxTag.FindAllStringSubmatch(line, -1) {
+			// 123 is more likely an issue number than a tag
+			if strings.Trim(m[1], "0123456789") == "" {
+				continue
+			}
+			add(m[1])
+		}
+	}
+	slices.Sort(res)
+	return res
+}
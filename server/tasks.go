@@ -0,0 +1,345 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tasks are markdown checkboxes, same as rendered by tasks plug:
+// - [ ] call Bob @kjk 📅 2026-10-20 ⏫
+// - [x] done task
+// optional: due date (📅 YYYY-MM-DD), priority (emoji, same as Obsidian Tasks)
+// and assignees (@name)
+
+type Task struct {
+	NoteID    string `json:"note_id"`
+	NoteTitle string `json:"note_title"`
+	// version of the note the task is from, see handleToggleTask()
+	ContentID string   `json:"content_id"`
+	Line      int      `json:"line"` // 1-based line number in note content
+	Text      string   `json:"text"`
+	Done      bool     `json:"done"`
+	Due       string   `json:"due,omitempty"` // YYYY-MM-DD
+	Priority  string   `json:"priority,omitempty"`
+	Assignees []string `json:"assignees,omitempty"`
+}
+
+var (
+	rxTask     = regexp.MustCompile(`^\s*[-*+]\s+\[([ xX])\]\s+(.*)$`)
+	rxDue      = regexp.MustCompile(`📅\s*(\d{4}-\d{2}-\d{2})`)
+	rxAssignee = regexp.MustCompile(`(?:^|\s)@([\w.-]+)`)
+)
+
+var taskPriorities = []struct {
+	emoji    string
+	priority string
+}{
+	{"🔺", "highest"},
+	{"⏫", "high"},
+	{"🔼", "medium"},
+	{"🔽", "low"},
+	{"⏬", "lowest"},
+}
+
+// for sorting, lower is more important
+func priorityRank(priority string) int {
+	for i, p := range taskPriorities {
+		if p.priority == priority {
+			return i
+		}
+	}
+	// no priority is between medium and low
+	return 3
+}
+
+func parseTaskLine(line string) *Task {
+	m := rxTask.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	t := &Task{
+		Done: m[1] != " ",
+		Text: strings.TrimSpace(m[2]),
+	}
+	if m := rxDue.FindStringSubmatch(t.Text); m != nil {
+		t.Due = m[1]
+	}
+	for _, p := range taskPriorities {
+		if strings.Contains(t.Text, p.emoji) {
+			t.Priority = p.priority
+			break
+		}
+	}
+	for _, m := range rxAssignee.FindAllStringSubmatch(t.Text, -1) {
+		t.Assignees = append(t.Assignees, strings.TrimRight(m[1], "."))
+	}
+	return t
+}
+
+// parses tasks from markdown, skipping fenced code blocks
+func parseTasks(s string) []*Task {
+	var res []*Task
+	inCode := false
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		t := parseTaskLine(strings.TrimRight(line, "\r"))
+		if t == nil {
+			continue
+		}
+		t.Line = i + 1
+		res = append(res, t)
+	}
+	return res
+}
+
+// returns new content with task at line (1-based) toggled
+func toggleTaskInContent(s string, line int) (string, *Task, error) {
+	lines := strings.Split(s, "\n")
+	if line < 1 || line > len(lines) {
+		return "", nil, fmt.Errorf("line %d out of range", line)
+	}
+	l := lines[line-1]
+	t := parseTaskLine(strings.TrimRight(l, "\r"))
+	if t == nil {
+		return "", nil, fmt.Errorf("line %d is not a task", line)
+	}
+	m := rxTask.FindStringSubmatchIndex(l)
+	// m[2], m[3] is the position of check mark
+	mark := "x"
+	if t.Done {
+		mark = " "
+	}
+	lines[line-1] = l[:m[2]] + mark + l[m[3]:]
+	t.Done = !t.Done
+	t.Line = line
+	return strings.Join(lines, "\n"), t, nil
+}
+
+// "today", "+7d", "-1d" or "2026-10-20" => "2026-10-20"
+func parseDateArg(s string, now time.Time) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "today" {
+		return now.Format("2006-01-02"), nil
+	}
+	if strings.HasSuffix(s, "d") && (strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-")) {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return "", fmt.Errorf("invalid date '%s'", s)
+		}
+		return now.AddDate(0, 0, n).Format("2006-01-02"), nil
+	}
+	if _, err := time.Parse("2006-01-02", s); err != nil {
+		return "", fmt.Errorf("invalid date '%s'", s)
+	}
+	return s, nil
+}
+
+type taskFilterCond struct {
+	key string
+	op  string
+	val string
+}
+
+var rxFilterCond = regexp.MustCompile(`^(\w+)(<=|>=|<|>|=)(.*)$`)
+
+// parses raw query string like "status=open&due<=2026-10-20" which
+// url.Values can't represent
+func parseTaskFilter(rawQuery string, now time.Time) ([]taskFilterCond, error) {
+	var res []taskFilterCond
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		s, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		m := rxFilterCond.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("invalid condition '%s'", s)
+		}
+		c := taskFilterCond{key: m[1], op: m[2], val: m[3]}
+		switch c.key {
+		case "due":
+			c.val, err = parseDateArg(c.val, now)
+			if err != nil {
+				return nil, err
+			}
+		case "status":
+			if c.val != "open" && c.val != "done" && c.val != "all" {
+				return nil, fmt.Errorf("invalid status '%s', must be open, done or all", c.val)
+			}
+		case "assignee", "priority", "note":
+			// no validation needed
+		default:
+			return nil, fmt.Errorf("unknown filter '%s'", c.key)
+		}
+		if c.key != "due" && c.op != "=" {
+			return nil, fmt.Errorf("only = is supported for '%s'", c.key)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+func compareOp(c int, op string) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func taskMatches(t *Task, conds []taskFilterCond) bool {
+	for _, c := range conds {
+		switch c.key {
+		case "status":
+			if (c.val == "open" && t.Done) || (c.val == "done" && !t.Done) {
+				return false
+			}
+		case "due":
+			// tasks without due date don't match date conditions
+			if t.Due == "" || !compareOp(strings.Compare(t.Due, c.val), c.op) {
+				return false
+			}
+		case "assignee":
+			if !slices.Contains(t.Assignees, strings.TrimPrefix(c.val, "@")) {
+				return false
+			}
+		case "priority":
+			if t.Priority != c.val {
+				return false
+			}
+		case "note":
+			if t.NoteID != c.val {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sorted by due date (tasks without due date last), priority, note, line
+func sortTasks(tasks []*Task) {
+	slices.SortStableFunc(tasks, func(t1, t2 *Task) int {
+		if t1.Due != t2.Due {
+			if t1.Due == "" {
+				return 1
+			}
+			if t2.Due == "" {
+				return -1
+			}
+			return strings.Compare(t1.Due, t2.Due)
+		}
+		if c := cmp.Compare(priorityRank(t1.Priority), priorityRank(t2.Priority)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(t1.NoteTitle, t2.NoteTitle); c != 0 {
+			return c
+		}
+		return cmp.Compare(t1.Line, t2.Line)
+	})
+}
+
+// /api/store/tasks?status=open&due<=2026-10-20&assignee=kjk
+func handleTasks(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	if !checkScope(w, r, scopeRead) {
+		return
+	}
+	conds, err := parseTaskFilter(r.URL.RawQuery, time.Now())
+	if err != nil {
+		serveError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	idx, err := getUserIndex(r.Context(), u)
+	if serveIfError(w, r, err) {
+		return
+	}
+	res := []*Task{}
+	for _, t := range idx.allTasks() {
+		if taskMatches(t, conds) {
+			res = append(res, t)
+		}
+	}
+	sortTasks(res)
+	serveJSONOK(w, r, res)
+}
+
+// /api/store/toggleTask?note=${noteID}&content=${contentID}&line=${line}
+// content is content_id of the task. If the note was changed since,
+// line might be a different task so we return 409 Conflict
+func handleToggleTask(w http.ResponseWriter, r *http.Request, u *UserInfo) {
+	if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeWrite) {
+		return
+	}
+	noteID := r.FormValue("note")
+	contentID := r.FormValue("content")
+	line, err := strconv.Atoi(r.FormValue("line"))
+	if noteID == "" || contentID == "" || err != nil {
+		serveError(w, r, "note, content and line are required", http.StatusBadRequest)
+		return
+	}
+
+	// serialize read-modify-write of note content
+	u.editMu.Lock()
+	defer u.editMu.Unlock()
+
+	idx, err := getUserIndex(r.Context(), u)
+	if serveIfError(w, r, err) {
+		return
+	}
+	note := idx.getNote(noteID)
+	if note == nil || note.ContentID == "" {
+		serveError(w, r, fmt.Sprintf("note '%s' not found", noteID), http.StatusNotFound)
+		return
+	}
+	if idx.isEncrypted(noteID) {
+		serveError(w, r, fmt.Sprintf("note '%s' is encrypted", noteID), http.StatusBadRequest)
+		return
+	}
+	if note.ContentID != contentID {
+		serveError(w, r, fmt.Sprintf("note '%s' was changed, it's now '%s' and not '%s'", noteID, note.ContentID, contentID), http.StatusConflict)
+		return
+	}
+	d, err := contentGet(r.Context(), u, note.ContentID)
+	if serveIfError(w, r, err) {
+		return
+	}
+	s, t, err := toggleTaskInContent(string(d), line)
+	if err != nil {
+		serveError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = storeAddNoteVersion(r.Context(), u, noteID, []byte(s), 0, false)
+	if serveIfError(w, r, err) {
+		return
+	}
+	t.NoteID = note.ID
+	t.NoteTitle = note.Title
+	if note = idx.getNote(noteID); note != nil {
+		t.ContentID = note.ContentID
+	}
+	serveJSONOK(w, r, t)
+}
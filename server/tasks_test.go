@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/appendstore"
+	"github.com/kjk/common/assert"
+)
+
+func TestParseTasks(t *testing.T) {
+	s := "# Standup\n- [ ] call Bob @kjk @ann 📅 2026-10-20 ⏫\n  * [x] done task\nnot a task [ ]\n```\n- [ ] in code\n```\n- [ ] mail foo@example.com 🔽\n"
+	tasks := parseTasks(s)
+	assert.Equal(t, len(tasks), 3)
+
+	t1 := tasks[0]
+	assert.Equal(t, t1.Line, 2)
+	assert.False(t, t1.Done)
+	assert.Equal(t, t1.Due, "2026-10-20")
+	assert.Equal(t, t1.Priority, "high")
+	assert.Equal(t, len(t1.Assignees), 2)
+	assert.Equal(t, t1.Assignees[1], "ann")
+
+	assert.True(t, tasks[1].Done)
+	assert.Equal(t, tasks[1].Line, 3)
+
+	// email is not an assignee
+	assert.Equal(t, len(tasks[2].Assignees), 0)
+	assert.Equal(t, tasks[2].Priority, "low")
+}
+
+func TestToggleTask(t *testing.T) {
+	s := "a\r\n- [ ] one\r\n- [X] two\r\n"
+	s2, task, err := toggleTaskInContent(s, 2)
+	assert.NoError(t, err)
+	assert.True(t, task.Done)
+	assert.Equal(t, s2, "a\r\n- [x] one\r\n- [X] two\r\n")
+	s2, task, err = toggleTaskInContent(s2, 3)
+	assert.NoError(t, err)
+	assert.False(t, task.Done)
+	assert.Equal(t, s2, "a\r\n- [x] one\r\n- [ ] two\r\n")
+	_, _, err = toggleTaskInContent(s, 1)
+	assert.Error(t, err)
+}
+
+func TestTaskFilter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	conds, err := parseTaskFilter("status=open&due%3C=%2B1d&assignee=@kjk", now)
+	assert.NoError(t, err)
+	assert.Equal(t, len(conds), 3)
+	assert.Equal(t, conds[1].op, "<=")
+	assert.Equal(t, conds[1].val, "2026-10-20")
+
+	task := &Task{Due: "2026-10-20", Assignees: []string{"kjk"}}
+	assert.True(t, taskMatches(task, conds))
+	task.Done = true
+	assert.False(t, taskMatches(task, conds))
+
+	_, err = parseTaskFilter("due<tomorrow", now)
+	assert.Error(t, err)
+}
+
+func TestIndexSkipsBadLogEntries(t *testing.T) {
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer u.Store.CloseFiles()
+
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("n1", "note", "md", false)))
+	assert.NoError(t, storeAddNoteVersion(ctx(), u, "n1", []byte("- [ ] task one\n"), 0, false))
+	for _, e := range [][]any{{"foo"}, {42, 0, "n1"}, {kLogChangeContent, 0, "n1"}} {
+		assert.Error(t, storeAppendLog(ctx(), u, e))
+	}
+	// appended before we validated log entries
+	assert.NoError(t, u.Store.AppendRecord("log", "", []byte(`[42,0,"n1"]`)))
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogChangeTitle("n1", "tasks")))
+
+	idx, err := getUserIndex(ctx(), u)
+	assert.NoError(t, err)
+	assert.Equal(t, idx.nLogs, 4)
+	tasks := idx.allTasks()
+	assert.Equal(t, len(tasks), 1)
+	assert.Equal(t, tasks[0].NoteTitle, "tasks")
+}
+
+func TestHandleToggleTask(t *testing.T) {
+	u := &UserInfo{ID: "local-jo", Store: &appendstore.Store{DataDir: t.TempDir()}}
+	assert.NoError(t, appendstore.OpenStore(u.Store))
+	defer u.Store.CloseFiles()
+	assert.NoError(t, storeAppendLog(ctx(), u, mkLogCreateNote("n1", "todo", "md", false)))
+	assert.NoError(t, storeAddNoteVersion(ctx(), u, "n1", []byte("- [ ] one\n- [ ] two\n"), 0, false))
+
+	toggle := func(contentID string, line string) *httptest.ResponseRecorder {
+		uri := "/api/store/toggleTask?note=n1&line=" + line + "&content=" + contentID
+		w := httptest.NewRecorder()
+		handleToggleTask(w, httptest.NewRequest("POST", uri, nil), u)
+		return w
+	}
+	idx, err := getUserIndex(ctx(), u)
+	assert.NoError(t, err)
+	contentID := idx.allTasks()[0].ContentID
+	assert.Equal(t, contentID, idx.getNote("n1").ContentID)
+
+	w := toggle(contentID, "1")
+	assert.Equal(t, w.Code, 200)
+	var task Task
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &task))
+	assert.True(t, task.Done)
+	assert.Equal(t, task.ContentID, idx.getNote("n1").ContentID)
+	assert.NotEqual(t, task.ContentID, contentID)
+
+	// the note was changed since we got the task
+	assert.Equal(t, toggle(contentID, "2").Code, 409)
+	assert.Equal(t, toggle("", "2").Code, 400)
+	assert.Equal(t, toggle(task.ContentID, "2").Code, 200)
+
+	d, err := contentGet(ctx(), u, idx.getNote("n1").ContentID)
+	assert.NoError(t, err)
+	assert.Equal(t, string(d), "- [x] one\n- [x] two\n")
+}
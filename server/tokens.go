@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API tokens allow scripts and command-line tools to access /api/store/*
+// without a browser cookie. They are sent as "Authorization: Bearer ${token}".
+// We only store sha256 of the token so a leaked tokens.json doesn't leak tokens.
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+
+	apiTokenPrefix = "nt_"
+)
+
+// higher scope includes lower scopes i.e. write can also read
+var scopeLevels = map[string]int{
+	scopeRead:  1,
+	scopeWrite: 2,
+	scopeAdmin: 3,
+}
+
+type APIToken struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	User       string    `json:"user"`
+	Email      string    `json:"email"`
+	Name       string    `json:"name"`
+	Scope      string    `json:"scope"`
+	Hash       string    `json:"hash,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+var (
+	apiTokens       []*APIToken
+	apiTokensLoaded bool
+	// when we last persisted LastUsedAt changes
+	apiTokensSavedAt time.Time
+
+	muTokens sync.Mutex
+)
+
+func tokensFilePath() string {
+	return filepath.Join(getDataDirMust(), "tokens.json")
+}
+
+func loadAPITokensLocked() {
+	if apiTokensLoaded {
+		return
+	}
+	apiTokensLoaded = true
+	path := tokensFilePath()
+	err := readJSONFile(path, &apiTokens)
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf("loadAPITokensLocked: readJSONFile('%s') failed with '%s'\n", path, err)
+	}
+	// tokens created before we had user ids
+	for _, t := range apiTokens {
+		if t.UserID == "" {
+			t.UserID = findUserIDByEmail(t.Email)
+		}
+	}
+	logf("loaded %d api tokens\n", len(apiTokens))
+}
+
+func saveAPITokensLocked() error {
+	apiTokensSavedAt = time.Now()
+	return writeJSONFileAtomic(tokensFilePath(), apiTokens)
+}
+
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func isValidScope(scope string) bool {
+	return scopeLevels[scope] > 0
+}
+
+func scopeAllows(have string, want string) bool {
+	return scopeLevels[have] >= scopeLevels[want]
+}
+
+func genSecureRandomHex(nBytes int) string {
+	d := make([]byte, nBytes)
+	_, err := rand.Read(d)
+	must(err)
+	return hex.EncodeToString(d)
+}
+
+// returns the token (the only time we know its value) and its info
+func createAPIToken(userID, user, email, name, scope string) (string, *APIToken, error) {
+	if !isValidScope(scope) {
+		return "", nil, fmt.Errorf("invalid scope '%s', must be one of: read, write, admin", scope)
+	}
+	token := apiTokenPrefix + genSecureRandomHex(24)
+	t := &APIToken{
+		ID:        genSecureRandomHex(4),
+		UserID:    userID,
+		User:      user,
+		Email:     email,
+		Name:      name,
+		Scope:     scope,
+		Hash:      hashAPIToken(token),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	muTokens.Lock()
+	defer muTokens.Unlock()
+	loadAPITokensLocked()
+	apiTokens = append(apiTokens, t)
+	err := saveAPITokensLocked()
+	if err != nil {
+		apiTokens = apiTokens[:len(apiTokens)-1]
+		return "", nil, err
+	}
+	logf("createAPIToken: created token '%s' (%s) for '%s'\n", t.ID, scope, userID)
+	return token, t, nil
+}
+
+// returns copies of tokens of a given user, without the hash
+func listAPITokens(userID string) []*APIToken {
+	muTokens.Lock()
+	defer muTokens.Unlock()
+	loadAPITokensLocked()
+
+	res := []*APIToken{}
+	for _, t := range apiTokens {
+		if t.UserID != userID {
+			continue
+		}
+		c := *t
+		c.Hash = ""
+		res = append(res, &c)
+	}
+	return res
+}
+
+func revokeAPIToken(userID string, id string) error {
+	muTokens.Lock()
+	defer muTokens.Unlock()
+	loadAPITokensLocked()
+
+	for i, t := range apiTokens {
+		if t.ID == id && t.UserID == userID {
+			apiTokens = append(apiTokens[:i], apiTokens[i+1:]...)
+			logf("revokeAPIToken: revoked token '%s' of '%s'\n", id, userID)
+			return saveAPITokensLocked()
+		}
+	}
+	return fmt.Errorf("token '%s' not found", id)
+}
+
+// returns a copy of the token info or nil if token is not valid
+func findAPIToken(token string) *APIToken {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil
+	}
+	hash := hashAPIToken(token)
+
+	muTokens.Lock()
+	defer muTokens.Unlock()
+	loadAPITokensLocked()
+
+	for _, t := range apiTokens {
+		if t.Hash != hash {
+			continue
+		}
+		// created before we had user ids and the user hasn't logged in since
+		if t.UserID == "" {
+			t.UserID = findUserIDByEmail(t.Email)
+			if t.UserID == "" {
+				return nil
+			}
+		}
+		t.LastUsedAt = time.Now().UTC()
+		// don't re-write the file on every api call
+		if time.Since(apiTokensSavedAt) > time.Minute {
+			err := saveAPITokensLocked()
+			logIfErrf(ctx(), err)
+		}
+		c := *t
+		return &c
+	}
+	return nil
+}
+
+// returns "" if there's no "Authorization: Bearer ${token}" header
+func getBearerToken(r *http.Request) string {
+	s := r.Header.Get("Authorization")
+	s, ok := trimPrefix(s, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(s)
+}
+
+type apiTokenKey struct{}
+
+// call when starting to handle HTTP request so that we look up the token
+// once. nil token in the context means the token is not valid
+func withAPIToken(r *http.Request) *http.Request {
+	token := getBearerToken(r)
+	if token == "" {
+		return r
+	}
+	t := findAPIToken(token)
+	return r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, t))
+}
+
+// returns false if the request doesn't have a token. Token is nil
+// if it's not valid
+func requestAPIToken(r *http.Request) (*APIToken, bool) {
+	if t, ok := r.Context().Value(apiTokenKey{}).(*APIToken); ok {
+		return t, true
+	}
+	token := getBearerToken(r)
+	if token == "" {
+		return nil, false
+	}
+	// request didn't go through withAPIToken
+	return findAPIToken(token), true
+}
+
+// requests authenticated with a cookie have all scopes, requests
+// authenticated with a token have the scope of the token
+func checkScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	t, hasToken := requestAPIToken(r)
+	if !hasToken {
+		return true
+	}
+	if t != nil && scopeAllows(t.Scope, scope) {
+		return true
+	}
+	serveError(w, r, fmt.Sprintf("api token doesn't have '%s' scope", scope), http.StatusForbidden)
+	return false
+}
+
+// /api/store/createToken?name=${name}&scope=${scope}
+// /api/store/listTokens
+// /api/store/revokeToken?id=${id}
+// returns false if uri is not a tokens api
+func handleTokens(w http.ResponseWriter, r *http.Request, u *UserInfo) bool {
+	uri := r.URL.Path
+	switch uri {
+	case "/api/store/createToken":
+		if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeAdmin) {
+			return true
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		scope := strings.TrimSpace(r.FormValue("scope"))
+		if scope == "" {
+			scope = scopeRead
+		}
+		token, t, err := createAPIToken(u.ID, u.User, u.Email, name, scope)
+		if err != nil {
+			serveError(w, r, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		res := map[string]any{
+			"token": token,
+			"id":    t.ID,
+			"name":  t.Name,
+			"scope": t.Scope,
+		}
+		serveJSONOK(w, r, res)
+		return true
+	case "/api/store/listTokens":
+		if !checkScope(w, r, scopeAdmin) {
+			return true
+		}
+		serveJSONOK(w, r, listAPITokens(u.ID))
+		return true
+	case "/api/store/revokeToken":
+		if !checkMethodPOSTorPUT(w, r) || !checkScope(w, r, scopeAdmin) {
+			return true
+		}
+		err := revokeAPIToken(u.ID, r.FormValue("id"))
+		if err != nil {
+			serveError(w, r, err.Error(), http.StatusNotFound)
+			return true
+		}
+		serveJSONOK(w, r, map[string]any{"ok": true})
+		return true
+	}
+	return false
+}
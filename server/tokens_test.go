@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestAPITokenLookup(t *testing.T) {
+	dataDir = t.TempDir()
+	defer func() {
+		dataDir = ""
+		apiTokens = nil
+		apiTokensLoaded = false
+	}()
+	token, at, err := createAPIToken("local-jo", "jo", "jo@example.com", "test", scopeRead)
+	assert.NoError(t, err)
+	assert.True(t, regexp.MustCompile(`^[0-9a-f]{8}$`).MatchString(at.ID))
+
+	r := httptest.NewRequest("GET", "/api/store/getLogs", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r = withAPIToken(r)
+	// looked up once, in withAPIToken
+	assert.NoError(t, revokeAPIToken("local-jo", at.ID))
+	got, hasToken := requestAPIToken(r)
+	assert.True(t, hasToken)
+	assert.Equal(t, got.ID, at.ID)
+
+	w := httptest.NewRecorder()
+	assert.True(t, checkScope(w, r, scopeRead))
+	assert.False(t, checkScope(w, r, scopeWrite))
+	assert.Equal(t, w.Code, 403)
+
+	r = httptest.NewRequest("GET", "/api/store/getLogs", nil)
+	r.Header.Set("Authorization", "Bearer nt_invalid")
+	got, hasToken = requestAPIToken(withAPIToken(r))
+	assert.True(t, hasToken)
+	assert.Nil(t, got)
+
+	_, hasToken = requestAPIToken(withAPIToken(httptest.NewRequest("GET", "/", nil)))
+	assert.False(t, hasToken)
+}
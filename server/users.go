@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// users are identified by a stable id derived from the login provider,
+// e.g. "github-1234" and their data is stored in data/<id>/
+// Emails can change and can contain characters not allowed in file names.
+//
+// users.json maps emails to ids. We use it to find the user for tokens
+// issued before we had ids and to migrate old directories that were
+// named after the email.
+
+type RegisteredUser struct {
+	ID    string `json:"id"`
+	Login string `json:"login"`
+	// all emails we've seen for this user, most recent first
+	Emails      []string  `json:"emails"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+var (
+	registeredUsers       []*RegisteredUser
+	registeredUsersLoaded bool
+
+	muUsers sync.Mutex
+)
+
+var rxUserID = regexp.MustCompile(`^[a-z]+-[0-9A-Za-z_-]+$`)
+
+func githubUserID(id int) string {
+	return fmt.Sprintf("github-%d", id)
+}
+
+func isValidUserID(id string) bool {
+	return rxUserID.MatchString(id)
+}
+
+func userDataDir(id string) string {
+	return filepath.Join(getDataDirMust(), id)
+}
+
+func usersFilePath() string {
+	return filepath.Join(getDataDirMust(), "users.json")
+}
+
+func loadRegisteredUsersLocked() {
+	if registeredUsersLoaded {
+		return
+	}
+	registeredUsersLoaded = true
+	path := usersFilePath()
+	err := readJSONFile(path, &registeredUsers)
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf("loadRegisteredUsersLocked: readJSONFile('%s') failed with '%s'\n", path, err)
+	}
+	logf("loaded %d registered users\n", len(registeredUsers))
+}
+
+func saveRegisteredUsersLocked() error {
+	return writeJSONFileAtomic(usersFilePath(), registeredUsers)
+}
+
+func findRegisteredUserLocked(id string) *RegisteredUser {
+	for _, ru := range registeredUsers {
+		if ru.ID == id {
+			return ru
+		}
+	}
+	return nil
+}
+
+// returns "" if we don't know the user
+func findUserIDByEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	muUsers.Lock()
+	defer muUsers.Unlock()
+	loadRegisteredUsersLocked()
+	for _, ru := range registeredUsers {
+		for _, e := range ru.Emails {
+			if strings.EqualFold(e, email) {
+				return ru.ID
+			}
+		}
+	}
+	return ""
+}
+
+// called after successful login. Remembers the emails (current first) and,
+// the first time we see the user, moves data/<email> directory to data/<id>
+func registerUserLogin(id, login string, emails []string) error {
+	if !isValidUserID(id) {
+		return fmt.Errorf("invalid user id '%s'", id)
+	}
+	muUsers.Lock()
+	defer muUsers.Unlock()
+	loadRegisteredUsersLocked()
+
+	now := time.Now().UTC()
+	ru := findRegisteredUserLocked(id)
+	if ru == nil {
+		ru = &RegisteredUser{
+			ID:        id,
+			CreatedAt: now,
+		}
+		registeredUsers = append(registeredUsers, ru)
+		logf("registerUserLogin: new user '%s', login: '%s'\n", id, login)
+	}
+	ru.Login = login
+	ru.LastLoginAt = now
+	for i := len(emails) - 1; i >= 0; i-- {
+		email := emails[i]
+		if email == "" {
+			continue
+		}
+		ru.Emails = slices.DeleteFunc(ru.Emails, func(e string) bool {
+			return strings.EqualFold(e, email)
+		})
+		ru.Emails = append([]string{email}, ru.Emails...)
+	}
+	migrateLegacyUserDir(id, ru.Emails)
+	return saveRegisteredUsersLocked()
+}
+
+// before we had user ids, user data was in data/<email>
+func migrateLegacyUserDir(id string, emails []string) {
+	dstDir := userDataDir(id)
+	if _, err := os.Stat(dstDir); err == nil {
+		return
+	}
+	for _, email := range emails {
+		// emails come from login provider but let's not trust them with paths
+		if email == "" || email != filepath.Base(email) || strings.HasPrefix(email, ".") {
+			continue
+		}
+		srcDir := filepath.Join(getDataDirMust(), email)
+		if _, err := os.Stat(srcDir); err != nil {
+			continue
+		}
+		err := os.Rename(srcDir, dstDir)
+		if err != nil {
+			logErrorf("migrateLegacyUserDir: os.Rename('%s', '%s') failed with '%s'\n", srcDir, dstDir, err)
+			return
+		}
+		logf("migrateLegacyUserDir: moved '%s' to '%s'\n", srcDir, dstDir)
+		return
+	}
+}
+
+// called at startup so that old tokens work without the user logging in
+// again. Directories of users we haven't seen log in since we have ids
+// are moved when they log in.
+func migrateLegacyUserDirs() {
+	muUsers.Lock()
+	defer muUsers.Unlock()
+	loadRegisteredUsersLocked()
+	for _, ru := range registeredUsers {
+		migrateLegacyUserDir(ru.ID, ru.Emails)
+	}
+	entries, err := os.ReadDir(getDataDirMust())
+	if err != nil {
+		logErrorf("migrateLegacyUserDirs: %s\n", err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.Contains(e.Name(), "@") {
+			logWarnf("migrateLegacyUserDirs: don't know user id for '%s', will move it when the user logs in\n", e.Name())
+		}
+	}
+}
+
+// returns copies of all registered users
+func listRegisteredUsers() []*RegisteredUser {
+	muUsers.Lock()
+	defer muUsers.Unlock()
+	loadRegisteredUsersLocked()
+
+	res := []*RegisteredUser{}
+	for _, ru := range registeredUsers {
+		c := *ru
+		c.Emails = slices.Clone(ru.Emails)
+		res = append(res, &c)
+	}
+	return res
+}
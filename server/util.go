@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 
+	"github.com/kjk/common/atomicfile"
 	"github.com/kjk/common/u"
 )
 
@@ -89,6 +91,37 @@ func serveJSONOK(w http.ResponseWriter, r *http.Request, v interface{}) {
 	logIfErrf(r.Context(), err)
 }
 
+// readJSONFile returns os.ErrNotExist (check with os.IsNotExist) if file doesn't exist
+func readJSONFile(path string, v any) error {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
+
+// writes the file atomically so that a crash doesn't leave a half-written file
+func writeJSONFileAtomic(path string, v any) error {
+	d, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := atomicfile.New(path)
+	if err != nil {
+		return err
+	}
+	defer f.RemoveIfNotClosed()
+	_, err = f.Write(d)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func startLoggedInDir(dir string, exe string, args ...string) (func(), error) {
 	cmd := exec.Command(exe, args...)
 	cmd.Dir = dir